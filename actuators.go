@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
+
+// AccessoryMetadata is what the Home app shows about an accessory besides its
+// name and serial.
+type AccessoryMetadata struct {
+	Manufacturer     string `json:"manufacturer,omitempty"`
+	Model            string `json:"model,omitempty"`
+	FirmwareRevision string `json:"firmware_revision,omitempty"`
+	HardwareRevision string `json:"hardware_revision,omitempty"`
+}
+
+const defaultManufacturer = "Stefan"
+
+// metadata returns the metadata of the sensor, with what it does not set
+// taken from the defaults.
+func (c SensorConfig) metadata(defaults *AccessoryMetadata) AccessoryMetadata {
+	metadata := AccessoryMetadata{Manufacturer: defaultManufacturer}
+	if defaults != nil {
+		if defaults.Manufacturer != "" {
+			metadata.Manufacturer = defaults.Manufacturer
+		}
+		metadata.Model = defaults.Model
+		metadata.FirmwareRevision = defaults.FirmwareRevision
+		metadata.HardwareRevision = defaults.HardwareRevision
+	}
+	for _, field := range []struct{ value, by *string }{
+		{&metadata.Manufacturer, &c.Manufacturer},
+		{&metadata.Model, &c.Model},
+		{&metadata.FirmwareRevision, &c.FirmwareRevision},
+		{&metadata.HardwareRevision, &c.HardwareRevision},
+	} {
+		if *field.by != "" {
+			*field.value = *field.by
+		}
+	}
+	return metadata
+}
+
+func accessoryInfo(config SensorConfig, id uint64) accessory.Info {
+	metadata := config.metadata(liveConfig().Bridge.SensorDefaults)
+	return accessory.Info{
+		Name:             config.Name,
+		Manufacturer:     metadata.Manufacturer,
+		Model:            metadata.Model,
+		FirmwareRevision: metadata.FirmwareRevision,
+		SerialNumber:     config.Serial,
+		ID:               id,
+	}
+}
+
+// addHardwareRevision adds the hardware revision of a sensor, when it has
+// one, to the information service of its accessory.
+func addHardwareRevision(config SensorConfig, ac *accessory.Accessory) {
+	metadata := config.metadata(liveConfig().Bridge.SensorDefaults)
+	if metadata.HardwareRevision == "" {
+		return
+	}
+	revision := characteristic.NewHardwareRevision()
+	revision.SetValue(metadata.HardwareRevision)
+	ac.Info.AddCharacteristic(revision.Characteristic)
+}
+
+// watchFirmwareRevision keeps the FirmwareRevision of an accessory in line with
+// the firmware version its device reports, which wins over the configured one.
+func watchFirmwareRevision(config SensorConfig, ac *accessory.Accessory) {
+	if version, ok := store.FirmwareVersion(config.Serial); ok {
+		ac.Info.FirmwareRevision.SetValue(version)
+	}
+
+	store.OnUpdate(config.Serial, func(measurement Measurement) {
+		if measurement.FirmwareVersion != "" {
+			ac.Info.FirmwareRevision.SetValue(measurement.FirmwareVersion)
+		}
+	})
+}
+
+func createSwitch(config SensorConfig, id uint64) (*accessory.Accessory, error) {
+	ac := accessory.New(accessoryInfo(config, id), accessory.TypeSwitch)
+
+	sw := service.NewSwitch()
+
+	// The device confirms the new state in its next report. If the command got
+	// lost that report reverts the switch to what the device is really doing.
+	sw.On.OnValueRemoteUpdate(func(on bool) {
+		if err := downlink.Send(config, Command{On: &on}); err != nil {
+			log.Printf("Could not switch <%s>: %v", config.Serial, err)
+		}
+	})
+
+	if measurement, ok := store.Latest(config.Serial); ok && measurement.MeasurementData.On != nil {
+		sw.On.SetValue(*measurement.MeasurementData.On)
+	}
+
+	onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+		if measurement.MeasurementData.On != nil {
+			sw.On.SetValue(*measurement.MeasurementData.On)
+		}
+	})
+
+	ac.AddService(sw.Service)
+
+	return ac, nil
+}
+
+// thermostat runs a simple on/off heating loop: the relay is switched on when
+// the temperature drops below the target minus the hysteresis and off again
+// once it rises above the target plus the hysteresis.
+type thermostat struct {
+	mutex   sync.Mutex
+	config  SensorConfig
+	service *service.Thermostat
+	heating bool
+}
+
+func (t *thermostat) update() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	measurement, ok := store.Latest(t.config.Sensor)
+	if !ok || measurement.MeasurementData.Temperature == nil {
+		return
+	}
+
+	temperature := float64(*measurement.MeasurementData.Temperature)
+	target := t.service.TargetTemperature.GetValue()
+	hysteresis := float64(t.config.Hysteresis)
+
+	heating := t.heating
+	switch {
+	case t.service.TargetHeatingCoolingState.GetValue() == characteristic.TargetHeatingCoolingStateOff:
+		heating = false
+	case temperature < target-hysteresis:
+		heating = true
+	case temperature > target+hysteresis:
+		heating = false
+	}
+
+	if heating != t.heating {
+		log.Printf("%s: Temperature <%f> target <%f>, heating <%v>", t.config.Serial, temperature, target, heating)
+		t.heating = heating
+		t.send()
+	}
+}
+
+func (t *thermostat) send() {
+	heating := t.heating
+	if err := downlink.Send(t.config, Command{On: &heating}); err != nil {
+		log.Printf("Could not switch relay <%s>: %v", t.config.Serial, err)
+	}
+}
+
+// relayReported keeps CurrentHeatingCoolingState in line with what the relay
+// says it is doing, and repeats the command if the relay disagrees with us.
+func (t *thermostat) relayReported(measurement Measurement) {
+	if measurement.MeasurementData.On == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if *measurement.MeasurementData.On {
+		t.service.CurrentHeatingCoolingState.SetValue(characteristic.CurrentHeatingCoolingStateHeat)
+	} else {
+		t.service.CurrentHeatingCoolingState.SetValue(characteristic.CurrentHeatingCoolingStateOff)
+	}
+
+	if *measurement.MeasurementData.On != t.heating {
+		t.send()
+	}
+}
+
+func createThermostat(config SensorConfig, id uint64) (*accessory.Accessory, error) {
+	if config.Sensor == "" {
+		return nil, fmt.Errorf("thermostat <%s> needs a temperature sensor", config.Serial)
+	}
+
+	ac := accessory.New(accessoryInfo(config, id), accessory.TypeThermostat)
+
+	t := &thermostat{
+		config:  config,
+		service: service.NewThermostat(),
+	}
+
+	if t.config.Hysteresis == 0 {
+		t.config.Hysteresis = 0.5
+	}
+
+	// Only heating is supported, the relay drives a heater
+	t.service.TargetHeatingCoolingState.SetMaxValue(characteristic.TargetHeatingCoolingStateHeat)
+	t.service.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateHeat)
+	if config.TargetTemperature != 0 {
+		t.service.TargetTemperature.SetValue(float64(config.TargetTemperature))
+	}
+	configureTemperature(config.Temperature, t.service.CurrentTemperature, t.service.TemperatureDisplayUnits)
+
+	t.service.CurrentTemperature.OnValueGet(func() interface{} {
+		if measurement, ok := store.Latest(config.Sensor); ok && measurement.MeasurementData.Temperature != nil {
+			return config.homeKitValue(*measurement.MeasurementData.Temperature)
+		}
+		return 0.0
+	})
+
+	t.service.TargetTemperature.OnValueRemoteUpdate(func(float64) { t.update() })
+	t.service.TargetHeatingCoolingState.OnValueRemoteUpdate(func(int) { t.update() })
+
+	onHomeKitUpdate(config.Sensor, config.notifyWindow(), func(measurement Measurement) {
+		if measurement.MeasurementData.Temperature != nil {
+			t.service.CurrentTemperature.SetValue(config.homeKitValue(*measurement.MeasurementData.Temperature))
+		}
+		t.update()
+	})
+	onHomeKitUpdate(config.Serial, config.notifyWindow(), t.relayReported)
+
+	ac.AddService(t.service.Service)
+
+	return ac, nil
+}
+
+func createFan(config SensorConfig, id uint64) (*accessory.Accessory, error) {
+	ac := accessory.New(accessoryInfo(config, id), accessory.TypeFan)
+
+	fan := service.NewFan()
+
+	speed := characteristic.NewRotationSpeed()
+	fan.AddCharacteristic(speed.Characteristic)
+
+	fan.On.OnValueRemoteUpdate(func(on bool) {
+		if err := downlink.Send(config, Command{On: &on}); err != nil {
+			log.Printf("Could not switch fan <%s>: %v", config.Serial, err)
+		}
+	})
+
+	speed.OnValueRemoteUpdate(func(value float64) {
+		percent := int(value)
+		if err := downlink.Send(config, Command{Speed: &percent}); err != nil {
+			log.Printf("Could not set speed of fan <%s>: %v", config.Serial, err)
+		}
+	})
+
+	onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+		if measurement.MeasurementData.On != nil {
+			fan.On.SetValue(*measurement.MeasurementData.On)
+		}
+		if measurement.MeasurementData.Speed != nil {
+			speed.SetValue(float64(*measurement.MeasurementData.Speed))
+		}
+	})
+
+	ac.AddService(fan.Service)
+
+	return ac, nil
+}
+
+func createWindowCovering(config SensorConfig, id uint64) (*accessory.Accessory, error) {
+	ac := accessory.New(accessoryInfo(config, id), accessory.TypeWindowCovering)
+
+	covering := service.NewWindowCovering()
+	covering.PositionState.SetValue(characteristic.PositionStateStopped)
+
+	var mutex sync.Mutex
+	reported := false
+
+	updatePositionState := func() {
+		current, target := covering.CurrentPosition.GetValue(), covering.TargetPosition.GetValue()
+		switch {
+		case target > current:
+			covering.PositionState.SetValue(characteristic.PositionStateIncreasing)
+		case target < current:
+			covering.PositionState.SetValue(characteristic.PositionStateDecreasing)
+		default:
+			covering.PositionState.SetValue(characteristic.PositionStateStopped)
+		}
+	}
+
+	covering.TargetPosition.OnValueRemoteUpdate(func(position int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if err := downlink.Send(config, Command{Position: &position}); err != nil {
+			log.Printf("Could not move <%s>: %v", config.Serial, err)
+		}
+		updatePositionState()
+	})
+
+	onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+		if measurement.MeasurementData.Position == nil {
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		position := *measurement.MeasurementData.Position
+		covering.CurrentPosition.SetValue(position)
+
+		// Until we have moved it ourselves the device decides where it is going
+		if !reported {
+			reported = true
+			covering.TargetPosition.SetValue(position)
+		}
+		updatePositionState()
+	})
+
+	ac.AddService(covering.Service)
+
+	return ac, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MetricSource is where a logical sensor takes one of its values from. It is
+// either the ID of a single sensor or an object listing several sensors and
+// how to combine their values: "mean" (the default), "min", "max", "median",
+// "sum", "latest" or "failover". With a Probe the value is that temperature
+// channel of the sensors, like {"sensors": ["garden"], "probe": "soil"}.
+//
+// With "failover" the sensors are in order of preference and the value comes
+// from the first one that reported it within StaleAfter seconds, like a
+// wired probe with a wireless backup.
+type MetricSource struct {
+	Sensors    []string `json:"sensors"`
+	Aggregate  string   `json:"aggregate,omitempty"`
+	Probe      string   `json:"probe,omitempty"`
+	StaleAfter int      `json:"stale_after,omitempty"`
+}
+
+// defaultStaleAfter is when a failover source is passed over if it does not
+// set its own.
+const defaultStaleAfter = 10 * time.Minute
+
+func (m MetricSource) staleAfter() time.Duration {
+	if m.StaleAfter > 0 {
+		return time.Duration(m.StaleAfter) * time.Second
+	}
+	return defaultStaleAfter
+}
+
+func (m *MetricSource) UnmarshalJSON(b []byte) error {
+	var sensorID string
+	if err := json.Unmarshal(b, &sensorID); err == nil {
+		*m = MetricSource{Sensors: []string{sensorID}}
+		return nil
+	}
+
+	type metricSource MetricSource
+	return json.Unmarshal(b, (*metricSource)(m))
+}
+
+var aggregates = map[string]func([]float64) float64{
+	"mean": func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	},
+	"min": func(values []float64) float64 {
+		min := values[0]
+		for _, v := range values[1:] {
+			if v < min {
+				min = v
+			}
+		}
+		return min
+	},
+	"max": func(values []float64) float64 {
+		max := values[0]
+		for _, v := range values[1:] {
+			if v > max {
+				max = v
+			}
+		}
+		return max
+	},
+	"median": func(values []float64) float64 {
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		if n := len(sorted); n%2 == 0 {
+			return (sorted[n/2-1] + sorted[n/2]) / 2
+		}
+		return sorted[len(sorted)/2]
+	},
+	"sum": func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+}
+
+// virtualMetrics are the values a virtual sensor takes from its members.
+var virtualMetrics = []string{"temperature", "humidity", "pressure"}
+
+// sources returns where the values of a sensor come from. Virtual sensors
+// take all their values from their members unless a source says otherwise.
+func (c SensorConfig) sources() map[string]MetricSource {
+	if c.Type != "virtual" {
+		return c.Sources
+	}
+
+	sources := map[string]MetricSource{}
+	for _, metric := range virtualMetrics {
+		sources[metric] = MetricSource{Sensors: c.Members, Aggregate: c.Aggregate}
+	}
+	for metric, source := range c.Sources {
+		sources[metric] = source
+	}
+	return sources
+}
+
+func aggregateFunc(name string) (func([]float64) float64, error) {
+	switch name {
+	case "":
+		return aggregates["mean"], nil
+	case "latest", "failover":
+		return nil, nil
+	}
+	if fn, ok := aggregates[name]; ok {
+		return fn, nil
+	}
+	return nil, fmt.Errorf("unknown aggregate <%s>", name)
+}
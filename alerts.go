@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Alert struct {
+	SensorID string    `json:"sensor_id"`
+	Name     string    `json:"name"`
+	Message  string    `json:"message"`
+	Since    time.Time `json:"since"`
+}
+
+// AlertEvent is an alert firing or being resolved.
+type AlertEvent struct {
+	Time     time.Time `json:"time"`
+	SensorID string    `json:"sensor_id"`
+	Name     string    `json:"name"`
+	Event    string    `json:"event"`
+	Message  string    `json:"message"`
+}
+
+// maxAlertEvents is how many events are kept for the API.
+const maxAlertEvents = 100
+
+type Alerts struct {
+	mutex     sync.Mutex
+	active    map[string]Alert
+	events    []AlertEvent
+	listeners map[string][]func(active bool)
+}
+
+var alerts = &Alerts{active: map[string]Alert{}, listeners: map[string][]func(bool){}}
+
+// OnChange calls fn when the named alert of a sensor fires or resolves.
+func (a *Alerts) OnChange(sensorID, name string, fn func(active bool)) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	key := sensorID + "/" + name
+	a.listeners[key] = append(a.listeners[key], fn)
+}
+
+// Raise fires an alert unless it is already active. Alerts are keyed by sensor
+// and name, so a sensor that stays below its threshold only alerts once.
+func (a *Alerts) Raise(sensorID, name, message string) {
+	a.RaiseTo(nil, sensorID, name, message)
+}
+
+// RaiseTo is Raise for alerts that only go to some notification channels.
+func (a *Alerts) RaiseTo(channels []string, sensorID, name, message string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	key := sensorID + "/" + name
+	if _, ok := a.active[key]; ok {
+		return
+	}
+
+	a.active[key] = Alert{SensorID: sensorID, Name: name, Message: message, Since: clock.Now()}
+	a.record(AlertEvent{Time: clock.Now(), SensorID: sensorID, Name: name, Event: "fired", Message: message})
+	log.Printf("[!] %s: %s", sensorID, message)
+	deliverTo(channels, "Alert for "+sensorID, message)
+	for _, listener := range a.listeners[key] {
+		listener(true)
+	}
+}
+
+func (a *Alerts) Clear(sensorID, name string) {
+	a.ClearTo(nil, sensorID, name)
+}
+
+// ClearTo is Clear for alerts that only go to some notification channels.
+func (a *Alerts) ClearTo(channels []string, sensorID, name string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	key := sensorID + "/" + name
+	if _, ok := a.active[key]; !ok {
+		return
+	}
+
+	delete(a.active, key)
+	message := fmt.Sprintf("Alert %s is resolved", name)
+	a.record(AlertEvent{Time: clock.Now(), SensorID: sensorID, Name: name, Event: "resolved", Message: message})
+	log.Printf("[*] %s: Alert <%s> resolved", sensorID, name)
+	deliverTo(channels, "Resolved for "+sensorID, message)
+	for _, listener := range a.listeners[key] {
+		listener(false)
+	}
+}
+
+// record keeps an event for the API. The caller must hold the lock.
+func (a *Alerts) record(event AlertEvent) {
+	a.events = append(a.events, event)
+	if len(a.events) > maxAlertEvents {
+		a.events = a.events[len(a.events)-maxAlertEvents:]
+	}
+}
+
+func (a *Alerts) List() []Alert {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	list := []Alert{}
+	for _, alert := range a.active {
+		list = append(list, alert)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Since.Before(list[j].Since)
+	})
+	return list
+}
+
+// Events returns the recent events, newest first.
+func (a *Alerts) Events() []AlertEvent {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	events := make([]AlertEvent, 0, len(a.events))
+	for i := len(a.events) - 1; i >= 0; i-- {
+		events = append(events, a.events[i])
+	}
+	return events
+}
+
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(alerts.List()); err != nil {
+		log.Println("Failed to encode alerts: ", err)
+	}
+}
+
+func handleAlertEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(alerts.Events()); err != nil {
+		log.Println("Failed to encode alert events: ", err)
+	}
+}
+
+const defaultRSSIThreshold = -85
+
+// watchAlerts raises and clears the alerts of a sensor as its measurements
+// come in.
+func watchAlerts(serial string) {
+	store.OnUpdate(serial, func(measurement Measurement) {
+		config, ok := liveSensor(serial)
+		if !ok {
+			return
+		}
+		data := measurement.MeasurementData
+
+		if config.DryThreshold != 0 && data.Moisture != nil {
+			if *data.Moisture < config.DryThreshold {
+				alerts.Raise(config.Serial, "dry", fmt.Sprintf("%s is dry, moisture %.0f%% is below %.0f%%", config.Name, *data.Moisture, config.DryThreshold))
+			} else {
+				alerts.Clear(config.Serial, "dry")
+			}
+		}
+
+		if config.LowLevelThreshold != 0 && data.Level != nil {
+			if *data.Level < config.LowLevelThreshold {
+				alerts.Raise(config.Serial, "low_level", fmt.Sprintf("%s is low, level %.0f%% is below %.0f%%", config.Name, *data.Level, config.LowLevelThreshold))
+			} else {
+				alerts.Clear(config.Serial, "low_level")
+			}
+		}
+
+		if config.HighLevelThreshold != 0 && data.Level != nil {
+			if *data.Level > config.HighLevelThreshold {
+				alerts.Raise(config.Serial, "high_level", fmt.Sprintf("%s is high, level %.0f%% is above %.0f%%", config.Name, *data.Level, config.HighLevelThreshold))
+			} else {
+				alerts.Clear(config.Serial, "high_level")
+			}
+		}
+
+		if config.Filter && data.FilterLife != nil {
+			if *data.FilterLife < config.filterThreshold() {
+				alerts.Raise(config.Serial, "filter", fmt.Sprintf("%s needs a new filter, %.0f%% of its life is left", config.Name, *data.FilterLife))
+			} else {
+				alerts.Clear(config.Serial, "filter")
+			}
+		}
+
+		if config.NoiseThreshold != 0 && data.Noise != nil {
+			if *data.Noise > config.NoiseThreshold {
+				alerts.Raise(config.Serial, "noise", fmt.Sprintf("%s is noisy, %.0f dBA is above %.0f dBA", config.Name, *data.Noise, config.NoiseThreshold))
+			} else {
+				alerts.Clear(config.Serial, "noise")
+			}
+		}
+
+		if stats, ok := store.Stats(config.Serial); ok && stats.RSSIAverage != nil {
+			threshold := defaultRSSIThreshold
+			if config.RSSIThreshold != 0 {
+				threshold = config.RSSIThreshold
+			}
+			if *stats.RSSIAverage < float64(threshold) {
+				alerts.Raise(config.Serial, "rssi", fmt.Sprintf("%s has a %s link, signal strength %.0f dBm is below %d dBm", config.Name, stats.LinkQuality, *stats.RSSIAverage, threshold))
+			} else {
+				alerts.Clear(config.Serial, "rssi")
+			}
+		}
+
+		if data.Faulted() {
+			alerts.Raise(config.Serial, "fault", fmt.Sprintf("%s reports a fault: %s", config.Name, data.Status))
+		} else {
+			alerts.Clear(config.Serial, "fault")
+		}
+
+		if data.Tampered != nil {
+			if *data.Tampered {
+				alerts.Raise(config.Serial, "tampered", fmt.Sprintf("%s has been tampered with", config.Name))
+			} else {
+				alerts.Clear(config.Serial, "tampered")
+			}
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// AnomalyConfig turns on anomaly detection for a sensor. A value that is more
+// than ZScore standard deviations away from the moving average of the sensor
+// is dropped and the sensor reports a fault until a normal value comes in.
+// Detection starts after Warmup values. A value that stays anomalous for
+// Accept values in a row is taken as the new normal, for sensors that moved.
+type AnomalyConfig struct {
+	Metrics []string `json:"metrics,omitempty"`
+	ZScore  float64  `json:"z_score,omitempty"`
+	Warmup  int      `json:"warmup,omitempty"`
+	Accept  int      `json:"accept,omitempty"`
+}
+
+const (
+	defaultAnomalyZScore = 4
+	defaultAnomalyWarmup = 30
+	defaultAnomalyAccept = 5
+
+	// anomalyWeight is how much a new value moves the baseline
+	anomalyWeight = 0.05
+)
+
+// baseline is an exponentially weighted mean and variance of a value.
+type baseline struct {
+	mean, variance float64
+	count          int
+	outliers       int
+}
+
+func (b *baseline) add(value float64) {
+	if b.count == 0 {
+		b.mean = value
+	} else {
+		diff := value - b.mean
+		b.mean += anomalyWeight * diff
+		b.variance = (1 - anomalyWeight) * (b.variance + anomalyWeight*diff*diff)
+	}
+	b.count++
+}
+
+type AnomalyDetector struct {
+	mutex     sync.Mutex
+	baselines map[string]*baseline
+}
+
+var anomalies = &AnomalyDetector{baselines: map[string]*baseline{}}
+
+// Check drops the anomalous values from a measurement and marks it as faulted
+// if there were any. It returns the names of the dropped values.
+func (d *AnomalyDetector) Check(config AnomalyConfig, measurement *Measurement) []string {
+	if config.ZScore <= 0 {
+		config.ZScore = defaultAnomalyZScore
+	}
+	if config.Warmup <= 0 {
+		config.Warmup = defaultAnomalyWarmup
+	}
+	if config.Accept <= 0 {
+		config.Accept = defaultAnomalyAccept
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var dropped []string
+	v := reflect.ValueOf(&measurement.MeasurementData).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() != reflect.Ptr || field.IsNil() || field.Elem().Kind() != reflect.Float32 {
+			continue
+		}
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if len(config.Metrics) != 0 && !contains(config.Metrics, name) {
+			continue
+		}
+
+		key := measurement.SensorID + "/" + name
+		b, ok := d.baselines[key]
+		if !ok {
+			b = &baseline{}
+			d.baselines[key] = b
+		}
+
+		value := field.Elem().Float()
+		if b.count >= config.Warmup && !isNormal(b, value, config.ZScore) {
+			b.outliers++
+			if b.outliers < config.Accept {
+				dropped = append(dropped, name)
+				field.Set(reflect.Zero(field.Type()))
+				continue
+			}
+			log.Printf("[*] %s: Accepting %s <%g> as the new normal", measurement.SensorID, name, value)
+			*b = baseline{}
+		}
+		b.outliers = 0
+		b.add(value)
+	}
+
+	if len(dropped) != 0 && !measurement.MeasurementData.Faulted() {
+		measurement.MeasurementData.Status = "anomalous_" + strings.Join(dropped, "_")
+	}
+	return dropped
+}
+
+func isNormal(b *baseline, value, zScore float64) bool {
+	// A perfectly steady value would make any change anomalous
+	deviation := math.Max(math.Sqrt(b.variance), 0.01*math.Abs(b.mean)+0.1)
+	return math.Abs(value-b.mean)/deviation <= zScore
+}
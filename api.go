@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// APIConfig sets where the API listens. With a Token, requests need an
+// "Authorization: Bearer" header with it, with a Username and Password they
+// can use basic auth instead. Tokens adds tokens that can do less.
+type APIConfig struct {
+	Address string `json:"address"`
+
+	// RecentErrors is how many failed packets /api/v1/errors keeps
+	RecentErrors int `json:"recent_errors,omitempty"`
+
+	Token    string        `json:"token,omitempty"`
+	Username string        `json:"username,omitempty"`
+	Password string        `json:"password,omitempty"`
+	TLS      *APITLSConfig `json:"tls,omitempty"`
+	Tokens   []APIToken    `json:"tokens,omitempty"`
+
+	CORS CORSConfig `json:"cors"`
+}
+
+// handleSensors lists all sensors, optionally only those in the room, group
+// or with the tag given in the query.
+func handleSensors(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	units := liveConfig().Units
+	states := []SensorState{}
+	for _, state := range store.Snapshot() {
+		if state.matches(query.Get("room"), query.Get("group"), query.Get("tag")) {
+			states = append(states, outputStateUnits(state, units))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(states); err != nil {
+		log.Println("Failed to encode sensors: ", err)
+	}
+}
+
+func handlePending(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pendingSensors.List()); err != nil {
+		log.Println("Failed to encode pending sensors: ", err)
+	}
+}
+
+type approveRequest struct {
+	Name  string `json:"name"`
+	Model string `json:"model"`
+}
+
+// handleApprove handles POST /api/v1/pending/<id>/approve
+func handleApprove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/pending/")
+	if !strings.HasSuffix(path, "/approve") {
+		http.NotFound(w, r)
+		return
+	}
+	sensorID := strings.TrimSuffix(path, "/approve")
+
+	var request approveRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sensor, err := approveSensor(sensorID, request.Name, request.Model)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sensor); err != nil {
+		log.Println("Failed to encode sensor: ", err)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	states := store.Snapshot()
+
+	// Sensors whose measurement expired have no values to report
+	var live []SensorState
+	for _, state := range states {
+		if state.Measurement != nil {
+			live = append(live, state)
+		}
+	}
+
+	writeOptionalMetric(w, "sensor_bridge_temperature_celsius", "gauge", "Latest reported temperature.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.Temperature
+	})
+	writeOptionalMetric(w, "sensor_bridge_humidity_percent", "gauge", "Latest reported relative humidity.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.Humidity
+	})
+	writeOptionalMetric(w, "sensor_bridge_pressure_hpa", "gauge", "Latest reported air pressure.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.Pressure
+	})
+	writeOptionalMetric(w, "sensor_bridge_soil_moisture_percent", "gauge", "Latest reported soil moisture.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.Moisture
+	})
+	writeOptionalMetric(w, "sensor_bridge_level_percent", "gauge", "Latest reported tank level.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.Level
+	})
+	writeOptionalMetric(w, "sensor_bridge_filter_life_percent", "gauge", "Latest reported filter life left.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.FilterLife
+	})
+	writeOptionalMetric(w, "sensor_bridge_wind_speed_meters_per_second", "gauge", "Latest reported wind speed.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.WindSpeed
+	})
+	writeOptionalMetric(w, "sensor_bridge_wind_direction_degrees", "gauge", "Latest reported wind direction.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.WindDirection
+	})
+	writeOptionalMetric(w, "sensor_bridge_rain_millimeters", "gauge", "Latest reported rainfall.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.Rain
+	})
+	writeOptionalMetric(w, "sensor_bridge_uv_index", "gauge", "Latest reported UV index.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.UVIndex
+	})
+	writeOptionalMetric(w, "sensor_bridge_noise_dba", "gauge", "Latest reported sound level.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.Noise
+	})
+	writeOptionalMetric(w, "sensor_bridge_power_watts", "gauge", "Latest reported power consumption.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.Watts
+	})
+	writeOptionalMetric(w, "sensor_bridge_energy_kwh_total", "counter", "Latest reported energy meter reading.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.KWh
+	})
+	writeOptionalMetric(w, "sensor_bridge_voltage_volts", "gauge", "Latest reported voltage.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.Voltage
+	})
+	writeOptionalMetric(w, "sensor_bridge_current_amperes", "gauge", "Latest reported current.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.Current
+	})
+	writeOptionalMetric(w, "sensor_bridge_battery_volts", "gauge", "Latest reported battery voltage.", live, func(s SensorState) *float32 {
+		return s.Measurement.MeasurementData.Battery
+	})
+	writeDeclaredMetrics(w, liveConfig().Metrics, live)
+	writeOptionalMetric(w, "sensor_bridge_rssi_dbm", "gauge", "Latest reported Wi-Fi signal strength.", states, func(s SensorState) *float32 {
+		if s.Stats.RSSI == nil {
+			return nil
+		}
+		rssi := float32(*s.Stats.RSSI)
+		return &rssi
+	})
+	writeOptionalMetric(w, "sensor_bridge_rssi_average_dbm", "gauge", "Moving average of the Wi-Fi signal strength.", states, func(s SensorState) *float32 {
+		if s.Stats.RSSIAverage == nil {
+			return nil
+		}
+		rssi := float32(*s.Stats.RSSIAverage)
+		return &rssi
+	})
+	writeMetric(w, "sensor_bridge_packets_received_total", "counter", "Packets received per sensor.", states, func(s SensorState) float64 {
+		return float64(s.Stats.Received)
+	})
+	writeMetric(w, "sensor_bridge_parse_errors_total", "counter", "Packets per sensor that could not be decoded.", states, func(s SensorState) float64 {
+		return float64(s.Stats.ParseErrors)
+	})
+	writeMetric(w, "sensor_bridge_packets_lost_total", "counter", "Packets lost per sensor, based on sequence gaps.", states, func(s SensorState) float64 {
+		return float64(s.Stats.Lost)
+	})
+	writeMetric(w, "sensor_bridge_packets_duplicate_total", "counter", "Duplicate packets per sensor.", states, func(s SensorState) float64 {
+		return float64(s.Stats.Duplicates)
+	})
+	writeMetric(w, "sensor_bridge_packets_rate_limited_total", "counter", "Packets per sensor dropped by the rate limit.", states, func(s SensorState) float64 {
+		return float64(s.Stats.RateLimited)
+	})
+	writeMetric(w, "sensor_bridge_packets_out_of_order_total", "counter", "Packets per sensor taken before the latest measurement.", states, func(s SensorState) float64 {
+		return float64(s.Stats.OutOfOrder)
+	})
+	writeMetric(w, "sensor_bridge_packets_replayed_total", "counter", "Signed packets per sensor that were seen before.", states, func(s SensorState) float64 {
+		return float64(s.Stats.Replayed)
+	})
+	writeOptionalMetric(w, "sensor_bridge_clock_skew_seconds", "gauge", "How far the clock of a sensor is ahead of ours.", states, func(s SensorState) *float32 {
+		if s.Stats.ClockSkew == nil {
+			return nil
+		}
+		skew := float32(*s.Stats.ClockSkew)
+		return &skew
+	})
+	writeOptionalMetric(w, "sensor_bridge_latency_seconds", "gauge", "Moving average of the time from the sensor taking a measurement to the bridge receiving it.", states, func(s SensorState) *float32 {
+		if s.Stats.Latency == nil {
+			return nil
+		}
+		latency := float32(*s.Stats.Latency)
+		return &latency
+	})
+	writeOptionalMetric(w, "sensor_bridge_homekit_lag_seconds", "gauge", "Moving average of the time from the bridge receiving a measurement to notifying HomeKit.", states, func(s SensorState) *float32 {
+		if s.Stats.NotifyLag == nil {
+			return nil
+		}
+		lag := float32(*s.Stats.NotifyLag)
+		return &lag
+	})
+	writeMetric(w, "sensor_bridge_packet_loss_ratio", "gauge", "Fraction of packets lost per sensor.", states, func(s SensorState) float64 {
+		return s.Stats.LossRatio()
+	})
+
+	writeReceiverMetrics(w)
+	writeRelayMetrics(w)
+	writeFieldErrorMetrics(w)
+
+	encodings := encodingCountsSnapshot()
+	var names []string
+	for name := range encodings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "# HELP sensor_bridge_decoded_packets_total Measurements decoded per payload encoding.\n")
+	fmt.Fprintf(w, "# TYPE sensor_bridge_decoded_packets_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "sensor_bridge_decoded_packets_total{encoding=%q} %d\n", name, encodings[name])
+	}
+
+	fmt.Fprintf(w, "# HELP sensor_bridge_quarantined_packets_total Packets from sensors that are not configured.\n")
+	fmt.Fprintf(w, "# TYPE sensor_bridge_quarantined_packets_total counter\n")
+	for _, sensor := range quarantine.List() {
+		fmt.Fprintf(w, "sensor_bridge_quarantined_packets_total{sensor_id=%q} %d\n", sensor.SensorID, sensor.Packets)
+	}
+}
+
+func writeFieldErrorMetrics(w http.ResponseWriter) {
+	counts := parseFailures.FieldCounts()
+
+	var fields []FieldError
+	for field := range counts {
+		fields = append(fields, field)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		if fields[i].Field != fields[j].Field {
+			return fields[i].Field < fields[j].Field
+		}
+		return fields[i].Problem < fields[j].Problem
+	})
+
+	fmt.Fprintf(w, "# HELP sensor_bridge_field_errors_total Problems with individual packet fields.\n")
+	fmt.Fprintf(w, "# TYPE sensor_bridge_field_errors_total counter\n")
+	for _, field := range fields {
+		fmt.Fprintf(w, "sensor_bridge_field_errors_total{field=%q,problem=%q} %d\n", field.Field, field.Problem, counts[field])
+	}
+}
+
+func writeReceiverMetrics(w http.ResponseWriter) {
+	stats := receiverStatsSnapshot()
+
+	var tags []string
+	for tag := range stats {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	fmt.Fprintf(w, "# HELP sensor_bridge_receiver_packets_total Packets received per receiver.\n")
+	fmt.Fprintf(w, "# TYPE sensor_bridge_receiver_packets_total counter\n")
+	for _, tag := range tags {
+		fmt.Fprintf(w, "sensor_bridge_receiver_packets_total{receiver=%q} %d\n", tag, stats[tag].Packets)
+	}
+	fmt.Fprintf(w, "# HELP sensor_bridge_receiver_errors_total Packets per receiver that could not be processed.\n")
+	fmt.Fprintf(w, "# TYPE sensor_bridge_receiver_errors_total counter\n")
+	for _, tag := range tags {
+		fmt.Fprintf(w, "sensor_bridge_receiver_errors_total{receiver=%q} %d\n", tag, stats[tag].Errors)
+	}
+	fmt.Fprintf(w, "# HELP sensor_bridge_receiver_rate_limited_total Packets per receiver dropped by a rate limit.\n")
+	fmt.Fprintf(w, "# TYPE sensor_bridge_receiver_rate_limited_total counter\n")
+	for _, tag := range tags {
+		fmt.Fprintf(w, "sensor_bridge_receiver_rate_limited_total{receiver=%q} %d\n", tag, stats[tag].RateLimited)
+	}
+	fmt.Fprintf(w, "# HELP sensor_bridge_receiver_oversized_total Packets per receiver dropped for exceeding the maximum size.\n")
+	fmt.Fprintf(w, "# TYPE sensor_bridge_receiver_oversized_total counter\n")
+	for _, tag := range tags {
+		fmt.Fprintf(w, "sensor_bridge_receiver_oversized_total{receiver=%q} %d\n", tag, stats[tag].Oversized)
+	}
+	fmt.Fprintf(w, "# HELP sensor_bridge_receiver_read_errors_total Failed reads from the socket per receiver.\n")
+	fmt.Fprintf(w, "# TYPE sensor_bridge_receiver_read_errors_total counter\n")
+	for _, tag := range tags {
+		fmt.Fprintf(w, "sensor_bridge_receiver_read_errors_total{receiver=%q} %d\n", tag, stats[tag].ReadErrors)
+	}
+	fmt.Fprintf(w, "# HELP sensor_bridge_receiver_rebinds_total Times the socket of a receiver was closed and bound again.\n")
+	fmt.Fprintf(w, "# TYPE sensor_bridge_receiver_rebinds_total counter\n")
+	for _, tag := range tags {
+		fmt.Fprintf(w, "sensor_bridge_receiver_rebinds_total{receiver=%q} %d\n", tag, stats[tag].Rebinds)
+	}
+}
+
+// metricLabels identifies a sensor in metrics, along with where it is.
+func metricLabels(state SensorState) string {
+	labels := fmt.Sprintf("sensor_id=%q", state.SensorID)
+	if state.Room != "" {
+		labels += fmt.Sprintf(",room=%q", state.Room)
+	}
+	if state.Group != "" {
+		labels += fmt.Sprintf(",group=%q", state.Group)
+	}
+	if len(state.Tags) != 0 {
+		labels += fmt.Sprintf(",tags=%q", strings.Join(state.Tags, ","))
+	}
+	return labels
+}
+
+func writeMetric(w http.ResponseWriter, name, typ, help string, states []SensorState, value func(SensorState) float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	for _, state := range states {
+		fmt.Fprintf(w, "%s{%s} %g\n", name, metricLabels(state), value(state))
+	}
+}
+
+// writeOptionalMetric only writes samples for sensors that reported the value.
+func writeOptionalMetric(w http.ResponseWriter, name, typ, help string, states []SensorState, value func(SensorState) *float32) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	for _, state := range states {
+		if v := value(state); v != nil {
+			fmt.Fprintf(w, "%s{%s} %g\n", name, metricLabels(state), *v)
+		}
+	}
+}
+
+func serveAPI(config APIConfig, firmwareConfig FirmwareConfig) {
+	parseFailures.SetSize(config.RecentErrors)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/sensors", handleSensors)
+	mux.HandleFunc("/api/v1/sensors/", handleSensor)
+	mux.HandleFunc("/api/v1/stream", handleStream)
+	mux.HandleFunc("/api/v1/config/sensors", handleConfigSensors)
+	mux.HandleFunc("/api/v1/config/sensors/", handleConfigSensor)
+	mux.HandleFunc("/api/v1/config/alert_rules", handleConfigAlertRules)
+	mux.HandleFunc("/api/v1/config/check", handleConfigCheck)
+	mux.HandleFunc("/api/v1/snapshot", handleSnapshot)
+	mux.HandleFunc("/api/v1/replica", handleReplica)
+	mux.HandleFunc("/api/v1/pending", handlePending)
+	mux.HandleFunc("/api/v1/pending/", handleApprove)
+	mux.HandleFunc("/api/v1/accessories", handleAccessories)
+	mux.HandleFunc("/api/v1/homekit/events", handleHomeKitEvents)
+	mux.HandleFunc("/api/v1/alerts", handleAlerts)
+	mux.HandleFunc("/api/v1/alerts/events", handleAlertEvents)
+	mux.HandleFunc("/api/v1/errors", handleErrors)
+	mux.HandleFunc("/api/v1/traces", handleTraces)
+	mux.HandleFunc("/api/v1/quarantine", handleQuarantine)
+	mux.HandleFunc("/api/v1/rollups", handleRollups)
+	mux.HandleFunc("/api/openapi.json", handleOpenAPI)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz(storagePath))
+
+	if firmwareConfig.Directory != "" {
+		mux.Handle("/firmware/", handleFirmware(firmwareConfig))
+	}
+
+	if err := validateTokens(config.Tokens); err != nil {
+		log.Fatal("Could not configure API tokens: ", err)
+	}
+	handler := withCORS(config.CORS, requireAuth(config, mux))
+
+	if config.TLS != nil {
+		cert, key, err := config.TLS.files()
+		if err != nil {
+			log.Fatal("Could not set up TLS for the API: ", err)
+		}
+		log.Printf("[*] API listening on %s with TLS", config.Address)
+		if err := http.ListenAndServeTLS(config.Address, cert, key, handler); err != nil {
+			log.Fatal("Could not start API: ", err)
+		}
+		return
+	}
+
+	log.Printf("[*] API listening on %s", config.Address)
+	if err := http.ListenAndServe(config.Address, handler); err != nil {
+		log.Fatal("Could not start API: ", err)
+	}
+}
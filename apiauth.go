@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// APITLSConfig serves the API over HTTPS, with the given certificate and key
+// or with a self-signed certificate that is generated on first use.
+type APITLSConfig struct {
+	Cert       string `json:"cert,omitempty"`
+	Key        string `json:"key,omitempty"`
+	SelfSigned bool   `json:"self_signed,omitempty"`
+}
+
+// files returns the certificate and key to serve, generating a self-signed
+// pair in the storage directory if needed.
+func (c APITLSConfig) files() (string, string, error) {
+	if c.Cert != "" || c.Key != "" || !c.SelfSigned {
+		return c.Cert, c.Key, nil
+	}
+
+	cert := filepath.Join(storagePath, "api-cert.pem")
+	key := filepath.Join(storagePath, "api-key.pem")
+	if _, err := os.Stat(cert); err == nil {
+		return cert, key, nil
+	}
+
+	log.Printf("[*] Generating self-signed certificate <%s>", cert)
+	return cert, key, generateCertificate(cert, key)
+}
+
+func generateCertificate(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "sensor-bridge"},
+		DNSNames:     []string{"localhost", hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// APIToken is a token with a scope: read can only look, write can also
+// change sensors and admin can also approve new sensors.
+type APIToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Scope string `json:"scope"`
+}
+
+const (
+	scopeNone = iota
+	scopeRead
+	scopeWrite
+	scopeAdmin
+)
+
+var scopes = map[string]int{"read": scopeRead, "write": scopeWrite, "admin": scopeAdmin}
+
+func validateTokens(tokens []APIToken) error {
+	for _, token := range tokens {
+		if token.Token == "" {
+			return fmt.Errorf("api token <%s> is empty", token.Name)
+		}
+		if _, ok := scopes[token.Scope]; !ok {
+			return fmt.Errorf("api token <%s> has unknown scope <%s>", token.Name, token.Scope)
+		}
+	}
+	return nil
+}
+
+// adminPaths list and pair new sensors with the keys they are to sign with, or
+// hand out the HomeKit keys of the bridge. configPaths show secrets even when
+// they are only read.
+var (
+	adminPaths  = []string{"/api/v1/pending", "/api/v1/pending/", "/api/v1/replica"}
+	configPaths = []string{"/api/v1/config/"}
+)
+
+// requiredScope returns what a request needs: anything that only reads is
+// read, approving sensors is admin and everything else is write.
+func requiredScope(r *http.Request) int {
+	if matchesPath(r.URL.Path, adminPaths) {
+		return scopeAdmin
+	}
+	if matchesPath(r.URL.Path, configPaths) {
+		return scopeWrite
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return scopeRead
+	}
+	return scopeWrite
+}
+
+func matchesPath(path string, paths []string) bool {
+	for _, p := range paths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicPaths are served without authentication: probes cannot log in,
+// sensors fetch firmware with nothing but the URL from their ACK and the
+// OpenAPI document is needed before a client has credentials.
+var publicPaths = []string{"/healthz", "/readyz", "/firmware/", "/api/openapi.json"}
+
+// requireAuth protects handler with the tokens or the username and password
+// of the API. Without any the API is open.
+func requireAuth(config APIConfig, handler http.Handler) http.Handler {
+	if config.Token == "" && config.Username == "" && len(config.Tokens) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if matchesPath(r.URL.Path, publicPaths) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		scope := config.scope(r)
+		if scope == scopeNone {
+			if config.Username != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="sensor-bridge"`)
+			}
+			audit(auditAPIAuthFailed, "", r.RemoteAddr, r.Method+" "+r.URL.Path)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if scope < requiredScope(r) {
+			audit(auditAPIAuthFailed, "", r.RemoteAddr, r.Method+" "+r.URL.Path+" needs more scope")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// scope returns what the credentials of a request allow. The token and the
+// username and password of the API allow everything.
+func (c APIConfig) scope(r *http.Request) int {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token := strings.TrimPrefix(header, "Bearer ")
+		if c.Token != "" && equal(token, c.Token) {
+			return scopeAdmin
+		}
+		for _, t := range c.Tokens {
+			if equal(token, t.Token) {
+				return scopes[t.Scope]
+			}
+		}
+		return scopeNone
+	}
+	if c.Username != "" {
+		if username, password, ok := r.BasicAuth(); ok {
+			// Evaluate both so that timing does not tell which one was wrong
+			validUsername := equal(username, c.Username)
+			validPassword := equal(password, c.Password)
+			if validUsername && validPassword {
+				return scopeAdmin
+			}
+		}
+	}
+	return scopeNone
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authorize adds the credentials of the API to a request of our own commands.
+func (c APIConfig) authorize(r *http.Request) {
+	if c.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.Username != "" {
+		r.SetBasicAuth(c.Username, c.Password)
+	} else if len(c.Tokens) != 0 {
+		r.Header.Set("Authorization", "Bearer "+c.Tokens[0].Token)
+	}
+}
+
+// client returns an HTTP client for our own commands. A self-signed
+// certificate is accepted, it is our own bridge on the other end.
+func (c APIConfig) client() *http.Client {
+	client := &http.Client{Timeout: 5 * time.Second}
+	if c.TLS != nil && c.TLS.SelfSigned && c.TLS.Cert == "" {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	return client
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequiredScope(t *testing.T) {
+	for _, test := range []struct {
+		method, path string
+		scope        int
+	}{
+		{"GET", "/api/v1/sensors", scopeRead},
+		{"POST", "/api/v1/traces", scopeWrite},
+		{"GET", "/api/v1/config/sensors", scopeWrite},
+		{"GET", "/api/v1/pending", scopeAdmin},
+		{"POST", "/api/v1/pending/f008d1d4092c/approve", scopeAdmin},
+		{"GET", "/api/v1/replica", scopeAdmin},
+		{"GET", "/api/v1/pendingx", scopeRead},
+	} {
+		if scope := requiredScope(httptest.NewRequest(test.method, test.path, nil)); scope != test.scope {
+			t.Errorf("%s %s needs scope %d, want %d", test.method, test.path, scope, test.scope)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+var configMutex sync.Mutex
+
+// addSensorToConfig appends a sensor to the bridge section of the config file.
+func addSensorToConfig(path string, sensor SensorConfig) error {
+	return updateSensorsInConfig(path, func(sensors []SensorConfig) ([]SensorConfig, error) {
+		for _, existing := range sensors {
+			if existing.Serial == sensor.Serial {
+				return nil, fmt.Errorf("sensor <%s> is already configured", sensor.Serial)
+			}
+		}
+		return append(sensors, sensor), nil
+	})
+}
+
+// updateSensorsInConfig rewrites the sensors in the bridge section of the
+// config file.
+func updateSensorsInConfig(path string, update func([]SensorConfig) ([]SensorConfig, error)) error {
+	return updateConfig(path, func(config map[string]json.RawMessage) error {
+		var bridge map[string]json.RawMessage
+		if err := json.Unmarshal(config["bridge"], &bridge); err != nil {
+			return err
+		}
+
+		var sensors []SensorConfig
+		if raw, ok := bridge["sensors"]; ok {
+			if err := json.Unmarshal(raw, &sensors); err != nil {
+				return err
+			}
+		}
+
+		sensors, err := update(sensors)
+		if err != nil {
+			return err
+		}
+
+		if bridge["sensors"], err = marshalConfig(sensors, ""); err != nil {
+			return err
+		}
+		config["bridge"], err = marshalConfig(bridge, "")
+		return err
+	})
+}
+
+// configRejected is an edit of the config file that was not made, because the
+// edit itself failed or the config would no longer load afterwards.
+type configRejected struct {
+	err error
+}
+
+func (e configRejected) Error() string { return e.err.Error() }
+
+// updateConfig rewrites the config file atomically. The file is edited as raw
+// JSON so that settings this version does not know about survive the rewrite.
+// The new file has to load before it replaces the old one, so that the next
+// start does not fail on it.
+func updateConfig(path string, update func(map[string]json.RawMessage) error) error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	encodedConfig, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(encodedConfig, &config); err != nil {
+		return err
+	}
+
+	if err := update(config); err != nil {
+		return configRejected{err}
+	}
+
+	encodedConfig, err = marshalConfig(config, "    ")
+	if err != nil {
+		return err
+	}
+
+	// The temporary file is next to the config, so that relative paths in it
+	// resolve the same
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(encodedConfig, '\n'), 0600); err != nil {
+		return err
+	}
+	if _, err := loadConfig(tmp); err != nil {
+		os.Remove(tmp)
+		return configRejected{fmt.Errorf("the config would not load: %v", err)}
+	}
+	return os.Rename(tmp, path)
+}
+
+// marshalConfig encodes part of the config file without escaping characters
+// like < and >, which are common in alert rules.
+func marshalConfig(v interface{}, indent string) (json.RawMessage, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buffer.Bytes(), "\n"), nil
+}
+
+// approveSensor moves a pending sensor into the config file. The new accessory
+// is only published to HomeKit after the bridge has been restarted.
+func approveSensor(sensorID, name, model string) (SensorConfig, error) {
+	pending, ok := pendingSensors.Get(sensorID)
+	if !ok {
+		return SensorConfig{}, fmt.Errorf("no pending sensor <%s>", sensorID)
+	}
+
+	if name == "" {
+		name = "Sensor" + sensorID
+	}
+
+	sensor := SensorConfig{
+		Serial:  pending.SensorID,
+		Name:    name,
+		Model:   model,
+		HMACKey: pending.HMACKey,
+	}
+
+	if err := addSensorToConfig(configPath, sensor); err != nil {
+		return SensorConfig{}, err
+	}
+
+	if err := pendingSensors.Remove(sensorID); err != nil {
+		return SensorConfig{}, err
+	}
+
+	log.Printf("[*] Approved sensor <%s> as <%s>, restart the bridge to publish it", sensor.Serial, sensor.Name)
+	audit(auditSensorApproved, sensor.Serial, "", sensor.Name)
+
+	return sensor, nil
+}
+
+func approveCommand(args []string) {
+	flags := flag.NewFlagSet("approve", flag.ExitOnError)
+	name := flags.String("name", "", "accessory name for the sensor")
+	model := flags.String("model", "", "model reported to HomeKit")
+
+	// Allow the sensor id before the flags, as in "approve <id> --name Kitchen"
+	var sensorID string
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		sensorID, args = args[0], args[1:]
+	}
+	flags.Parse(args)
+	if sensorID == "" {
+		sensorID = flags.Arg(0)
+	}
+
+	if sensorID == "" {
+		fmt.Fprintln(os.Stderr, "usage: sensor-bridge approve <sensor-id> [--name name] [--model model]")
+		os.Exit(2)
+	}
+
+	if err := pendingSensors.Load(); err != nil {
+		log.Fatal("Could not load pending sensors: ", err)
+	}
+
+	if _, err := approveSensor(sensorID, *name, *model); err != nil {
+		log.Fatal("Could not approve sensor: ", err)
+	}
+}
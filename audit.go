@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Events in the audit log
+const (
+	auditPairingRequested = "pairing_requested"
+	auditSensorApproved   = "sensor_approved"
+	auditPacketRejected   = "packet_rejected"
+	auditUnknownSensor    = "unknown_sensor"
+	auditAPIAuthFailed    = "api_auth_failed"
+	auditConfigChanged    = "config_changed"
+)
+
+// auditEvent is a line of the audit log.
+type auditEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Sensor  string    `json:"sensor,omitempty"`
+	Address string    `json:"address,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// auditLog appends security relevant events as JSON lines. It is nil when
+// the log is disabled.
+var auditLog *rotatingFile
+
+func openAuditLog(config RotateConfig) error {
+	if config.Path == "" {
+		return nil
+	}
+
+	file, err := openRotatingFile(config)
+	if err != nil {
+		return err
+	}
+
+	auditLog = file
+	return nil
+}
+
+func audit(event, sensor, address, detail string) {
+	if auditLog == nil {
+		return
+	}
+
+	// Details quote names in <>, which should stay readable
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(auditEvent{
+		Time:    clock.Now(),
+		Event:   event,
+		Sensor:  sensor,
+		Address: address,
+		Detail:  detail,
+	})
+	if err != nil {
+		log.Println("Could not encode audit event: ", err)
+		return
+	}
+
+	if _, err := auditLog.Write(line.Bytes()); err != nil {
+		log.Println("Could not write audit log: ", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// splitSignature separates a signed packet into its payload and the hex
+// encoded HMAC-SHA256 that the sensor appended after a newline. Anything
+// after the last newline that is not a signature belongs to the payload, a
+// binary payload may well contain a newline byte.
+func splitSignature(packet []byte) ([]byte, []byte) {
+	i := bytes.LastIndexByte(packet, '\n')
+	if i == -1 {
+		return packet, nil
+	}
+	signature := bytes.TrimSpace(packet[i+1:])
+	if _, err := hex.DecodeString(string(signature)); err != nil || len(signature) != 2*sha256.Size {
+		return packet, nil
+	}
+	return packet[:i], signature
+}
+
+// sign appends the hex encoded HMAC-SHA256 of payload after a newline, the
+// same framing that sensors use for their uplink packets.
+func sign(key string, payload []byte) ([]byte, error) {
+	decodedKey, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, errors.New("invalid hmac key")
+	}
+
+	mac := hmac.New(sha256.New, decodedKey)
+	mac.Write(payload)
+
+	signed := append(append([]byte{}, payload...), '\n')
+	return append(signed, hex.EncodeToString(mac.Sum(nil))...), nil
+}
+
+func verifySignature(key string, payload, signature []byte) error {
+	decodedKey, err := hex.DecodeString(key)
+	if err != nil {
+		return errors.New("invalid hmac key")
+	}
+
+	if len(signature) == 0 {
+		return errors.New("missing signature")
+	}
+
+	decodedSignature := make([]byte, hex.DecodedLen(len(signature)))
+	if _, err := hex.Decode(decodedSignature, signature); err != nil {
+		return errors.New("malformed signature")
+	}
+
+	mac := hmac.New(sha256.New, decodedKey)
+	mac.Write(payload)
+	if !hmac.Equal(mac.Sum(nil), decodedSignature) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
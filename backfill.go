@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// measurementLogFiles returns the measurement log and its rotated files that
+// were written to since a time, oldest first. A rotated file that is still
+// being compressed is read from the original.
+func measurementLogFiles(path string, since time.Time) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	// The timestamp suffix makes lexical order chronological, the log itself
+	// is the newest
+	sort.Strings(matches)
+	matches = append(matches, path)
+
+	var files []string
+	for _, match := range matches {
+		if strings.HasSuffix(match, ".gz") && contains(matches, strings.TrimSuffix(match, ".gz")) {
+			continue
+		}
+		info, err := os.Stat(match)
+		if err != nil || info.ModTime().Before(since) {
+			continue
+		}
+		files = append(files, match)
+	}
+	return files, nil
+}
+
+// backfillRollups counts the measurements of the measurement log that are
+// recent enough towards the rollups again, so that a restart does not leave
+// a hole in the summaries. It must run before the receivers start.
+func backfillRollups(config RotateConfig, units UnitSystemConfig) (int, error) {
+	if config.Path == "" {
+		return 0, nil
+	}
+
+	since := clock.Now().AddDate(0, 0, -rollupDays)
+	files, err := measurementLogFiles(config.Path, since)
+	if err != nil {
+		return 0, err
+	}
+
+	// The log may be written in other units than the bridge works in
+	output := units.Outputs["measurement_log"]
+
+	count := 0
+	for _, path := range files {
+		err := readMeasurementLog(path, func(logged loggedMeasurement) {
+			if logged.Time.Before(since) {
+				return
+			}
+			normalizeUnits(&logged.Measurement.MeasurementData, output)
+			rollups.Add(logged.Measurement, logged.Time, logged.Received)
+			count++
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// readMeasurementLog calls fn for every line of a measurement log file, which
+// may be compressed. Lines that do not decode, like one cut short by a crash,
+// are skipped.
+func readMeasurementLog(path string, fn func(loggedMeasurement)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var logged loggedMeasurement
+		if err := json.Unmarshal(scanner.Bytes(), &logged); err != nil {
+			continue
+		}
+		fn(logged)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A backup is a tar file, gzipped when its name ends in .gz or .tgz, with the
+// config file, the sensors directory, the storage directory with the pairings
+// and accessory IDs, and the measurement and audit logs with their rotated
+// files. Each goes under its own prefix and is put back where the imported
+// config wants it, so that the logs can move on the new hardware.
+const (
+	backupConfig         = "config/"
+	backupSensorsDir     = "sensors_dir/"
+	backupStorage        = "storage/"
+	backupMeasurementLog = "measurement_log/"
+	backupAuditLog       = "audit_log/"
+)
+
+func isCompressedBackup(name string) bool {
+	return strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// backupWriter adds files to a backup.
+type backupWriter struct {
+	tw    *tar.Writer
+	out   string
+	files int
+}
+
+func (b *backupWriter) add(name, file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := b.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// A log that grows while it is read is cut off at the size in the header
+	if _, err := io.CopyN(b.tw, f, info.Size()); err != nil {
+		return err
+	}
+	b.files++
+	return nil
+}
+
+// addDir adds the files in dir and below it under prefix, leaving out the
+// temporary files of atomic writes.
+func (b *backupWriter) addDir(prefix, dir string) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && file == dir {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(file, ".tmp") || sameFile(file, b.out) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		return b.add(prefix+filepath.ToSlash(rel), file)
+	})
+}
+
+func sameFile(a, b string) bool {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	ib, err := os.Stat(b)
+	return err == nil && os.SameFile(ia, ib)
+}
+
+// addLog adds a log and its rotated files under prefix.
+func (b *backupWriter) addLog(prefix string, config RotateConfig) error {
+	if config.Path == "" {
+		return nil
+	}
+	files, err := filepath.Glob(config.Path + ".*")
+	if err != nil {
+		return err
+	}
+	files = append(files, config.Path)
+	for _, file := range files {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+		// Logs in the storage directory are in the backup already
+		if rel, err := filepath.Rel(storagePath, file); err == nil && !strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if err := b.add(prefix+filepath.Base(file), file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportCommand writes everything a bridge needs to carry on elsewhere to a
+// backup. It is best run with the bridge stopped, so that nothing changes
+// while it is read.
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("out", "sensor-bridge-backup.tar", "file to write the backup to")
+	flags.Parse(args)
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatal("Could not load config file: ", err)
+	}
+
+	file, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Fatal("Could not create backup: ", err)
+	}
+
+	var w io.WriteCloser = file
+	if isCompressedBackup(*out) {
+		w = gzip.NewWriter(file)
+	}
+	b := &backupWriter{tw: tar.NewWriter(w), out: *out}
+
+	err = b.add(backupConfig+filepath.Base(configPath), configPath)
+	if err == nil && config.SensorsDir != "" {
+		err = b.addDir(backupSensorsDir, config.sensorsDir(configPath))
+	}
+	if err == nil {
+		err = b.addDir(backupStorage, storagePath)
+	}
+	if err == nil {
+		err = b.addLog(backupMeasurementLog, config.MeasurementLog)
+	}
+	if err == nil {
+		err = b.addLog(backupAuditLog, config.AuditLog)
+	}
+	if err == nil {
+		err = b.tw.Close()
+	}
+	if err == nil && w != file {
+		err = w.Close()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*out)
+		log.Fatal("Could not write backup: ", err)
+	}
+
+	fmt.Printf("Exported %d files to %s\n", b.files, *out)
+}
+
+// readBackup calls fn for every file in a backup.
+func readBackup(name string, fn func(header *tar.Header, r io.Reader) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if isCompressedBackup(name) {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// backupPath returns where a file of a backup goes, or an error for names
+// that would end up outside of where they belong.
+func backupPath(name string, config Config) (string, error) {
+	clean := path.Clean(name)
+	if clean != name || path.IsAbs(clean) || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("backup contains unsafe file <%s>", name)
+	}
+
+	switch {
+	case clean == backupConfig+filepath.Base(configPath):
+		return configPath, nil
+	case strings.HasPrefix(clean, backupSensorsDir) && config.SensorsDir != "":
+		return filepath.Join(config.sensorsDir(configPath), filepath.FromSlash(strings.TrimPrefix(clean, backupSensorsDir))), nil
+	case strings.HasPrefix(clean, backupStorage):
+		return filepath.Join(storagePath, filepath.FromSlash(strings.TrimPrefix(clean, backupStorage))), nil
+	case strings.HasPrefix(clean, backupMeasurementLog) && config.MeasurementLog.Path != "":
+		return filepath.Join(filepath.Dir(config.MeasurementLog.Path), path.Base(clean)), nil
+	case strings.HasPrefix(clean, backupAuditLog) && config.AuditLog.Path != "":
+		return filepath.Join(filepath.Dir(config.AuditLog.Path), path.Base(clean)), nil
+	}
+	return "", nil
+}
+
+// importCommand restores a backup made with export into the working
+// directory. The bridge must not be running. It will not overwrite an
+// existing config or storage directory unless forced to.
+func importCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	in := flags.String("in", "sensor-bridge-backup.tar", "backup to restore")
+	force := flags.Bool("force", false, "overwrite the existing config and storage")
+	flags.Parse(args)
+
+	if !*force {
+		for _, existing := range []string{configPath, storagePath} {
+			if _, err := os.Stat(existing); err == nil {
+				log.Fatalf("%s already exists, use --force to overwrite it", existing)
+			}
+		}
+	}
+
+	// The config of the backup says where the rest goes
+	var encodedConfig []byte
+	err := readBackup(*in, func(header *tar.Header, r io.Reader) error {
+		if header.Name != backupConfig+filepath.Base(configPath) {
+			return nil
+		}
+		var err error
+		encodedConfig, err = ioutil.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		log.Fatal("Could not read backup: ", err)
+	}
+	if encodedConfig == nil {
+		log.Fatalf("Backup has no %s", configPath)
+	}
+	var config Config
+	if err := json.Unmarshal(encodedConfig, &config); err != nil {
+		log.Fatal("Backup has an invalid config file: ", err)
+	}
+
+	files := 0
+	err = readBackup(*in, func(header *tar.Header, r io.Reader) error {
+		target, err := backupPath(header.Name, config)
+		if err != nil || target == "" {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		tmp := target + ".tmp"
+		file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, r); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		files++
+		return os.Rename(tmp, target)
+	})
+	if err != nil {
+		log.Fatal("Could not restore backup: ", err)
+	}
+
+	fmt.Printf("Imported %d files from %s\n", files, *in)
+	if _, err := loadConfig(configPath); err != nil {
+		fmt.Println("The imported config does not load here:", err)
+	}
+}
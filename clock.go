@@ -0,0 +1,253 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// ClockConfig sets how far, in seconds, the clock of a sensor may drift from
+// ours before it is flagged. It defaults to five minutes.
+type ClockConfig struct {
+	MaxSkew int `json:"max_skew"`
+}
+
+const defaultMaxClockSkew = 5 * time.Minute
+
+var maxClockSkew = defaultMaxClockSkew
+
+func configureClock(config ClockConfig) {
+	maxClockSkew = defaultMaxClockSkew
+	if config.MaxSkew > 0 {
+		maxClockSkew = time.Duration(config.MaxSkew) * time.Second
+	}
+}
+
+// Sensors without a battery backed clock start counting at zero or at some
+// default date after a reboot, and old NTP clients roll over to 2036.
+// Anything before this or more than a day ahead of us is not a real time.
+var minSensorTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	clockOK     = "ok"
+	clockSkewed = "skewed"
+	clockBogus  = "bogus"
+)
+
+// checkClock compares the time reported by a sensor to when we received the
+// measurement. A sensor time of zero means the sensor did not send one.
+func checkClock(sensorTime int64, received time.Time) (status string, skew time.Duration) {
+	if sensorTime == 0 {
+		return "", 0
+	}
+
+	t := time.Unix(sensorTime, 0)
+	if t.Before(minSensorTime) || t.After(received.Add(24*time.Hour)) {
+		return clockBogus, 0
+	}
+
+	skew = t.Sub(received)
+	if math.Abs(skew.Seconds()) > maxClockSkew.Seconds() {
+		return clockSkewed, skew
+	}
+	return clockOK, skew
+}
+
+// measurementTime returns when a measurement was taken, which is when we
+// received it unless the sensor has a clock we can trust.
+func measurementTime(sensorTime int64, received time.Time) time.Time {
+	if status, _ := checkClock(sensorTime, received); status == clockOK {
+		return time.Unix(sensorTime, 0)
+	}
+	return received
+}
+
+// trackClock records the clock status of a sensor and logs when it changes
+// for the worse.
+func (s *SensorStats) trackClock(sensorID string, sensorTime int64, received time.Time) {
+	status, skew := checkClock(sensorTime, received)
+	if status == "" {
+		return
+	}
+
+	if status != s.Clock && status != clockOK {
+		log.Printf("Clock of sensor <%s> is %s (sensor time <%d>)", sensorID, status, sensorTime)
+	}
+	s.Clock = status
+
+	if status == clockBogus {
+		s.ClockSkew = nil
+		return
+	}
+	seconds := skew.Seconds()
+	s.ClockSkew = &seconds
+	s.Latency = movingAverage(s.Latency, -seconds)
+}
+
+// Clock is where the time comes from for the things that depend on how much
+// of it passed: TTLs, staleness, rate limits, rollups, the timers of
+// notifications and the schedules of summaries, HA, relaying and retries, and
+// for the times the bridge records, like those of audit events and parse
+// errors. It is the system clock unless replaced, by a manualClock in tests.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTicker(d time.Duration) Ticker
+	AfterFunc(d time.Duration, fn func()) Timer
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// Ticker is a time.Ticker of a Clock.
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// Timer is a time.Timer of a Clock that calls a function.
+type Timer interface {
+	Stop() bool
+}
+
+var clock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                  { return time.Now() }
+func (systemClock) Since(t time.Time) time.Duration { return time.Since(t) }
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) AfterFunc(d time.Duration, fn func()) Timer {
+	return time.AfterFunc(d, fn)
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) Chan() <-chan time.Time { return t.C }
+
+// manualClock only moves when it is advanced, and fires the tickers and
+// timers that are due on the way in order, so that tests can skip ahead
+// without sleeping.
+type manualClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*manualWaiter
+}
+
+// manualWaiter is a ticker when it has a period, a timer otherwise.
+type manualWaiter struct {
+	clock  *manualClock
+	when   time.Time
+	period time.Duration
+	c      chan time.Time
+	fn     func()
+}
+
+func newManualClock(now time.Time) *manualClock {
+	return &manualClock{now: now}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *manualClock) NewTicker(d time.Duration) Ticker {
+	return manualTicker{c.add(&manualWaiter{period: d, c: make(chan time.Time, 1)}, d)}
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, fn func()) Timer {
+	return c.add(&manualWaiter{fn: fn}, d)
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.AfterFunc(d, func() { ch <- c.Now() })
+	return ch
+}
+
+// Sleep returns once another goroutine advanced the clock by d.
+func (c *manualClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *manualClock) add(w *manualWaiter, d time.Duration) *manualWaiter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w.clock, w.when = c, c.now.Add(d)
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+// Advance moves the clock forward. Like a time.Ticker, a ticker whose
+// channel is full skips ticks.
+func (c *manualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	target := c.now.Add(d)
+	for {
+		var next *manualWaiter
+		for _, w := range c.waiters {
+			if !w.when.After(target) && (next == nil || w.when.Before(next.when)) {
+				next = w
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.when
+
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+			select {
+			case next.c <- c.now:
+			default:
+			}
+			continue
+		}
+		c.remove(next)
+		c.mutex.Unlock()
+		next.fn()
+		c.mutex.Lock()
+	}
+	c.now = target
+	c.mutex.Unlock()
+}
+
+// remove drops a waiter and tells if it was still waiting. The caller must
+// hold the lock.
+func (c *manualClock) remove(w *manualWaiter) bool {
+	for i, waiter := range c.waiters {
+		if waiter == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (w *manualWaiter) Stop() bool {
+	w.clock.mutex.Lock()
+	defer w.clock.mutex.Unlock()
+	return w.clock.remove(w)
+}
+
+type manualTicker struct {
+	*manualWaiter
+}
+
+func (t manualTicker) Chan() <-chan time.Time { return t.c }
+func (t manualTicker) Stop()                  { t.manualWaiter.Stop() }
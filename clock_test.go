@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// useManualClock replaces the clock for the duration of a test.
+func useManualClock(t *testing.T) *manualClock {
+	manual := newManualClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	previous := clock
+	clock = manual
+	t.Cleanup(func() { clock = previous })
+	return manual
+}
+
+func TestManualClockFiresInOrder(t *testing.T) {
+	c := newManualClock(time.Unix(0, 0))
+
+	var fired []string
+	c.AfterFunc(3*time.Second, func() { fired = append(fired, "3s") })
+	c.AfterFunc(time.Second, func() { fired = append(fired, "1s") })
+	stopped := c.AfterFunc(2*time.Second, func() { fired = append(fired, "2s") })
+	if !stopped.Stop() {
+		t.Fatal("Stop of a waiting timer returned false")
+	}
+	after := c.After(2 * time.Second)
+
+	c.Advance(1500 * time.Millisecond)
+	if len(fired) != 1 || fired[0] != "1s" {
+		t.Fatalf("after 1.5s fired %v, want [1s]", fired)
+	}
+	select {
+	case <-after:
+		t.Fatal("After fired early")
+	default:
+	}
+
+	c.Advance(2 * time.Second)
+	if len(fired) != 2 || fired[1] != "3s" {
+		t.Fatalf("after 3.5s fired %v, want [1s 3s]", fired)
+	}
+	if got := <-after; !got.Equal(time.Unix(2, 0)) {
+		t.Fatalf("After fired at %v, want 2s", got)
+	}
+	if got := c.Since(time.Unix(0, 0)); got != 3500*time.Millisecond {
+		t.Fatalf("Since is %v, want 3.5s", got)
+	}
+}
+
+func TestManualClockTicker(t *testing.T) {
+	c := newManualClock(time.Unix(0, 0))
+	ticker := c.NewTicker(time.Minute)
+
+	c.Advance(time.Minute)
+	if got := <-ticker.Chan(); !got.Equal(time.Unix(60, 0)) {
+		t.Fatalf("tick at %v, want 1m", got)
+	}
+
+	// Ticks nobody reads are dropped, like with a time.Ticker
+	c.Advance(5 * time.Minute)
+	<-ticker.Chan()
+	select {
+	case got := <-ticker.Chan():
+		t.Fatalf("got a second tick at %v", got)
+	default:
+	}
+
+	ticker.Stop()
+	c.Advance(time.Hour)
+	select {
+	case got := <-ticker.Chan():
+		t.Fatalf("stopped ticker ticked at %v", got)
+	default:
+	}
+}
+
+func TestRecordedTimesFollowClock(t *testing.T) {
+	inTempDir(t)
+	c := useManualClock(t)
+	c.Advance(time.Hour)
+
+	p := packet{address: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}, payload: []byte("{")}
+	if failure := newParseFailure(p, errors.New("bad")); !failure.Time.Equal(c.Now()) {
+		t.Fatalf("parse failure at %s, clock at %s", failure.Time, c.Now())
+	}
+	if snapshot := takeSnapshot(); !snapshot.Time.Equal(c.Now()) {
+		t.Fatalf("snapshot at %s, clock at %s", snapshot.Time, c.Now())
+	}
+
+	if err := openAuditLog(RotateConfig{Path: "audit.log"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auditLog = nil })
+	audit(auditUnknownSensor, "a", "", "")
+	encoded, err := ioutil.ReadFile("audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event auditEvent
+	if err := json.Unmarshal(encoded, &event); err != nil {
+		t.Fatal(err)
+	}
+	if !event.Time.Equal(c.Now()) {
+		t.Fatalf("audit event at %s, clock at %s", event.Time, c.Now())
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// notifyWindow is how long HomeKit updates of the sensor are held together.
+func (c SensorConfig) notifyWindow() time.Duration {
+	return time.Duration(c.NotifyWindow) * time.Second
+}
+
+// onHomeKitUpdate registers fn for the measurements of a sensor that change
+// characteristics. Within a window only the first measurement is passed on
+// right away, the latest of the rest follows when the window ends. Every
+// measurement is complete, so skipping the ones in between loses nothing.
+func onHomeKitUpdate(serial string, window time.Duration, fn func(Measurement)) {
+	notify := func(measurement Measurement, stored time.Time) {
+		fn(measurement)
+		store.RecordNotifyLag(serial, clock.Since(stored))
+	}
+
+	if window <= 0 {
+		store.OnUpdate(serial, func(measurement Measurement) {
+			notify(measurement, clock.Now())
+		})
+		return
+	}
+
+	var (
+		mutex   sync.Mutex
+		last    time.Time
+		pending *Measurement
+		stored  time.Time
+	)
+
+	store.OnUpdate(serial, func(measurement Measurement) {
+		mutex.Lock()
+		if since := clock.Since(last); since >= window && pending == nil {
+			last = clock.Now()
+			mutex.Unlock()
+			notify(measurement, last)
+			return
+		}
+
+		scheduled := pending != nil
+		pending, stored = &measurement, clock.Now()
+		if !scheduled {
+			clock.AfterFunc(window-clock.Since(last), func() {
+				mutex.Lock()
+				latest, since := *pending, stored
+				pending, last = nil, clock.Now()
+				mutex.Unlock()
+				notify(latest, since)
+			})
+		}
+		mutex.Unlock()
+	})
+}
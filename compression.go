@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// defaultMaxDecompressedSize caps how large a compressed payload may get once
+// decompressed, so that a tiny packet cannot make us allocate gigabytes.
+const defaultMaxDecompressedSize = 64 * 1024
+
+var errDecompressedTooLarge = errors.New("decompressed payload too large")
+
+// isZlib recognizes the two byte zlib header: deflate, a window of at most
+// 32 KiB and a checksum over both bytes. That rules out JSON, CBOR and
+// MessagePack maps.
+func isZlib(payload []byte) bool {
+	return len(payload) >= 2 && payload[0]&0x0f == 8 && payload[0]>>4 <= 7 &&
+		(uint16(payload[0])<<8|uint16(payload[1]))%31 == 0
+}
+
+// decompress inflates gzip and zlib compressed payloads, which sensors use
+// for batched history uploads. Other payloads are returned as they are.
+func decompress(payload []byte, limit int) ([]byte, error) {
+	if limit <= 0 {
+		limit = defaultMaxDecompressedSize
+	}
+
+	var r io.ReadCloser
+	var err error
+
+	switch {
+	case len(payload) >= 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		r, err = gzip.NewReader(bytes.NewReader(payload))
+	case isZlib(payload):
+		r, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		return payload, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	decompressed, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > limit {
+		return nil, errDecompressedTooLarge
+	}
+	return decompressed, nil
+}
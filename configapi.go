@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Calibration corrects a value of a sensor: the reported value is multiplied
+// by Scale, which defaults to 1, and then Offset is added.
+type Calibration struct {
+	Offset float64  `json:"offset,omitempty"`
+	Scale  *float64 `json:"scale,omitempty"`
+}
+
+// calibrate corrects the values of a measurement that have a calibration.
+func calibrate(calibrations map[string]Calibration, data *MeasurementData) {
+	if len(calibrations) == 0 {
+		return
+	}
+
+	mapValues(data, nil, func(name string, value float64) float64 {
+		calibration, ok := calibrations[name]
+		if !ok {
+			return value
+		}
+		if calibration.Scale != nil {
+			value *= *calibration.Scale
+		}
+		return value + calibration.Offset
+	})
+}
+
+// live is the config as it is now, after changes made through the API or by
+// editing the file and sending a SIGHUP.
+var live struct {
+	mutex  sync.RWMutex
+	config Config
+}
+
+func setLiveConfig(config Config) {
+	live.mutex.Lock()
+	defer live.mutex.Unlock()
+	live.config = config
+}
+
+func liveConfig() Config {
+	live.mutex.RLock()
+	defer live.mutex.RUnlock()
+	return live.config
+}
+
+func liveSensor(serial string) (SensorConfig, bool) {
+	return liveConfig().Bridge.sensor(serial)
+}
+
+// validateSensor checks a sensor before it goes into the config file.
+func validateSensor(sensor SensorConfig) error {
+	if sensor.Serial == "" {
+		return fmt.Errorf("sensor has no serial")
+	}
+	if strings.Contains(sensor.Serial, "/") {
+		return fmt.Errorf("serial <%s> cannot contain a slash", sensor.Serial)
+	}
+	if _, err := sensor.profileRules(); err != nil {
+		return err
+	}
+	if _, err := sensor.pipeline(); err != nil {
+		return err
+	}
+	if err := sensor.Temperature.validate(); err != nil {
+		return err
+	}
+	if err := sensor.Door.validate(); err != nil {
+		return err
+	}
+	if sensor.Units != nil {
+		if err := sensor.Units.validate(); err != nil {
+			return err
+		}
+	}
+	if sensor.Precision != nil && (*sensor.Precision < 0 || *sensor.Precision > 6) {
+		return fmt.Errorf("precision must be between 0 and 6 decimals")
+	}
+	for metric, source := range sensor.sources() {
+		if _, err := aggregateFunc(source.Aggregate); err != nil {
+			return fmt.Errorf("source of %s: %v", metric, err)
+		}
+		if source.Probe != "" && metricKind(metric) != reflect.Float32 {
+			return fmt.Errorf("source of %s: a probe can only provide a decimal value", metric)
+		}
+		if source.StaleAfter < 0 || (source.StaleAfter != 0 && source.Aggregate != "failover") {
+			return fmt.Errorf("source of %s: stale_after is a positive number of seconds, only for failover", metric)
+		}
+	}
+	return nil
+}
+
+// writeConfigJSON encodes v, leaving out the HMAC keys of sensors unless the
+// request asked for them with ?secrets=true.
+func writeConfigJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if r.URL.Query().Get("secrets") != "true" {
+		switch sensors := v.(type) {
+		case []SensorConfig:
+			redacted := make([]SensorConfig, len(sensors))
+			for i, sensor := range sensors {
+				redacted[i] = sensor.redacted()
+			}
+			v = redacted
+		case SensorConfig:
+			v = sensors.redacted()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Failed to encode config: ", err)
+	}
+}
+
+func (c SensorConfig) redacted() SensorConfig {
+	if c.HMACKey != "" {
+		c.HMACKey = "redacted"
+	}
+	return c
+}
+
+// configStatus is the HTTP status for an error from updateConfig: the
+// request is at fault when the edit was rejected, the bridge otherwise.
+func configStatus(err error) int {
+	if _, ok := err.(configRejected); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// applyConfigChange reloads the config after the API changed it and answers
+// with an error if either failed.
+func applyConfigChange(w http.ResponseWriter, err error) bool {
+	if err != nil {
+		http.Error(w, err.Error(), configStatus(err))
+		return false
+	}
+	if err := reloadConfig(); err != nil {
+		http.Error(w, "the config was written but could not be reloaded: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// handleConfigSensors handles GET and POST /api/v1/config/sensors
+func handleConfigSensors(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeConfigJSON(w, r, http.StatusOK, liveConfig().Bridge.Sensors)
+	case http.MethodPost:
+		var sensor SensorConfig
+		if err := json.NewDecoder(r.Body).Decode(&sensor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateSensor(sensor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := liveSensor(sensor.Serial); ok {
+			http.Error(w, fmt.Sprintf("sensor <%s> is already configured", sensor.Serial), http.StatusBadRequest)
+			return
+		}
+		if applyConfigChange(w, addSensorToConfig(configPath, sensor)) {
+			log.Printf("[*] Added sensor <%s>", sensor.Serial)
+			writeConfigJSON(w, r, http.StatusCreated, sensor)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleConfigSensor handles GET, PUT and DELETE /api/v1/config/sensors/<id>.
+// PUT replaces the whole sensor.
+func handleConfigSensor(w http.ResponseWriter, r *http.Request) {
+	serial := strings.TrimPrefix(r.URL.Path, "/api/v1/config/sensors/")
+
+	// Sensors in the sensors directory belong to whatever manages that
+	if sensor, ok := liveSensor(serial); ok && sensor.file != "" && r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("sensor <%s> is defined in %s", serial, sensor.file), http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sensor, ok := liveSensor(serial)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeConfigJSON(w, r, http.StatusOK, sensor)
+	case http.MethodPut:
+		var sensor SensorConfig
+		if err := json.NewDecoder(r.Body).Decode(&sensor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if sensor.Serial == "" {
+			sensor.Serial = serial
+		}
+		if sensor.Serial != serial {
+			http.Error(w, "serial cannot change", http.StatusBadRequest)
+			return
+		}
+		if err := validateSensor(sensor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := updateSensorsInConfig(configPath, func(sensors []SensorConfig) ([]SensorConfig, error) {
+			for i := range sensors {
+				if sensors[i].Serial == serial {
+					// Keep the key when a redacted copy comes back
+					if sensor.HMACKey == "redacted" {
+						sensor.HMACKey = sensors[i].HMACKey
+					}
+					sensors[i] = sensor
+					return sensors, nil
+				}
+			}
+			return nil, fmt.Errorf("sensor <%s> is not configured", serial)
+		})
+		if applyConfigChange(w, err) {
+			log.Printf("[*] Updated sensor <%s>", serial)
+			writeConfigJSON(w, r, http.StatusOK, sensor)
+		}
+	case http.MethodDelete:
+		err := updateSensorsInConfig(configPath, func(sensors []SensorConfig) ([]SensorConfig, error) {
+			for i := range sensors {
+				if sensors[i].Serial == serial {
+					return append(sensors[:i], sensors[i+1:]...), nil
+				}
+			}
+			return nil, fmt.Errorf("sensor <%s> is not configured", serial)
+		})
+		if applyConfigChange(w, err) {
+			log.Printf("[*] Removed sensor <%s>, restart the bridge to unpublish it", serial)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleConfigAlertRules handles GET and PUT /api/v1/config/alert_rules. PUT
+// replaces all rules.
+func handleConfigAlertRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rules := liveConfig().AlertRules
+		if rules == nil {
+			rules = []AlertRule{}
+		}
+		writeConfigJSON(w, r, http.StatusOK, rules)
+	case http.MethodPut:
+		var rules []AlertRule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateRules(rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := updateConfig(configPath, func(config map[string]json.RawMessage) error {
+			encoded, err := marshalConfig(rules, "")
+			config["alert_rules"] = encoded
+			return err
+		})
+		if applyConfigChange(w, err) {
+			log.Printf("[*] Updated alert rules")
+			writeConfigJSON(w, r, http.StatusOK, rules)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
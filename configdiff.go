@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigChange is a difference between the running config and the config
+// file. Restart is set when the change only takes effect after a restart.
+type ConfigChange struct {
+	Section string   `json:"section,omitempty"`
+	Sensor  string   `json:"sensor,omitempty"`
+	Change  string   `json:"change"`
+	Fields  []string `json:"fields,omitempty"`
+	Restart bool     `json:"restart"`
+}
+
+func (c ConfigChange) String() string {
+	var s string
+	if c.Sensor != "" {
+		s = fmt.Sprintf("sensor <%s> %s", c.Sensor, c.Change)
+	} else {
+		s = fmt.Sprintf("%s %s", c.Section, c.Change)
+	}
+	if len(c.Fields) != 0 {
+		s += ": " + strings.Join(c.Fields, ", ")
+	}
+	if c.Restart {
+		s += " (needs a restart)"
+	}
+	return s
+}
+
+// Settings that reloadConfig applies to a running bridge, by JSON name. All
+// other changes need a restart.
+var (
+	liveSections     = map[string]bool{"alert_rules": true}
+	liveBridgeFields = map[string]bool{"name_template": true}
+	liveSensorFields = map[string]bool{
+		"name": true, "room": true, "group": true, "tags": true, "hmac_key": true,
+		"dry_threshold": true, "noise_threshold": true, "rssi_threshold": true,
+		"low_level_threshold": true, "high_level_threshold": true,
+		"firmware_image": true, "firmware_pin": true, "ttl": true,
+		"setpoint": true, "calibration": true, "anomaly": true, "pipeline": true,
+		"units": true,
+	}
+)
+
+// changedFields returns the JSON names of the exported fields that differ
+// between two structs of the same type, leaving out those in skip.
+func changedFields(a, b interface{}, skip ...string) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var fields []string
+	for i := 0; i < va.NumField(); i++ {
+		field := va.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.PkgPath != "" || name == "" || contains(skip, name) {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+func needsRestart(fields []string, live map[string]bool) bool {
+	for _, field := range fields {
+		if !live[field] {
+			return true
+		}
+	}
+	return false
+}
+
+// diffConfig returns what changes when going from the old to the new config.
+func diffConfig(old, new Config) []ConfigChange {
+	var changes []ConfigChange
+
+	for _, section := range changedFields(old, new, "bridge") {
+		changes = append(changes, ConfigChange{Section: section, Change: "changed", Restart: !liveSections[section]})
+	}
+
+	if fields := changedFields(old.Bridge, new.Bridge, "sensors"); len(fields) != 0 {
+		changes = append(changes, ConfigChange{Section: "bridge", Change: "changed", Fields: fields, Restart: needsRestart(fields, liveBridgeFields)})
+	}
+
+	oldSensors := map[string]SensorConfig{}
+	for _, sensor := range old.Bridge.Sensors {
+		oldSensors[sensor.Serial] = sensor
+	}
+	newSensors := map[string]SensorConfig{}
+	for _, sensor := range new.Bridge.Sensors {
+		newSensors[sensor.Serial] = sensor
+	}
+
+	var serials []string
+	for serial := range oldSensors {
+		serials = append(serials, serial)
+	}
+	for serial := range newSensors {
+		if _, ok := oldSensors[serial]; !ok {
+			serials = append(serials, serial)
+		}
+	}
+	sort.Strings(serials)
+
+	for _, serial := range serials {
+		before, existed := oldSensors[serial]
+		after, exists := newSensors[serial]
+		switch {
+		case !existed:
+			changes = append(changes, ConfigChange{Sensor: serial, Change: "added", Restart: true})
+		case !exists:
+			changes = append(changes, ConfigChange{Sensor: serial, Change: "removed", Restart: true})
+		default:
+			if fields := changedFields(before, after); len(fields) != 0 {
+				changes = append(changes, ConfigChange{Sensor: serial, Change: "changed", Fields: fields, Restart: needsRestart(fields, liveSensorFields)})
+			}
+		}
+	}
+
+	return changes
+}
+
+func logConfigChanges(changes []ConfigChange) {
+	for _, change := range changes {
+		log.Printf("[*] Config: %s", change)
+		audit(auditConfigChanged, change.Sensor, "", change.String())
+	}
+}
+
+// handleConfigCheck handles POST /api/v1/config/check, which loads the config
+// file and returns how it differs from the running config without applying
+// it.
+func handleConfigCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	changes := diffConfig(liveConfig(), config)
+	if changes == nil {
+		changes = []ConfigChange{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(changes); err != nil {
+		log.Println("Failed to encode config changes: ", err)
+	}
+}
+
+// checkCommand validates the config file and, if the bridge runs, prints what
+// a reload would change.
+func checkCommand(args []string) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Config file is invalid:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Config file is valid")
+
+	if config.API.Address == "" {
+		fmt.Println("The API is not enabled, cannot compare with the running bridge")
+		return
+	}
+
+	var changes []ConfigChange
+	if err := requestAPI(config.API, http.MethodPost, "/api/v1/config/check", &changes); err != nil {
+		fmt.Println("Cannot compare with the running bridge:", err)
+		return
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("No changes")
+		return
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+}
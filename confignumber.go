@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/util"
+)
+
+// configurationState is what the accessories looked like when the bridge was
+// last published, and the configuration number it got.
+type configurationState struct {
+	Hash   string `json:"hash"`
+	Number int64  `json:"number"`
+}
+
+// hc bumps the number once more itself when the structure changed, HAP
+// wants it to wrap around before 65535
+const maxConfigurationNumber = 65534
+
+var configurationPath = filepath.Join(storagePath, "configuration.json")
+
+// accessoriesHash fingerprints what controllers keep of the accessories:
+// their IDs, services, characteristics and names. hc only hashes the
+// structure, a renamed sensor would keep its old name in the Home app.
+func accessoriesHash(accessories []*accessory.Accessory) string {
+	h := sha256.New()
+	for _, a := range accessories {
+		fmt.Fprintf(h, "accessory %d\n", a.ID)
+		for _, s := range a.Services {
+			fmt.Fprintf(h, "service %s\n", s.Type)
+			for _, c := range s.Characteristics {
+				fmt.Fprintf(h, "characteristic %s %s %v\n", c.Type, c.Format, c.Perms)
+				if c.Type == characteristic.TypeName {
+					fmt.Fprintf(h, "name %v\n", c.Value)
+				}
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// updateConfigurationNumber bumps the configuration number the transport
+// announces when the accessories changed since they were last published, so
+// that controllers fetch them again instead of showing ghosts. It must run
+// before the transport is created, which reads the number from storage.
+func updateConfigurationNumber(accessories []*accessory.Accessory) (func() error, error) {
+	storage, err := util.NewFileStorage(storagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	number := int64(1)
+	if b, err := storage.Get("version"); err == nil && len(b) > 0 {
+		if number, err = strconv.ParseInt(string(b), 10, 64); err != nil || number < 1 {
+			number = 1
+		}
+	}
+
+	var state configurationState
+	if encoded, err := ioutil.ReadFile(configurationPath); err == nil {
+		if err := json.Unmarshal(encoded, &state); err != nil {
+			return nil, fmt.Errorf("%s: %v", configurationPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	hash := accessoriesHash(accessories)
+	if state.Hash != "" && state.Hash != hash {
+		if state.Number > number {
+			number = state.Number
+		}
+		if number++; number > maxConfigurationNumber {
+			number = 1
+		}
+		if err := storage.Set("version", []byte(strconv.FormatInt(number, 10))); err != nil {
+			return nil, err
+		}
+	}
+
+	// The transport may bump the number again, so it is saved once it exists
+	return func() error {
+		if b, err := storage.Get("version"); err == nil && len(b) > 0 {
+			if published, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+				number = published
+			}
+		}
+		encoded, err := json.MarshalIndent(configurationState{Hash: hash, Number: number}, "", "    ")
+		if err != nil {
+			return err
+		}
+		tmp := configurationPath + ".tmp"
+		if err := ioutil.WriteFile(tmp, encoded, 0600); err != nil {
+			return err
+		}
+		return os.Rename(tmp, configurationPath)
+	}, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// DecodingRule decodes the packets from a subnet in its own way, for fleets
+// where some sensors still send another format than the rest to the same
+// port. Format, Encoding and Parsing replace those of the receiver when set.
+type DecodingRule struct {
+	Subnet   string `json:"subnet"`
+	Format   string `json:"format,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Parsing  string `json:"parsing,omitempty"`
+}
+
+func (r DecodingRule) validate() error {
+	if _, _, err := net.ParseCIDR(r.Subnet); err != nil {
+		return fmt.Errorf("invalid subnet <%s>", r.Subnet)
+	}
+	switch r.Format {
+	case "", "json", "legacy":
+	default:
+		return fmt.Errorf("unknown format <%s> for <%s>", r.Format, r.Subnet)
+	}
+	return nil
+}
+
+func validateReceivers(receivers []ReceiverConfig) error {
+	for _, receiver := range receivers {
+		for _, rule := range receiver.Rules {
+			if err := rule.validate(); err != nil {
+				return fmt.Errorf("receiver <%s>: %v", receiver.Tag, err)
+			}
+		}
+	}
+	return nil
+}
+
+// forSource returns the receiver with the first of its rules that matches
+// the address a packet came from applied.
+func (c ReceiverConfig) forSource(address net.Addr) ReceiverConfig {
+	if len(c.Rules) == 0 || address == nil {
+		return c
+	}
+	ip := net.ParseIP(addressHost(address))
+	if ip == nil {
+		return c
+	}
+
+	for _, rule := range c.Rules {
+		_, subnet, err := net.ParseCIDR(rule.Subnet)
+		if err != nil || !subnet.Contains(ip) {
+			continue
+		}
+		if rule.Format != "" {
+			c.Format = rule.Format
+		}
+		if rule.Encoding != "" {
+			c.Encoding = rule.Encoding
+		}
+		if rule.Parsing != "" {
+			c.Parsing = rule.Parsing
+		}
+		break
+	}
+	return c
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/brutella/dnssd"
+)
+
+const discoveryServiceType = "_sensor-bridge._udp"
+
+type DiscoveryConfig struct {
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name"`
+}
+
+// Announcement is the answer to a discover packet. Sensors broadcast one to
+// the receiver port and take the address of the bridge from the reply.
+type Announcement struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Port int    `json:"port"`
+}
+
+func discoveryName(config Config) string {
+	if config.Discovery.Name != "" {
+		return config.Discovery.Name
+	}
+	return config.Bridge.Name
+}
+
+func processDiscover(config Config, p packet) error {
+	if !config.Discovery.Enabled {
+		return nil
+	}
+
+	announcement := Announcement{
+		Type: "bridge",
+		Name: discoveryName(config),
+		Port: p.receiver.Port,
+	}
+
+	encodedAnnouncement, err := json.Marshal(announcement)
+	if err != nil {
+		return err
+	}
+
+	return p.reply(encodedAnnouncement)
+}
+
+// announce publishes every UDP receiver as a _sensor-bridge._udp service.
+func announce(config Config) {
+	if !config.Discovery.Enabled {
+		return
+	}
+
+	responder, err := dnssd.NewResponder()
+	if err != nil {
+		log.Println("Could not start mDNS responder: ", err)
+		return
+	}
+
+	for _, receiver := range config.receivers() {
+		if receiver.Type != "" && receiver.Type != "udp" {
+			continue
+		}
+
+		service, err := dnssd.NewService(dnssd.Config{
+			Name: discoveryName(config),
+			Type: discoveryServiceType,
+			Port: receiver.Port,
+			Text: map[string]string{"receiver": receiver.Tag},
+		})
+		if err != nil {
+			log.Println("Could not create mDNS service: ", err)
+			continue
+		}
+
+		if _, err := responder.Add(service); err != nil {
+			log.Println("Could not add mDNS service: ", err)
+			continue
+		}
+
+		log.Printf("[*] Announcing receiver <%s> as %s on port %d", receiver.Tag, discoveryServiceType, receiver.Port)
+	}
+
+	go func() {
+		if err := responder.Respond(context.Background()); err != nil {
+			log.Println("mDNS responder stopped: ", err)
+		}
+	}()
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brutella/dnssd"
+)
+
+const (
+	doctorPass = "PASS"
+	doctorFail = "FAIL"
+	doctorSkip = "SKIP"
+)
+
+// doctorResult is the outcome of one of the checks of the doctor command.
+type doctorResult struct {
+	Check  string
+	Status string
+	Detail string
+}
+
+// The history needs room for the measurement log and its rotated files, and
+// at least this much for everything else, in MB
+const minFreeSpaceMB = 100
+
+// doctorCommand checks the things that usually explain why sensors do not
+// show up or update in HomeKit and prints a report, so that it can be pasted
+// into a support request. It exits with status 1 when a check failed.
+func doctorCommand(args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 3*time.Second, "how long to wait for answers from the network")
+	flags.Parse(args)
+
+	var results []doctorResult
+	add := func(check string, status string, format string, args ...interface{}) {
+		results = append(results, doctorResult{Check: check, Status: status, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		add("config", doctorFail, "%s is invalid: %v", configPath, err)
+	} else {
+		add("config", doctorPass, "%s is valid, %d sensors", configPath, len(config.Bridge.Sensors))
+		configureClock(config.Clock)
+
+		for _, receiver := range config.receivers() {
+			status, detail := checkReceiver(config, receiver, *timeout)
+			add("receiver "+receiver.Tag, status, "%s", detail)
+		}
+	}
+
+	id, status, detail := checkPairingStorage()
+	add("pairing storage", status, "%s", detail)
+
+	if err == nil {
+		if config.Bridge.Disabled {
+			add("mdns", doctorSkip, "HomeKit is disabled")
+		} else {
+			status, detail := checkMDNS(config.Bridge.Name, id, *timeout)
+			add("mdns", status, "%s", detail)
+		}
+
+		status, detail := checkClockSanity(config)
+		add("clock", status, "%s", detail)
+
+		for _, path := range historyPaths(config) {
+			status, detail := checkFreeSpace(path, config.MeasurementLog)
+			add("disk "+path, status, "%s", detail)
+		}
+	}
+
+	if printResults(results) {
+		os.Exit(1)
+	}
+}
+
+// printResults prints a report of checks and tells if any of them failed.
+func printResults(results []doctorResult) bool {
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Status, result.Check, result.Detail)
+		failed = failed || result.Status == doctorFail
+	}
+	w.Flush()
+	return failed
+}
+
+// checkReceiver tells if a running bridge listens on a UDP receiver. With
+// discovery enabled the bridge is asked to announce itself, otherwise the port
+// just has to be in use.
+func checkReceiver(config Config, receiver ReceiverConfig, timeout time.Duration) (string, string) {
+	if receiver.Type != "" && receiver.Type != "udp" {
+		return doctorSkip, fmt.Sprintf("%s receivers are not checked", receiver.Type)
+	}
+
+	network := receiver.Network
+	if network == "" {
+		network = "udp"
+	}
+	port := strconv.Itoa(receiver.Port)
+
+	if config.Discovery.Enabled {
+		host := receiver.Group
+		if host == "" {
+			host = receiver.Address
+		}
+		if host == "" || net.ParseIP(host).IsUnspecified() {
+			host = "localhost"
+		}
+		if err := discoverBridge(network, net.JoinHostPort(host, port), timeout); err != nil {
+			return doctorFail, fmt.Sprintf("no answer to discover on %s port %s: %v", host, port, err)
+		}
+		return doctorPass, fmt.Sprintf("the bridge answers on %s port %s", host, port)
+	}
+
+	// Multicast sockets share their port, binding it tells nothing
+	if receiver.Group != "" {
+		return doctorSkip, "enable discovery to check multicast receivers"
+	}
+
+	conn, err := listenUDP(receiver)
+	if err == nil {
+		conn.Close()
+		return doctorFail, fmt.Sprintf("nothing listens on port %s, is the bridge running?", port)
+	}
+	if !strings.Contains(err.Error(), "address already in use") {
+		return doctorFail, fmt.Sprintf("cannot bind port %s: %v", port, err)
+	}
+	return doctorPass, fmt.Sprintf("port %s is in use, enable discovery to check it is the bridge", port)
+}
+
+func discoverBridge(network, address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(`{"type":"discover"}`)); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return err
+		}
+		var announcement Announcement
+		if json.Unmarshal(buffer[:n], &announcement) == nil && announcement.Type == "bridge" {
+			return nil
+		}
+	}
+}
+
+// checkPairingStorage makes sure that the files hc keeps the identity of the
+// bridge and its pairings in can be read. A bridge that lost them has to be
+// removed and paired again in the Home app. It returns the device ID of the
+// bridge, if it has one yet.
+func checkPairingStorage() (string, string, string) {
+	b, err := ioutil.ReadFile(filepath.Join(storagePath, "uuid"))
+	if os.IsNotExist(err) {
+		return "", doctorPass, "the bridge has not been started yet"
+	}
+	if err != nil {
+		return "", doctorFail, err.Error()
+	}
+	id := string(b)
+
+	files, err := filepath.Glob(filepath.Join(storagePath, "*.entity"))
+	if err != nil {
+		return id, doctorFail, err.Error()
+	}
+
+	var keys bool
+	pairings := 0
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return id, doctorFail, err.Error()
+		}
+		var entity struct {
+			Name       string
+			PublicKey  []byte
+			PrivateKey []byte
+		}
+		if err := json.Unmarshal(b, &entity); err != nil {
+			return id, doctorFail, fmt.Sprintf("%s is corrupt: %v", file, err)
+		}
+
+		if entity.Name != id {
+			pairings++
+			continue
+		}
+		if len(entity.PublicKey) != 32 || len(entity.PrivateKey) != 64 {
+			return id, doctorFail, fmt.Sprintf("%s has no valid key pair", file)
+		}
+		keys = true
+	}
+
+	if !keys {
+		return id, doctorFail, fmt.Sprintf("no key pair for bridge <%s>, it has to be paired again", id)
+	}
+	if pairings == 0 {
+		return id, doctorPass, fmt.Sprintf("bridge <%s> is not paired", id)
+	}
+	return id, doctorPass, fmt.Sprintf("bridge <%s> has %d pairings", id, pairings)
+}
+
+// checkMDNS looks for the bridge among the HomeKit accessories announced on
+// the network, by device ID or else by name.
+func checkMDNS(name, id string, timeout time.Duration) (string, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var found *dnssd.Service
+	err := dnssd.LookupType(ctx, "_hap._tcp.local.", func(service dnssd.Service) {
+		if (id != "" && service.Text["id"] == id) || (id == "" && strings.HasPrefix(service.Name, name)) {
+			found = &service
+			cancel()
+		}
+	}, func(dnssd.Service) {})
+	if found != nil {
+		return doctorPass, fmt.Sprintf("announced as <%s> on %s port %d", found.Name, found.Host, found.Port)
+	}
+	if err != nil && err != context.Canceled && err != context.DeadlineExceeded {
+		return doctorFail, fmt.Sprintf("cannot browse mDNS: %v", err)
+	}
+	return doctorFail, fmt.Sprintf("bridge <%s> is not announced, is the bridge running and multicast allowed?", name)
+}
+
+// checkClockSanity catches hosts without a battery backed clock that did not
+// set the time after booting. When the API is reachable it also asks whether
+// the sensors that report their time all disagree with ours.
+func checkClockSanity(config Config) (string, string) {
+	now := time.Now()
+	if now.Before(minSensorTime) {
+		return doctorFail, fmt.Sprintf("the time is %s, is NTP running?", now.Format(time.RFC3339))
+	}
+
+	if config.API.Address == "" {
+		return doctorPass, fmt.Sprintf("the time is %s", now.Format(time.RFC3339))
+	}
+
+	var states []SensorState
+	if err := fetchAPI(config.API, "/api/v1/sensors", &states); err != nil {
+		return doctorPass, fmt.Sprintf("the time is %s, cannot compare with the sensors: %v", now.Format(time.RFC3339), err)
+	}
+
+	var skews []float64
+	for _, state := range states {
+		if state.Stats.ClockSkew != nil {
+			skews = append(skews, *state.Stats.ClockSkew)
+		}
+	}
+	if len(skews) == 0 {
+		return doctorPass, fmt.Sprintf("the time is %s, no sensors report theirs", now.Format(time.RFC3339))
+	}
+
+	sort.Float64s(skews)
+	median := skews[len(skews)/2]
+	if len(skews) > 1 && math.Abs(median) > maxClockSkew.Seconds() {
+		return doctorFail, fmt.Sprintf("the sensors are %s off from our clock", time.Duration(median*float64(time.Second)).Round(time.Second))
+	}
+	return doctorPass, fmt.Sprintf("the sensors are within %s of our clock", time.Duration(math.Abs(median)*float64(time.Second)).Round(time.Second))
+}
+
+// historyPaths are the directories the bridge writes its state and history
+// to.
+func historyPaths(config Config) []string {
+	paths := []string{storagePath}
+	for _, log := range []RotateConfig{config.MeasurementLog, config.AuditLog} {
+		if log.Path == "" {
+			continue
+		}
+		path := filepath.Dir(log.Path)
+		if !contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func checkFreeSpace(path string, measurementLog RotateConfig) (string, string) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		if os.IsNotExist(err) {
+			return doctorPass, "does not exist yet"
+		}
+		return doctorFail, err.Error()
+	}
+	free := uint64(stat.Bavail) * uint64(stat.Bsize) / (1024 * 1024)
+
+	// A full measurement log and its rotated files, when they are capped
+	need := uint64(minFreeSpaceMB)
+	if measurementLog.Path != "" && filepath.Dir(measurementLog.Path) == path && measurementLog.MaxSizeMB > 0 {
+		need += uint64(measurementLog.MaxSizeMB * (measurementLog.MaxFiles + 1))
+	}
+
+	if free < need {
+		return doctorFail, fmt.Sprintf("%d MB free, %d MB needed", free, need)
+	}
+	return doctorPass, fmt.Sprintf("%d MB free", free)
+}
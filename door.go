@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
+
+// DoorConfig sets the tilt angles at which an accelerometer based door sensor
+// counts as closed or open. Angles in between keep the last state for a
+// contact sensor and are opening or closing for a garage door.
+type DoorConfig struct {
+	Closed *float32 `json:"closed,omitempty"`
+	Open   *float32 `json:"open,omitempty"`
+}
+
+// Degrees, a garage door tilts up to 90 when it is fully open
+const (
+	defaultClosedAngle = 5
+	defaultOpenAngle   = 80
+)
+
+func (c *DoorConfig) thresholds() (closed, open float32) {
+	closed, open = defaultClosedAngle, defaultOpenAngle
+	if c == nil {
+		return
+	}
+	if c.Closed != nil {
+		closed = *c.Closed
+	}
+	if c.Open != nil {
+		open = *c.Open
+	}
+	return
+}
+
+func (c *DoorConfig) validate() error {
+	if closed, open := c.thresholds(); closed >= open {
+		return fmt.Errorf("door closed angle must be below the open angle")
+	}
+	return nil
+}
+
+// doorAngle is the tilt angle of a door, or its position for sensors that
+// report one instead.
+func doorAngle(data MeasurementData) (float32, bool) {
+	if data.Angle != nil {
+		return *data.Angle, true
+	}
+	if data.Position != nil {
+		return float32(*data.Position), true
+	}
+	return 0, false
+}
+
+// createGarageDoor exposes a door sensor as a garage door opener that only
+// reports its state, the bridge cannot open or close the door.
+func createGarageDoor(config SensorConfig, id uint64) (*accessory.Accessory, error) {
+	ac := accessory.New(accessoryInfo(config, id), accessory.TypeGarageDoorOpener)
+
+	garage := service.NewGarageDoorOpener()
+	addServiceName(config, garage.Service, "Door")
+	garage.TargetDoorState.Perms = characteristic.PermsRead()
+	garage.CurrentDoorState.SetValue(characteristic.CurrentDoorStateClosed)
+	garage.TargetDoorState.SetValue(characteristic.TargetDoorStateClosed)
+
+	closed, open := config.Door.thresholds()
+	var last *float32
+
+	onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+		angle, ok := doorAngle(measurement.MeasurementData)
+		if !ok {
+			return
+		}
+
+		state, target := characteristic.CurrentDoorStateStopped, garage.TargetDoorState.GetValue()
+		switch {
+		case angle <= closed:
+			state, target = characteristic.CurrentDoorStateClosed, characteristic.TargetDoorStateClosed
+		case angle >= open:
+			state, target = characteristic.CurrentDoorStateOpen, characteristic.TargetDoorStateOpen
+		case last != nil && angle > *last:
+			state, target = characteristic.CurrentDoorStateOpening, characteristic.TargetDoorStateOpen
+		case last != nil && angle < *last:
+			state, target = characteristic.CurrentDoorStateClosing, characteristic.TargetDoorStateClosed
+		}
+		last = &angle
+
+		garage.TargetDoorState.UpdateValue(target)
+		garage.CurrentDoorState.UpdateValue(state)
+	})
+
+	addStatusTampered(config, garage.Service)
+
+	ac.AddService(garage.Service)
+
+	return ac, nil
+}
+
+// createContactSensor exposes a door sensor as a contact sensor that is open
+// above the open angle and closed below the closed angle.
+func createContactSensor(config SensorConfig, id uint64) (*accessory.Accessory, error) {
+	ac := accessory.New(accessoryInfo(config, id), accessory.TypeSensor)
+
+	contact := service.NewContactSensor()
+	addServiceName(config, contact.Service, "Contact")
+
+	closed, open := config.Door.thresholds()
+
+	onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+		angle, ok := doorAngle(measurement.MeasurementData)
+		if !ok {
+			return
+		}
+
+		switch {
+		case angle <= closed:
+			contact.ContactSensorState.UpdateValue(characteristic.ContactSensorStateContactDetected)
+		case angle >= open:
+			contact.ContactSensorState.UpdateValue(characteristic.ContactSensorStateContactNotDetected)
+		}
+	})
+
+	addStatusTampered(config, contact.Service)
+
+	ac.AddService(contact.Service)
+
+	return ac, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+type Command struct {
+	Type     string `json:"type"`
+	SensorID string `json:"sensor_id"`
+	On       *bool  `json:"on,omitempty"`
+	Speed    *int   `json:"speed,omitempty"`
+	Position *int   `json:"position,omitempty"`
+}
+
+// Downlink remembers which receiver each device last reported through, so
+// that commands go out over the same socket.
+type Downlink struct {
+	mutex  sync.Mutex
+	routes map[string]net.PacketConn
+}
+
+var downlink = &Downlink{routes: map[string]net.PacketConn{}}
+
+func (d *Downlink) Route(sensorID string, pc net.PacketConn) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.routes[sensorID] = pc
+}
+
+// Replace routes the devices that reported over a socket that was closed to
+// the one that took its place.
+func (d *Downlink) Replace(old, pc net.PacketConn) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for sensorID, route := range d.routes {
+		if route == old {
+			d.routes[sensorID] = pc
+		}
+	}
+}
+
+// Send delivers a command to a device at the address its last report came
+// from. Devices with an HMAC key get a signed command.
+func (d *Downlink) Send(sensor SensorConfig, command Command) error {
+	d.mutex.Lock()
+	pc := d.routes[sensor.Serial]
+	d.mutex.Unlock()
+
+	address, ok := store.Address(sensor.Serial)
+	if !ok {
+		return fmt.Errorf("address of <%s> unknown until it reports", sensor.Serial)
+	}
+
+	if pc == nil {
+		return fmt.Errorf("<%s> does not report over UDP", sensor.Serial)
+	}
+
+	command.Type = "command"
+	command.SensorID = sensor.Serial
+
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+
+	if sensor.HMACKey != "" {
+		if payload, err = sign(sensor.HMACKey, payload); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("%s: Sending command %s", sensor.Serial, payload)
+
+	_, err = pc.WriteTo(payload, address)
+	return err
+}
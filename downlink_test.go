@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDownlinkReplace(t *testing.T) {
+	listen := func() net.PacketConn {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return pc
+	}
+	old, other, pc := listen(), listen(), listen()
+
+	d := &Downlink{routes: map[string]net.PacketConn{}}
+	d.Route("a", old)
+	d.Route("b", other)
+	d.Replace(old, pc)
+
+	if d.routes["a"] != pc {
+		t.Fatal("route over the rebound socket was not replaced")
+	}
+	if d.routes["b"] != other {
+		t.Fatal("route over another socket was replaced")
+	}
+}
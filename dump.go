@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+)
+
+var bridgeAccessory *accessory.Accessory
+
+func registerBridge(ac *accessory.Accessory) {
+	accessoriesMutex.Lock()
+	defer accessoriesMutex.Unlock()
+	bridgeAccessory = ac
+}
+
+// accessoryTree returns the bridge and its sensors in the shape of the HAP
+// /accessories response, by accessory ID, with the values read like a
+// controller would read them. Instance IDs are only assigned once the HomeKit
+// transport runs.
+func accessoryTree() map[string][]*accessory.Accessory {
+	accessoriesMutex.Lock()
+	var tree []*accessory.Accessory
+	if bridgeAccessory != nil {
+		tree = append(tree, bridgeAccessory)
+	}
+	for _, ac := range accessories {
+		tree = append(tree, ac)
+	}
+	accessoriesMutex.Unlock()
+	sort.Slice(tree, func(i, j int) bool { return tree[i].ID < tree[j].ID })
+
+	// Values that change are sent to controllers, which logs HomeKit events
+	for _, ac := range tree {
+		for _, svc := range ac.Services {
+			for _, c := range svc.Characteristics {
+				if contains(c.Perms, characteristic.PermRead) {
+					c.GetValue()
+				}
+			}
+		}
+	}
+	return map[string][]*accessory.Accessory{"accessories": tree}
+}
+
+func handleAccessories(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(accessoryTree()); err != nil {
+		log.Println("Failed to encode accessories: ", err)
+	}
+}
+
+// dumpAccessoriesCommand prints the accessories of the running bridge the way
+// HomeKit controllers get them, to see what they make of the config.
+func dumpAccessoriesCommand(args []string) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatal("Could not load config file: ", err)
+	}
+
+	if config.API.Address == "" {
+		log.Fatal("The API is not enabled in the config file")
+	}
+
+	var tree json.RawMessage
+	if err := fetchAPI(config.API, "/api/v1/accessories", &tree); err != nil {
+		log.Fatal("Could not fetch accessories: ", err)
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, tree, "", "    "); err != nil {
+		log.Fatal("Could not format accessories: ", err)
+	}
+	out.WriteByte('\n')
+	out.WriteTo(os.Stdout)
+}
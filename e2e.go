@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/brutella/hc"
+	"github.com/brutella/hc/characteristic"
+)
+
+const (
+	e2ePin    = "03141592"
+	e2eSerial = "e2e-sensor"
+)
+
+// e2eReadings are sent to the bridge in turn, each has to show up in HomeKit
+// before the next is sent.
+var e2eReadings = []struct{ temperature, humidity float64 }{
+	{21.5, 45},
+	{-3.25, 80},
+}
+
+// e2eCommand runs a bridge from a fresh config and storage, pairs with it like
+// the Home app does, sends it readings over UDP and checks that HomeKit sees
+// them. It exits with status 1 when a step failed, so that forks can run it
+// in their CI.
+func e2eCommand(args []string) {
+	flags := flag.NewFlagSet("e2e", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 30*time.Second, "how long each step may take")
+	keep := flags.Bool("keep", false, "keep the directory the bridge ran in")
+	flags.Parse(args)
+
+	dir, err := ioutil.TempDir("", "sensor-bridge-e2e")
+	if err != nil {
+		log.Fatal("Could not create directory: ", err)
+	}
+
+	var hapPort, udpPort int
+	hapPort, err = freePort("tcp")
+	if err == nil {
+		udpPort, err = freePort("udp")
+	}
+	if err == nil {
+		err = writeE2EConfig(filepath.Join(dir, configPath), hapPort, udpPort)
+	}
+	if err != nil {
+		log.Fatal("Could not write config: ", err)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal("Could not find the bridge: ", err)
+	}
+
+	results, ok := runE2E(executable, dir, hapPort, udpPort, *timeout)
+	if printResults(results) || !ok {
+		fmt.Printf("The bridge ran in %s, its output is in bridge.log\n", dir)
+		os.Exit(1)
+	}
+	if *keep {
+		fmt.Printf("The bridge ran in %s\n", dir)
+		return
+	}
+	os.RemoveAll(dir)
+}
+
+// freePort returns a port that nothing listens on right now.
+func freePort(network string) (int, error) {
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+func writeE2EConfig(path string, hapPort, udpPort int) error {
+	config := map[string]interface{}{
+		"receiver": map[string]interface{}{"port": udpPort, "address": "127.0.0.1"},
+		"bridge": map[string]interface{}{
+			"name": "E2E Bridge",
+			"pin":  e2ePin,
+			"port": strconv.Itoa(hapPort),
+			"sensors": []map[string]interface{}{
+				{"serial": e2eSerial, "name": "E2E Sensor", "model": "E2E"},
+			},
+		},
+	}
+	b, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// runE2E runs the steps against the bridge executable in dir and stops at the
+// first that fails, the rest depend on it.
+func runE2E(executable, dir string, hapPort, udpPort int, timeout time.Duration) ([]doctorResult, bool) {
+	var results []doctorResult
+	step := func(name string, fn func() (string, error)) bool {
+		detail, err := fn()
+		if err != nil {
+			results = append(results, doctorResult{Check: name, Status: doctorFail, Detail: err.Error()})
+			return false
+		}
+		results = append(results, doctorResult{Check: name, Status: doctorPass, Detail: detail})
+		return true
+	}
+
+	stop := func() {}
+	defer func() { stop() }()
+
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(hapPort))
+	var client *hapClient
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	ok := step("start", func() (string, error) {
+		var err error
+		if stop, err = startE2EBridge(executable, dir); err != nil {
+			return "", err
+		}
+		err = waitFor(timeout, func() error {
+			client, err = dialHAP(address, time.Second)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("HomeKit does not listen on %s: %v", address, err)
+		}
+		return fmt.Sprintf("HomeKit listens on %s", address), nil
+	})
+
+	ok = ok && step("pair setup", func() (string, error) {
+		pin, err := hc.NewPin(e2ePin)
+		if err == nil {
+			err = client.pairSetup(pin)
+		}
+		return fmt.Sprintf("paired with <%s>", client.accessoryName), err
+	})
+
+	ok = ok && step("pair verify", func() (string, error) {
+		return "the connection is encrypted", client.pairVerify()
+	})
+
+	var aid uint64
+	iids := map[string]uint64{}
+	ok = ok && step("accessories", func() (string, error) {
+		accessories, err := client.accessories()
+		if err != nil {
+			return "", err
+		}
+		for _, accessory := range accessories {
+			if _, serial, _ := accessory.characteristic(characteristic.TypeSerialNumber); serial != e2eSerial {
+				continue
+			}
+			aid = accessory.AID
+			for _, typ := range []string{characteristic.TypeCurrentTemperature, characteristic.TypeCurrentRelativeHumidity} {
+				iid, _, ok := accessory.characteristic(typ)
+				if !ok {
+					return "", fmt.Errorf("sensor <%s> has no characteristic %s", e2eSerial, typ)
+				}
+				iids[typ] = iid
+			}
+			return fmt.Sprintf("%d accessories, sensor <%s> is %d", len(accessories), e2eSerial, aid), nil
+		}
+		return "", fmt.Errorf("sensor <%s> is not among the %d accessories", e2eSerial, len(accessories))
+	})
+
+	target := net.JoinHostPort("127.0.0.1", strconv.Itoa(udpPort))
+
+	for i, reading := range e2eReadings {
+		ok = ok && step(fmt.Sprintf("reading %d", i+1), func() (string, error) {
+			if err := sendE2EReading(target, i+1, reading.temperature, reading.humidity); err != nil {
+				return "", err
+			}
+			err := waitFor(timeout, func() error {
+				for typ, want := range map[string]float64{
+					characteristic.TypeCurrentTemperature:      reading.temperature,
+					characteristic.TypeCurrentRelativeHumidity: reading.humidity,
+				} {
+					value, err := client.readCharacteristic(aid, iids[typ])
+					if err != nil {
+						return err
+					}
+					if got, _ := value.(float64); math.Abs(got-want) > 0.01 {
+						return fmt.Errorf("characteristic %s is %v, want %v", typ, value, want)
+					}
+				}
+				return nil
+			})
+			return fmt.Sprintf("temperature %v, humidity %v", reading.temperature, reading.humidity), err
+		})
+	}
+
+	return results, ok
+}
+
+// startE2EBridge runs the bridge executable in dir and returns a function
+// that stops it.
+func startE2EBridge(executable, dir string) (func(), error) {
+	output, err := os.Create(filepath.Join(dir, "bridge.log"))
+	if err != nil {
+		return nil, err
+	}
+	defer output.Close()
+
+	cmd := exec.Command(executable)
+	cmd.Dir = dir
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// Fail fast when the bridge does not even start
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		return nil, fmt.Errorf("the bridge exited: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	return func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+	}, nil
+}
+
+func sendE2EReading(target string, seq int, temperature, humidity float64) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"sensor_id":      e2eSerial,
+		"measurement_id": strconv.Itoa(seq),
+		"measurement_data": map[string]float64{
+			"temperature": temperature,
+			"humidity":    humidity,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(payload)
+	return err
+}
+
+// waitFor calls fn until it succeeds or the timeout passes, and returns the
+// last error.
+func waitFor(timeout time.Duration, fn func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := fn()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
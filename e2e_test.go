@@ -0,0 +1,49 @@
+//go:build e2e
+// +build e2e
+
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestE2E builds the bridge and runs the e2e steps against it. It pairs and
+// talks to a real bridge, so it only runs with go test -tags e2e.
+func TestE2E(t *testing.T) {
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "sensor-bridge")
+	if output, err := exec.Command("go", "build", "-o", executable, ".").CombinedOutput(); err != nil {
+		t.Fatalf("Could not build the bridge: %v\n%s", err, output)
+	}
+
+	hapPort, err := freePort("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpPort, err := freePort("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeE2EConfig(filepath.Join(dir, configPath), hapPort, udpPort); err != nil {
+		t.Fatal(err)
+	}
+
+	results, ok := runE2E(executable, dir, hapPort, udpPort, 30*time.Second)
+	for _, result := range results {
+		if result.Status == doctorFail {
+			t.Errorf("%s: %s", result.Check, result.Detail)
+		} else {
+			t.Logf("%s: %s", result.Check, result.Detail)
+		}
+	}
+	if !ok {
+		if log, err := ioutil.ReadFile(filepath.Join(dir, "bridge.log")); err == nil {
+			t.Logf("bridge.log:\n%s", log)
+		}
+		t.FailNow()
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// EmailConfig sends notifications by mail. Security is starttls, which is the
+// default, tls for servers that expect TLS from the start, usually on port 465,
+// or none. Subject and Body are templates that get the Subject, Message and
+// Time of the notification.
+type EmailConfig struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Security string   `json:"security"`
+	Subject  string   `json:"subject"`
+	Body     string   `json:"body"`
+}
+
+const (
+	defaultEmailSubject = "[sensor-bridge] {{.Subject}}"
+	defaultEmailBody    = "{{.Message}}\n\nSent by sensor-bridge at {{.Time.Format \"2006-01-02 15:04:05 MST\"}}\n"
+)
+
+type emailNotifier struct {
+	config  EmailConfig
+	subject *template.Template
+	body    *template.Template
+}
+
+type emailContext struct {
+	Subject string
+	Message string
+	Time    time.Time
+}
+
+func newEmailNotifier(config EmailConfig) (*emailNotifier, error) {
+	if config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("email needs a from and a to address")
+	}
+	switch config.Security {
+	case "":
+		config.Security = "starttls"
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("unknown email security <%s>", config.Security)
+	}
+	if config.Port == 0 {
+		config.Port = 587
+		if config.Security == "tls" {
+			config.Port = 465
+		}
+	}
+	if config.Subject == "" {
+		config.Subject = defaultEmailSubject
+	}
+	if config.Body == "" {
+		config.Body = defaultEmailBody
+	}
+
+	subject, err := template.New("subject").Parse(config.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse email subject: %v", err)
+	}
+	body, err := template.New("body").Parse(config.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse email body: %v", err)
+	}
+
+	return &emailNotifier{config: config, subject: subject, body: body}, nil
+}
+
+func (n *emailNotifier) Notify(subject, message string) error {
+	context := emailContext{Subject: subject, Message: message, Time: clock.Now()}
+
+	var renderedSubject, renderedBody bytes.Buffer
+	if err := n.subject.Execute(&renderedSubject, context); err != nil {
+		return err
+	}
+	if err := n.body.Execute(&renderedBody, context); err != nil {
+		return err
+	}
+
+	var mail bytes.Buffer
+	fmt.Fprintf(&mail, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&mail, "To: %s\r\n", strings.Join(n.config.To, ", "))
+	fmt.Fprintf(&mail, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(renderedSubject.String())))
+	fmt.Fprintf(&mail, "Date: %s\r\n", context.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&mail, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&mail, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	mail.WriteString(strings.Replace(renderedBody.String(), "\n", "\r\n", -1))
+
+	return n.send(mail.Bytes())
+}
+
+func (n *emailNotifier) send(mail []byte) error {
+	address := net.JoinHostPort(n.config.Host, strconv.Itoa(n.config.Port))
+	tlsConfig := &tls.Config{ServerName: n.config.Host}
+
+	var conn net.Conn
+	var err error
+	if n.config.Security == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, 10*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	client, err := smtp.NewClient(conn, n.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if n.config.Security == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if n.config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.config.Username, n.config.Password, n.config.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(n.config.From); err != nil {
+		return err
+	}
+	for _, to := range n.config.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(mail); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/st3fan/sensor-bridge/pkg/emulator"
+)
+
+// emulateCommand emulates a fleet of sensors that report to a bridge at their
+// own pace, to see how a bridge copes with a fleet before buying it. Unlike
+// loadtest it does not wait for ACKs, the bridge tells how it did through its
+// API and metrics. It runs for the duration, or until interrupted.
+func emulateCommand(args []string) {
+	flags := flag.NewFlagSet("emulate", flag.ExitOnError)
+	target := flags.String("target", "127.0.0.1:3232", "address of the receiver")
+	sensors := flags.Int("sensors", 10, "number of sensors to emulate")
+	prefix := flags.String("prefix", "emulator", "prefix of the sensor IDs")
+	interval := flags.Duration("interval", time.Minute, "how often each sensor reports")
+	jitter := flags.Duration("jitter", 0, "how much a report may be early or late")
+	loss := flags.Float64("loss", 0, "fraction of reports that are lost")
+	skew := flags.Duration("skew", 0, "how far the clock of a sensor may be off")
+	key := flags.String("key", "", "hex HMAC key to sign the reports with")
+	duration := flags.Duration("duration", 0, "how long to run, forever when zero")
+	flags.Parse(args)
+
+	e, err := emulator.New(emulator.Config{
+		Target:    *target,
+		Sensors:   *sensors,
+		Prefix:    *prefix,
+		Interval:  *interval,
+		Jitter:    *jitter,
+		Loss:      *loss,
+		ClockSkew: *skew,
+		Key:       *key,
+	})
+	if err != nil {
+		log.Fatal("Could not configure the emulator: ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), *duration)
+	}
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	fmt.Printf("Emulating %d sensors that report every %s to %s\n", *sensors, *interval, *target)
+
+	start := time.Now()
+	if err := e.Run(ctx); err != nil {
+		log.Fatal("Could not run the emulator: ", err)
+	}
+
+	stats := e.Stats()
+	fmt.Printf("Sent %d reports in %s, lost %d on purpose, %d failed to send\n",
+		stats.Sent, time.Since(start).Round(time.Second), stats.Lost, stats.Failed)
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// Sensors that are short on memory or bandwidth may send CBOR or MessagePack
+// instead of JSON. Both are turned into JSON before decoding, so that every
+// encoding goes through the same parsing rules.
+
+var (
+	errTruncated   = errors.New("truncated payload")
+	errTooDeep     = errors.New("payload nested too deeply")
+	errTrailing    = errors.New("trailing bytes after payload")
+	errUnsupported = errors.New("unsupported value")
+	errNotFinite   = errors.New("number is NaN or infinite")
+)
+
+// maxDepth limits how deeply arrays and maps may be nested in binary payloads.
+const maxDepth = 32
+
+// detectEncoding tells the encodings apart by their first byte. A JSON packet
+// is an object, a CBOR packet a map (major type 5, possibly behind the
+// self-describe tag) and a MessagePack packet a fixmap, map16 or map32.
+func detectEncoding(payload []byte) string {
+	trimmed := bytes.TrimLeft(payload, " \t\r\n")
+	if len(trimmed) == 0 {
+		return "json"
+	}
+
+	switch b := trimmed[0]; {
+	case b == '{':
+		return "json"
+	case b >= 0xa0 && b <= 0xbb, b == 0xbf, b == 0xd9:
+		return "cbor"
+	case b >= 0x80 && b <= 0x8f, b == 0xde, b == 0xdf:
+		return "msgpack"
+	}
+	return "json"
+}
+
+// transcode turns a payload in the encoding of a receiver into JSON. It
+// returns which encoding was used, which is only interesting for "auto".
+func transcode(encoding string, payload []byte) ([]byte, string, error) {
+	if encoding == "auto" {
+		encoding = detectEncoding(payload)
+	}
+
+	var value interface{}
+	var err error
+
+	switch encoding {
+	case "", "json":
+		if jsonDepth(payload) > maxDepth {
+			return nil, "json", errTooDeep
+		}
+		return payload, "json", nil
+	case "cbor":
+		value, err = decodeBinary(payload, (*binaryReader).cbor)
+	case "msgpack":
+		value, err = decodeBinary(payload, (*binaryReader).msgpack)
+	default:
+		decoder, ok := decoders[encoding]
+		if !ok {
+			return nil, "", fmt.Errorf("unknown encoding <%s>", encoding)
+		}
+		document, err := decoder.Decode(payload)
+		if err == nil && jsonDepth(document) > maxDepth {
+			err = errTooDeep
+		}
+		if err != nil {
+			return nil, encoding, fmt.Errorf("%s: %v", encoding, err)
+		}
+		return document, encoding, nil
+	}
+	if err != nil {
+		return nil, encoding, fmt.Errorf("%s: %v", encoding, err)
+	}
+
+	document, err := json.Marshal(value)
+	if err != nil {
+		return nil, encoding, fmt.Errorf("%s: %v", encoding, err)
+	}
+	return document, encoding, nil
+}
+
+// jsonDepth returns how deeply the arrays and objects of a JSON document are
+// nested, without decoding it.
+func jsonDepth(document []byte) int {
+	depth, deepest := 0, 0
+	inString, escaped := false, false
+	for _, b := range document {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && b == '\\':
+			escaped = true
+		case b == '"':
+			inString = !inString
+		case inString:
+		case b == '{' || b == '[':
+			depth++
+			if depth > deepest {
+				deepest = depth
+			}
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return deepest
+}
+
+// finite rejects the NaN and infinities a binary payload can hold but JSON
+// cannot.
+func finite(f float64) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, errNotFinite
+	}
+	return f, nil
+}
+
+type binaryReader struct {
+	data []byte
+	pos  int
+}
+
+func decodeBinary(payload []byte, decode func(*binaryReader, int) (interface{}, error)) (interface{}, error) {
+	r := &binaryReader{data: payload}
+	value, err := decode(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if r.pos != len(r.data) {
+		return nil, errTrailing
+	}
+	return value, nil
+}
+
+func (r *binaryReader) next(n uint64) ([]byte, error) {
+	if n > uint64(len(r.data)-r.pos) {
+		return nil, errTruncated
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+func (r *binaryReader) byte() (byte, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (r *binaryReader) uint(size int) (uint64, error) {
+	b, err := r.next(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// count checks that a length read from the payload is not larger than what
+// is left of it, every element takes at least one byte.
+func (r *binaryReader) count(n uint64) (int, error) {
+	if n > uint64(len(r.data)-r.pos) {
+		return 0, errTruncated
+	}
+	return int(n), nil
+}
+
+func mapKey(key interface{}) (string, error) {
+	switch k := key.(type) {
+	case string:
+		return k, nil
+	case uint64:
+		return strconv.FormatUint(k, 10), nil
+	case int64:
+		return strconv.FormatInt(k, 10), nil
+	}
+	return "", errors.New("map keys must be strings or integers")
+}
+
+// cborBreak marks the end of an indefinite length item.
+var cborBreak = &struct{}{}
+
+func (r *binaryReader) cbor(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	initial, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	major, info := initial>>5, initial&0x1f
+
+	if initial == 0xff {
+		return cborBreak, nil
+	}
+
+	// Floats and simple values have their own meaning for the argument sizes
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			bits, err := r.uint(2)
+			if err != nil {
+				return nil, err
+			}
+			return finite(float16(uint16(bits)))
+		case 26:
+			bits, err := r.uint(4)
+			if err != nil {
+				return nil, err
+			}
+			return finite(float64(math.Float32frombits(uint32(bits))))
+		case 27:
+			bits, err := r.uint(8)
+			if err != nil {
+				return nil, err
+			}
+			return finite(math.Float64frombits(bits))
+		}
+		return nil, errUnsupported
+	}
+
+	indefinite := info == 31
+	var argument uint64
+	switch {
+	case info < 24:
+		argument = uint64(info)
+	case info <= 27:
+		if argument, err = r.uint(1 << (info - 24)); err != nil {
+			return nil, err
+		}
+	case indefinite && major >= 2 && major <= 5:
+	default:
+		return nil, errUnsupported
+	}
+
+	switch major {
+	case 0:
+		return argument, nil
+	case 1:
+		if argument > math.MaxInt64 {
+			return nil, errUnsupported
+		}
+		return -1 - int64(argument), nil
+	case 2, 3:
+		var b []byte
+		if indefinite {
+			for {
+				chunk, err := r.cbor(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				if chunk == cborBreak {
+					break
+				}
+				switch c := chunk.(type) {
+				case string:
+					b = append(b, c...)
+				case []byte:
+					b = append(b, c...)
+				default:
+					return nil, errUnsupported
+				}
+			}
+		} else if b, err = r.next(argument); err != nil {
+			return nil, err
+		}
+		if major == 2 {
+			return b, nil
+		}
+		return string(b), nil
+	case 4:
+		list := []interface{}{}
+		for i := uint64(0); indefinite || i < argument; i++ {
+			if !indefinite {
+				if _, err := r.count(argument - i); err != nil {
+					return nil, err
+				}
+			}
+			item, err := r.cbor(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if item == cborBreak {
+				if !indefinite {
+					return nil, errUnsupported
+				}
+				break
+			}
+			list = append(list, item)
+		}
+		return list, nil
+	case 5:
+		object := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < argument; i++ {
+			// Halve what is left rather than double the count, which could
+			// overflow
+			if !indefinite && argument-i > uint64(len(r.data)-r.pos)/2 {
+				return nil, errTruncated
+			}
+			key, err := r.cbor(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if key == cborBreak {
+				if !indefinite {
+					return nil, errUnsupported
+				}
+				break
+			}
+			name, err := mapKey(key)
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.cbor(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if value == cborBreak {
+				return nil, errUnsupported
+			}
+			object[name] = value
+		}
+		return object, nil
+	case 6:
+		// Tags only add meaning to the item that follows
+		return r.cbor(depth + 1)
+	}
+
+	return nil, errUnsupported
+}
+
+func float16(bits uint16) float64 {
+	sign := 1.0
+	if bits&0x8000 != 0 {
+		sign = -1
+	}
+	exponent := int(bits>>10) & 0x1f
+	fraction := float64(bits & 0x3ff)
+
+	switch exponent {
+	case 0:
+		return sign * math.Ldexp(fraction, -24)
+	case 31:
+		if fraction == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	}
+	return sign * math.Ldexp(fraction+1024, exponent-25)
+}
+
+func (r *binaryReader) msgpack(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	b, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return uint64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b >= 0x80 && b <= 0x8f:
+		return r.msgpackMap(uint64(b&0x0f), depth)
+	case b >= 0x90 && b <= 0x9f:
+		return r.msgpackArray(uint64(b&0x0f), depth)
+	case b >= 0xa0 && b <= 0xbf:
+		s, err := r.next(uint64(b & 0x1f))
+		return string(s), err
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return r.next(n)
+	case 0xca:
+		bits, err := r.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return finite(float64(math.Float32frombits(uint32(bits))))
+	case 0xcb:
+		bits, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return finite(math.Float64frombits(bits))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return r.uint(1 << (b - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		v, err := r.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign extend from the size of the value
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		s, err := r.next(n)
+		return string(s), err
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackMap(n, depth)
+	}
+
+	return nil, errUnsupported
+}
+
+func (r *binaryReader) msgpackArray(n uint64, depth int) (interface{}, error) {
+	count, err := r.count(n)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]interface{}, 0, count)
+	for i := 0; i < count; i++ {
+		item, err := r.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+func (r *binaryReader) msgpackMap(n uint64, depth int) (interface{}, error) {
+	// n is at most 32 bits, doubling it cannot overflow
+	count, err := r.count(2 * n)
+	if err != nil {
+		return nil, err
+	}
+	object := make(map[string]interface{}, count/2)
+	for i := 0; i < count/2; i++ {
+		key, err := r.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		name, err := mapKey(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		object[name] = value
+	}
+	return object, nil
+}
+
+var (
+	encodingsMutex sync.Mutex
+	encodingCounts = map[string]uint64{}
+)
+
+func countEncoding(encoding string) {
+	encodingsMutex.Lock()
+	defer encodingsMutex.Unlock()
+	encodingCounts[encoding]++
+}
+
+func encodingCountsSnapshot() map[string]uint64 {
+	encodingsMutex.Lock()
+	defer encodingsMutex.Unlock()
+
+	snapshot := map[string]uint64{}
+	for encoding, count := range encodingCounts {
+		snapshot[encoding] = count
+	}
+	return snapshot
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// FuzzTranscode feeds packets to the decoders the way the receiver does:
+// decompressed first, then turned into JSON. Whatever a sensor sends, the
+// result is either an error or JSON the parsers can take. The seeds in
+// testdata/fuzz/FuzzTranscode cover each encoding and the payloads the
+// decoders used to accept or choke on.
+func FuzzTranscode(f *testing.F) {
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		decompressed, err := decompress(payload, defaultMaxDecompressedSize)
+		if err != nil {
+			return
+		}
+		if len(decompressed) > defaultMaxDecompressedSize {
+			t.Fatalf("decompressed to %d bytes", len(decompressed))
+		}
+
+		for _, encoding := range []string{"auto", "json", "cbor", "msgpack"} {
+			document, _, err := transcode(encoding, decompressed)
+			if err != nil {
+				continue
+			}
+			if depth := jsonDepth(document); depth > maxDepth {
+				t.Fatalf("%s: nested %d deep", encoding, depth)
+			}
+			// JSON is passed on as it is, the parsers reject what is invalid
+			if encoding == "auto" {
+				encoding = detectEncoding(decompressed)
+			}
+			if encoding != "json" && !json.Valid(document) {
+				t.Fatalf("%s: invalid JSON %q", encoding, document)
+			}
+		}
+	})
+}
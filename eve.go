@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
+
+// Custom characteristics understood by the Eve app. These are not part of
+// HAP, so the Home app ignores them.
+const (
+	TypeEveAirPressure   = "E863F10F-079E-48FF-8F27-9C2605A29F52"
+	TypeEveWindSpeed     = "49C8AE5A-A3A5-41AB-BF1F-12D5654F9F41"
+	TypeEveWindDirection = "46F1284C-1912-421B-82F5-EB75008B167E"
+	TypeEveRain          = "10C88F40-7EC4-478C-8D5A-BD0C3CCE14B7"
+	TypeEveUVIndex       = "05BA0FE0-B848-4226-906D-5B64272E05CE"
+	TypeEveVoltage       = "E863F10A-079E-48FF-8F27-9C2605A29F52"
+	TypeEveCurrent       = "E863F126-079E-48FF-8F27-9C2605A29F52"
+	TypeEvePower         = "E863F10D-079E-48FF-8F27-9C2605A29F52"
+	TypeEveEnergy        = "E863F10C-079E-48FF-8F27-9C2605A29F52"
+
+	// Eve has no noise characteristic, this one is our own
+	TypeNoiseLevel = "6E0B1A52-3C2F-4F67-9B0D-5D2B8C7A1E40"
+)
+
+type customCharacteristic struct {
+	typ         string
+	description string
+	unit        string
+	min, max    float64
+	step        float64
+	value       func(MeasurementData) *float32
+}
+
+var customCharacteristics = map[string]customCharacteristic{
+	"air_pressure": {
+		typ: TypeEveAirPressure, description: "Air Pressure", min: 700, max: 1100, step: 1,
+		value: func(data MeasurementData) *float32 { return data.Pressure },
+	},
+	"wind_speed": {
+		typ: TypeEveWindSpeed, description: "Wind Speed", min: 0, max: 150, step: 0.1,
+		value: func(data MeasurementData) *float32 { return data.WindSpeed },
+	},
+	"wind_direction": {
+		typ: TypeEveWindDirection, description: "Wind Direction", unit: characteristic.UnitArcDegrees, min: 0, max: 360, step: 1,
+		value: func(data MeasurementData) *float32 { return data.WindDirection },
+	},
+	"rain": {
+		typ: TypeEveRain, description: "Rain", min: 0, max: 1000, step: 0.1,
+		value: func(data MeasurementData) *float32 { return data.Rain },
+	},
+	"uv_index": {
+		typ: TypeEveUVIndex, description: "UV Index", min: 0, max: 16, step: 0.1,
+		value: func(data MeasurementData) *float32 { return data.UVIndex },
+	},
+	"noise": {
+		typ: TypeNoiseLevel, description: "Noise Level", min: 0, max: 140, step: 0.1,
+		value: func(data MeasurementData) *float32 { return data.Noise },
+	},
+	"voltage": {
+		typ: TypeEveVoltage, description: "Voltage", min: 0, max: 500, step: 0.1,
+		value: func(data MeasurementData) *float32 { return data.Voltage },
+	},
+	"current": {
+		typ: TypeEveCurrent, description: "Electric Current", min: 0, max: 100, step: 0.01,
+		value: func(data MeasurementData) *float32 { return data.Current },
+	},
+	"watts": {
+		typ: TypeEvePower, description: "Consumption", min: 0, max: 100000, step: 0.1,
+		value: func(data MeasurementData) *float32 { return data.Watts },
+	},
+	"kwh": {
+		typ: TypeEveEnergy, description: "Total Consumption", min: 0, max: 1000000, step: 0.01,
+		value: func(data MeasurementData) *float32 { return data.KWh },
+	},
+}
+
+// addCustomCharacteristics adds the optional characteristics listed in the
+// sensor config to svc and keeps them updated from the sensor's reports.
+func addCustomCharacteristics(config SensorConfig, svc *service.Service) error {
+	for _, name := range config.Characteristics {
+		custom, ok := customCharacteristics[name]
+		if !ok {
+			return fmt.Errorf("unknown characteristic <%s>", name)
+		}
+
+		c := characteristic.NewFloat(custom.typ)
+		c.Format = characteristic.FormatFloat
+		c.Perms = characteristic.PermsRead()
+		c.Description = custom.description
+		c.Unit = custom.unit
+		c.SetMinValue(custom.min)
+		c.SetMaxValue(custom.max)
+		c.SetStepValue(custom.step)
+		c.SetValue(custom.min)
+
+		c.OnValueGet(func() interface{} {
+			if measurement, ok := store.Latest(config.Serial); ok {
+				if v := custom.value(measurement.MeasurementData); v != nil {
+					return config.homeKitValue(*v)
+				}
+			}
+			return c.Characteristic.Value
+		})
+
+		onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+			if v := custom.value(measurement.MeasurementData); v != nil {
+				c.UpdateValue(config.homeKitValue(*v))
+			}
+		})
+
+		svc.AddCharacteristic(c.Characteristic)
+	}
+
+	return nil
+}
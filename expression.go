@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Transforms are small assignments like "temperature = raw_adc * 0.0625 - 4"
+// that compute a metric from the other values of a measurement. Expressions
+// have numbers, the values of the measurement by name, the raw values the
+// sensor sent as raw_<name>, the operators + - * / and parentheses, and the
+// functions below.
+
+var functions = map[string]func(args []float64) (float64, error){
+	"abs":   unary(math.Abs),
+	"sqrt":  unary(math.Sqrt),
+	"round": unary(math.Round),
+	"floor": unary(math.Floor),
+	"ceil":  unary(math.Ceil),
+	"log":   unary(math.Log),
+	"exp":   unary(math.Exp),
+	"pow": func(args []float64) (float64, error) {
+		if len(args) != 2 {
+			return 0, fmt.Errorf("pow takes 2 arguments")
+		}
+		return math.Pow(args[0], args[1]), nil
+	},
+	"min": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, fmt.Errorf("min takes at least 1 argument")
+		}
+		min := args[0]
+		for _, arg := range args[1:] {
+			min = math.Min(min, arg)
+		}
+		return min, nil
+	},
+	"max": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, fmt.Errorf("max takes at least 1 argument")
+		}
+		max := args[0]
+		for _, arg := range args[1:] {
+			max = math.Max(max, arg)
+		}
+		return max, nil
+	},
+}
+
+func unary(fn func(float64) float64) func([]float64) (float64, error) {
+	return func(args []float64) (float64, error) {
+		if len(args) != 1 {
+			return 0, fmt.Errorf("takes 1 argument")
+		}
+		return fn(args[0]), nil
+	}
+}
+
+// errMissingValue means the measurement lacks a value the expression uses.
+var errMissingValue = errors.New("missing value")
+
+type expression interface {
+	eval(values map[string]float64) (float64, error)
+}
+
+type number float64
+
+func (n number) eval(values map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+type variable string
+
+func (v variable) eval(values map[string]float64) (float64, error) {
+	value, ok := values[string(v)]
+	if !ok {
+		return 0, errMissingValue
+	}
+	return value, nil
+}
+
+type operation struct {
+	op          byte
+	left, right expression
+}
+
+func (b operation) eval(values map[string]float64) (float64, error) {
+	left, err := b.left.eval(values)
+	if err != nil {
+		return 0, err
+	}
+	right, err := b.right.eval(values)
+	if err != nil {
+		return 0, err
+	}
+	switch b.op {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	}
+	return left / right, nil
+}
+
+type negation struct {
+	operand expression
+}
+
+func (n negation) eval(values map[string]float64) (float64, error) {
+	value, err := n.operand.eval(values)
+	return -value, err
+}
+
+type call struct {
+	name string
+	args []expression
+}
+
+func (c call) eval(values map[string]float64) (float64, error) {
+	args := make([]float64, len(c.args))
+	for i, arg := range c.args {
+		value, err := arg.eval(values)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = value
+	}
+	value, err := functions[c.name](args)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", c.name, err)
+	}
+	return value, nil
+}
+
+// parser is a recursive descent parser over the tokens of an expression.
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func tokenize(source string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("+-*/(),=", c):
+			tokens = append(tokens, string(c))
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(source) && (unicode.IsDigit(rune(source[j])) || source[j] == '.' || source[j] == 'e' ||
+				(j > i && source[j-1] == 'e' && (source[j] == '-' || source[j] == '+'))) {
+				j++
+			}
+			tokens = append(tokens, source[i:j])
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(source) && (unicode.IsLetter(rune(source[j])) || unicode.IsDigit(rune(source[j])) || source[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, source[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected <%c>", c)
+		}
+	}
+	return tokens, nil
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *parser) expect(token string) error {
+	if got := p.next(); got != token {
+		if got == "" {
+			return fmt.Errorf("expected <%s> at the end", token)
+		}
+		return fmt.Errorf("expected <%s>, got <%s>", token, got)
+	}
+	return nil
+}
+
+// sum = product { ("+" | "-") product }
+func (p *parser) sum() (expression, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.next()[0]
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		left = operation{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// product = factor { ("*" | "/") factor }
+func (p *parser) product() (expression, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "*" || p.peek() == "/" {
+		op := p.next()[0]
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = operation{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// factor = number | name | name "(" [ sum { "," sum } ] ")" | "-" factor | "(" sum ")"
+func (p *parser) factor() (expression, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end")
+	case token == "-":
+		operand, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return negation{operand}, nil
+	case token == "(":
+		inner, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number <%s>", token)
+		}
+		return number(value), nil
+	case unicode.IsLetter(rune(token[0])) || token[0] == '_':
+		if p.peek() != "(" {
+			if !isNumericMetric(token) && !strings.HasPrefix(token, "raw_") {
+				return nil, fmt.Errorf("unknown value <%s>", token)
+			}
+			return variable(token), nil
+		}
+		if _, ok := functions[token]; !ok {
+			return nil, fmt.Errorf("unknown function <%s>", token)
+		}
+		p.next()
+		c := call{name: token}
+		for p.peek() != ")" {
+			if len(c.args) != 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.sum()
+			if err != nil {
+				return nil, err
+			}
+			c.args = append(c.args, arg)
+		}
+		p.next()
+		return c, nil
+	}
+	return nil, fmt.Errorf("unexpected <%s>", token)
+}
+
+// Transform assigns the result of an expression to a metric.
+type Transform struct {
+	Metric     string
+	expression expression
+}
+
+func parseTransform(source string) (Transform, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return Transform{}, err
+	}
+	if len(tokens) < 3 || tokens[1] != "=" {
+		return Transform{}, fmt.Errorf("expected <metric = expression>")
+	}
+	if !isNumericMetric(tokens[0]) {
+		return Transform{}, fmt.Errorf("unknown metric <%s>", tokens[0])
+	}
+
+	p := &parser{tokens: tokens, pos: 2}
+	e, err := p.sum()
+	if err != nil {
+		return Transform{}, err
+	}
+	if p.pos != len(tokens) {
+		return Transform{}, fmt.Errorf("unexpected <%s>", p.peek())
+	}
+	return Transform{Metric: tokens[0], expression: e}, nil
+}
+
+// Apply sets the metric of data to the value of the expression. It leaves
+// data as it is when a value the expression needs is missing.
+func (t Transform) Apply(data *MeasurementData) error {
+	values := map[string]float64{}
+	for name, value := range metricValues(*data) {
+		if number, ok := numericValue(value); ok {
+			values[name] = number
+		}
+	}
+	for name, value := range data.Raw {
+		values["raw_"+name] = value
+	}
+
+	result, err := t.expression.eval(values)
+	if err == errMissingValue {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return fmt.Errorf("%s is <%g>", t.Metric, result)
+	}
+
+	v := reflect.ValueOf(data).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0] != t.Metric {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Type().Elem().Kind() {
+		case reflect.Float32:
+			value := float32(result)
+			field.Set(reflect.ValueOf(&value))
+		case reflect.Int:
+			value := int(math.Round(result))
+			field.Set(reflect.ValueOf(&value))
+		case reflect.Int64:
+			value := int64(math.Round(result))
+			field.Set(reflect.ValueOf(&value))
+		}
+	}
+	if isDeclaredMetric(t.Metric) {
+		metrics := map[string]float64{t.Metric: result}
+		for name, value := range data.Metrics {
+			if name != t.Metric {
+				metrics[name] = value
+			}
+		}
+		data.Metrics = metrics
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
+
+// Percent of filter life left at which HomeKit asks for a new filter
+const defaultFilterThreshold = 10
+
+func (c SensorConfig) filterThreshold() float32 {
+	if c.FilterThreshold != 0 {
+		return c.FilterThreshold
+	}
+	return defaultFilterThreshold
+}
+
+// addFilterServices adds the fan of a sensor box and the maintenance of its
+// filter, so that HomeKit reminds to change it. The fan only reports its
+// state, the bridge does not switch it.
+func addFilterServices(config SensorConfig, ac *accessory.Accessory) {
+	if !config.Filter {
+		return
+	}
+
+	fan := service.NewFan()
+	addServiceName(config, fan.Service, "Fan")
+	fan.On.Perms = characteristic.PermsRead()
+
+	maintenance := service.NewFilterMaintenance()
+	addServiceName(config, maintenance.Service, "Filter")
+
+	life := characteristic.NewFilterLifeLevel()
+	maintenance.AddCharacteristic(life.Characteristic)
+
+	onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+		data := measurement.MeasurementData
+		if data.FanOn != nil {
+			fan.On.UpdateValue(*data.FanOn)
+		}
+		if data.FilterLife != nil {
+			life.UpdateValue(config.homeKitValue(*data.FilterLife))
+			if *data.FilterLife < config.filterThreshold() {
+				maintenance.FilterChangeIndication.UpdateValue(characteristic.FilterChangeIndicationChangeFilter)
+			} else {
+				maintenance.FilterChangeIndication.UpdateValue(characteristic.FilterChangeIndicationFilterOK)
+			}
+		}
+	})
+
+	ac.AddService(fan.Service)
+	ac.AddService(maintenance.Service)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FirmwareConfig struct {
+	Directory string `json:"directory"`
+	BaseURL   string `json:"base_url"`
+}
+
+// FirmwareOffer is included in ACKs to sensors that are not running the firmware
+// we want them to run.
+type FirmwareOffer struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+}
+
+type firmwareImage struct {
+	version  string
+	filename string
+}
+
+// Firmware keeps track of the images in the firmware directory. Images are
+// named <image>-<version>.bin, for example sensor-1.4.2.bin.
+type Firmware struct {
+	mutex   sync.Mutex
+	config  FirmwareConfig
+	images  map[string][]firmwareImage
+	scanned time.Time
+}
+
+var firmware = &Firmware{}
+
+func (f *Firmware) Configure(config FirmwareConfig) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.config = config
+	f.scanned = time.Time{}
+}
+
+func (f *Firmware) scan() {
+	if clock.Since(f.scanned) < 30*time.Second {
+		return
+	}
+	f.scanned = clock.Now()
+	f.images = map[string][]firmwareImage{}
+
+	files, err := ioutil.ReadDir(f.config.Directory)
+	if err != nil {
+		log.Println("Could not read firmware directory: ", err)
+		return
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".bin") {
+			continue
+		}
+		i := strings.LastIndexByte(name, '-')
+		if i == -1 {
+			continue
+		}
+		image, version := name[:i], strings.TrimSuffix(name[i+1:], ".bin")
+		f.images[image] = append(f.images[image], firmwareImage{version: version, filename: name})
+	}
+}
+
+// Offer returns the firmware a sensor should update to, if any. Sensors are
+// offered the latest version of their image unless they are pinned to a
+// specific version.
+func (f *Firmware) Offer(sensor SensorConfig, currentVersion string) (*FirmwareOffer, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.config.Directory == "" || currentVersion == "" {
+		return nil, false
+	}
+
+	f.scan()
+
+	imageName := sensor.FirmwareImage
+	if imageName == "" {
+		imageName = "sensor"
+	}
+
+	var target *firmwareImage
+	for i, image := range f.images[imageName] {
+		if sensor.FirmwarePin != "" {
+			if image.version == sensor.FirmwarePin {
+				target = &f.images[imageName][i]
+			}
+			continue
+		}
+		if target == nil || compareVersions(image.version, target.version) > 0 {
+			target = &f.images[imageName][i]
+		}
+	}
+
+	if target == nil || target.version == currentVersion {
+		return nil, false
+	}
+
+	return &FirmwareOffer{Version: target.version, URL: f.config.BaseURL + target.filename}, true
+}
+
+// compareVersions compares dotted version numbers like 1.10.2 numerically.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func handleFirmware(config FirmwareConfig) http.Handler {
+	return http.StripPrefix("/firmware/", http.FileServer(http.Dir(config.Directory)))
+}
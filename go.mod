@@ -2,4 +2,7 @@ module github.com/st3fan/sensor-bridge
 
 go 1.13
 
-require github.com/brutella/hc v1.2.2
+require (
+	github.com/brutella/dnssd v1.1.1
+	github.com/brutella/hc v1.2.2
+)
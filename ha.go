@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HAConfig pairs two bridges. The primary is the leader whenever it runs.
+// The standby copies the measurements and the HomeKit storage of the leader
+// and takes over when it misses FailAfter syncs in a row, or the peer does
+// not lead for as long. Only the leader publishes the HomeKit bridge and
+// sends notifications. Peer is the API URL of the other bridge, Token an
+// admin token for its API.
+type HAConfig struct {
+	Role               string `json:"role,omitempty"`
+	Peer               string `json:"peer,omitempty"`
+	Token              string `json:"token,omitempty"`
+	Interval           int    `json:"interval,omitempty"`
+	FailAfter          int    `json:"fail_after,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+const (
+	defaultHAInterval  = 10 * time.Second
+	defaultHAFailAfter = 3
+
+	// maxReplicatedFile keeps logs that happen to live in storage out
+	maxReplicatedFile = 1024 * 1024
+)
+
+// Replica is what the standby copies from the leader.
+type Replica struct {
+	Leader  bool              `json:"leader"`
+	Sensors []SensorState     `json:"sensors"`
+	Files   map[string][]byte `json:"files,omitempty"`
+}
+
+type HA struct {
+	mutex   sync.Mutex
+	config  HAConfig
+	leader  bool
+	changed chan struct{}
+
+	// replicated keeps the last measurement copied for each sensor
+	replicated map[string]string
+}
+
+var ha = &HA{leader: true, changed: make(chan struct{}), replicated: map[string]string{}}
+
+func (h *HA) Leader() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.leader
+}
+
+func (h *HA) setLeader(leader bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.leader != leader {
+		h.leader = leader
+		close(h.changed)
+		h.changed = make(chan struct{})
+	}
+}
+
+// until returns a channel that is closed once the bridge is or is no longer
+// the leader.
+func (h *HA) until(leader bool) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for {
+			h.mutex.Lock()
+			current, changed := h.leader, h.changed
+			h.mutex.Unlock()
+			if current == leader {
+				close(done)
+				return
+			}
+			<-changed
+		}
+	}()
+	return done
+}
+
+// configureHA copies the state of the peer before anything reads the storage.
+// The primary does this once, after the standby may have run on its own.
+func configureHA(config HAConfig) error {
+	if config.Role == "" {
+		return nil
+	}
+	if config.Role != "primary" && config.Role != "standby" {
+		return fmt.Errorf("unknown role <%s>", config.Role)
+	}
+	if config.Peer == "" {
+		return fmt.Errorf("no peer")
+	}
+
+	ha.mutex.Lock()
+	ha.config = config
+	ha.mutex.Unlock()
+
+	replica, err := ha.fetch()
+	if err != nil {
+		log.Printf("[!] Could not sync with peer <%s>: %v", config.Peer, err)
+	} else if replica.Leader {
+		if err := writeReplicatedFiles(replica.Files); err != nil {
+			return err
+		}
+		log.Printf("[*] Copied storage of peer <%s>", config.Peer)
+	}
+
+	if config.Role == "standby" {
+		ha.setLeader(false)
+		log.Printf("[*] Running as standby of <%s>", config.Peer)
+	}
+	return nil
+}
+
+// applyReplicatedSensors stores the measurements of the leader that are new.
+func applyReplicatedSensors(replica Replica) {
+	for _, state := range replica.Sensors {
+		if state.Measurement == nil || state.Virtual {
+			continue
+		}
+		encoded, err := json.Marshal(state.Measurement)
+		if err != nil {
+			continue
+		}
+		ha.mutex.Lock()
+		seen := ha.replicated[state.SensorID] == string(encoded)
+		ha.replicated[state.SensorID] = string(encoded)
+		ha.mutex.Unlock()
+		if !seen {
+			store.Update(*state.Measurement, nil)
+		}
+	}
+}
+
+func (h *HA) client() *http.Client {
+	client := &http.Client{Timeout: 5 * time.Second}
+	if h.config.InsecureSkipVerify {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	return client
+}
+
+func (h *HA) fetch() (Replica, error) {
+	request, err := http.NewRequest(http.MethodGet, strings.TrimRight(h.config.Peer, "/")+"/api/v1/replica", nil)
+	if err != nil {
+		return Replica{}, err
+	}
+	if h.config.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+h.config.Token)
+	}
+
+	response, err := h.client().Do(request)
+	if err != nil {
+		return Replica{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return Replica{}, fmt.Errorf("peer returned %s", response.Status)
+	}
+
+	var replica Replica
+	err = json.NewDecoder(response.Body).Decode(&replica)
+	return replica, err
+}
+
+// watchPeer keeps a standby in sync with the leader and decides which of the
+// two leads. The primary leads whenever it runs and never yields, so only a
+// standby steps down. A standby takes over when the peer is down or does not
+// lead for FailAfter syncs in a row, so that HomeKit is never left without a
+// leader.
+func watchPeer() {
+	if ha.config.Role != "standby" {
+		return
+	}
+
+	interval, failAfter := defaultHAInterval, defaultHAFailAfter
+	if ha.config.Interval > 0 {
+		interval = time.Duration(ha.config.Interval) * time.Second
+	}
+	if ha.config.FailAfter > 0 {
+		failAfter = ha.config.FailAfter
+	}
+
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for range ticker.Chan() {
+		replica, err := ha.fetch()
+		if err != nil || !replica.Leader {
+			if missed++; missed == failAfter && !ha.Leader() {
+				if err != nil {
+					log.Printf("[!] Peer <%s> is down, taking over: %v", ha.config.Peer, err)
+				} else {
+					log.Printf("[!] Peer <%s> does not lead, taking over", ha.config.Peer)
+				}
+				ha.setLeader(true)
+			}
+			continue
+		}
+		missed = 0
+
+		if ha.Leader() {
+			log.Printf("[*] Peer <%s> is back, stepping down", ha.config.Peer)
+			ha.setLeader(false)
+			// The HomeKit transport may still be using the storage
+			continue
+		}
+
+		applyReplicatedSensors(replica)
+		if err := writeReplicatedFiles(replica.Files); err != nil {
+			log.Println("[!] Could not copy storage of peer: ", err)
+			continue
+		}
+		health.StandbyInSync()
+	}
+}
+
+// replicated tells which files in the storage directory belong to the bridge
+// as a whole rather than to this host.
+func replicated(info os.FileInfo) bool {
+	name := info.Name()
+	return info.Mode().IsRegular() && info.Size() <= maxReplicatedFile &&
+		!strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "snapshot-") &&
+		name != "api-cert.pem" && name != "api-key.pem"
+}
+
+func readReplicatedFiles() (map[string][]byte, error) {
+	infos, err := ioutil.ReadDir(storagePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	files := map[string][]byte{}
+	for _, info := range infos {
+		if !replicated(info) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(storagePath, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[info.Name()] = data
+	}
+	return files, nil
+}
+
+// writeReplicatedFiles makes the storage the same as that of the peer, which
+// includes forgetting HomeKit pairings that were removed there.
+func writeReplicatedFiles(files map[string][]byte) error {
+	current, err := readReplicatedFiles()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(storagePath, 0755); err != nil {
+		return err
+	}
+
+	for name, data := range files {
+		if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			return fmt.Errorf("peer sent bad file name <%s>", name)
+		}
+		if existing, ok := current[name]; ok && bytes.Equal(existing, data) {
+			continue
+		}
+		tmp := filepath.Join(storagePath, "."+name+".tmp")
+		if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, filepath.Join(storagePath, name)); err != nil {
+			return err
+		}
+	}
+	for name := range current {
+		if _, ok := files[name]; !ok {
+			if err := os.Remove(filepath.Join(storagePath, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handleReplica handles GET /api/v1/replica
+func handleReplica(w http.ResponseWriter, r *http.Request) {
+	replica := Replica{Leader: ha.Leader(), Sensors: store.Snapshot()}
+	if replica.Leader {
+		files, err := readReplicatedFiles()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		replica.Files = files
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(replica); err != nil {
+		log.Println("Failed to encode replica: ", err)
+	}
+}
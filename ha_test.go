@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakePeer serves a replica that leads or not, or fails when status is not
+// 200, and tells of every request.
+func fakePeer(t *testing.T, status int, leader bool) (*httptest.Server, <-chan struct{}) {
+	requests := make(chan struct{}, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+		} else {
+			json.NewEncoder(w).Encode(Replica{Leader: leader})
+		}
+		requests <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+// useHA configures the bridge as role of peer for the duration of a test.
+func useHA(t *testing.T, role, peer string, leader bool) {
+	ha.mutex.Lock()
+	previous := ha.config
+	ha.config = HAConfig{Role: role, Peer: peer, Interval: 1, FailAfter: 3}
+	ha.mutex.Unlock()
+	ha.setLeader(leader)
+	t.Cleanup(func() {
+		ha.mutex.Lock()
+		ha.config = previous
+		ha.mutex.Unlock()
+		ha.setLeader(true)
+	})
+}
+
+// startWatchPeer runs watchPeer once its ticker is waiting on the clock.
+func startWatchPeer(c *manualClock) {
+	go watchPeer()
+	for {
+		c.mutex.Lock()
+		waiting := len(c.waiters)
+		c.mutex.Unlock()
+		if waiting > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// nextSync advances the clock to the next sync and waits for its request.
+func nextSync(c *manualClock, requests <-chan struct{}) {
+	c.Advance(time.Second)
+	<-requests
+}
+
+func waitLeader(t *testing.T, leader bool) {
+	t.Helper()
+	select {
+	case <-ha.until(leader):
+	case <-time.After(5 * time.Second):
+		t.Fatalf("leader is %v, want %v", ha.Leader(), leader)
+	}
+}
+
+func TestStandbyTakesOverFromNonLeadingPeer(t *testing.T) {
+	c := useManualClock(t)
+	server, requests := fakePeer(t, http.StatusOK, false)
+	useHA(t, "standby", server.URL, false)
+	startWatchPeer(c)
+
+	nextSync(c, requests)
+	nextSync(c, requests)
+	if ha.Leader() {
+		t.Fatal("took over before missing fail_after syncs")
+	}
+
+	nextSync(c, requests)
+	waitLeader(t, true)
+}
+
+func TestStandbyTakesOverFromDownPeer(t *testing.T) {
+	c := useManualClock(t)
+	server, requests := fakePeer(t, http.StatusServiceUnavailable, false)
+	useHA(t, "standby", server.URL, false)
+	startWatchPeer(c)
+
+	nextSync(c, requests)
+	nextSync(c, requests)
+	nextSync(c, requests)
+	waitLeader(t, true)
+}
+
+func TestStandbyStepsDownForLeadingPeer(t *testing.T) {
+	c := useManualClock(t)
+	server, requests := fakePeer(t, http.StatusOK, true)
+	useHA(t, "standby", server.URL, true)
+	startWatchPeer(c)
+
+	nextSync(c, requests)
+	waitLeader(t, false)
+}
+
+func TestPrimaryNeverYields(t *testing.T) {
+	server, _ := fakePeer(t, http.StatusOK, true)
+	useHA(t, "primary", server.URL, true)
+
+	// The primary does not watch its peer at all
+	watchPeer()
+	if !ha.Leader() {
+		t.Fatal("primary stepped down")
+	}
+}
+
+func TestStandbyInSyncIsReady(t *testing.T) {
+	inTempDir(t)
+	previous := health
+	health = &Health{receiverLoops: map[string]time.Time{}}
+	t.Cleanup(func() { health = previous })
+
+	c := useManualClock(t)
+	server, requests := fakePeer(t, http.StatusOK, true)
+	useHA(t, "standby", server.URL, false)
+	health.ReceiverBound("")
+	if health.Ready() {
+		t.Fatal("standby is ready before its first sync")
+	}
+
+	startWatchPeer(c)
+	nextSync(c, requests)
+	for deadline := time.Now().Add(5 * time.Second); !health.Ready(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("standby is not ready after a sync")
+		}
+	}
+}
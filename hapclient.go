@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/brutella/hc/crypto"
+	"github.com/brutella/hc/crypto/chacha20poly1305"
+	"github.com/brutella/hc/crypto/hkdf"
+	"github.com/brutella/hc/hap/pair"
+	"github.com/brutella/hc/util"
+)
+
+// hapClient is a minimal HomeKit controller, enough to pair with the bridge
+// and read its accessories the way the Home app does. Once verified, all
+// traffic on the connection is encrypted.
+type hapClient struct {
+	address string
+	conn    net.Conn
+	raw     *bufio.Reader
+	http    *bufio.Reader
+
+	name       string
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+
+	accessoryName string
+	accessoryKey  []byte
+
+	session   crypto.Cryptographer
+	decrypted bytes.Buffer
+}
+
+func dialHAP(address string, timeout time.Duration) (*hapClient, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &hapClient{
+		address:    address,
+		conn:       conn,
+		raw:        bufio.NewReader(conn),
+		name:       "sensor-bridge-e2e",
+		publicKey:  publicKey,
+		privateKey: privateKey,
+	}
+	c.http = bufio.NewReader(c)
+	return c, nil
+}
+
+func (c *hapClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *hapClient) Read(p []byte) (int, error) {
+	if c.session == nil {
+		return c.raw.Read(p)
+	}
+	if c.decrypted.Len() == 0 {
+		r, err := c.session.Decrypt(c.raw)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.Copy(&c.decrypted, r); err != nil {
+			return 0, err
+		}
+	}
+	return c.decrypted.Read(p)
+}
+
+func (c *hapClient) Write(p []byte) (int, error) {
+	if c.session == nil {
+		return c.conn.Write(p)
+	}
+	r, err := c.session.Encrypt(bytes.NewReader(p))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(c.conn, r); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *hapClient) do(method, path, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, "http://"+c.address+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(c.http, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return b, nil
+}
+
+func (c *hapClient) post(path string, in util.Container) (util.Container, error) {
+	b, err := c.do("POST", path, "application/pairing+tlv8", in.BytesBuffer().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	out, err := util.NewTLV8ContainerFromReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if code := out.GetByte(pair.TagErrCode); code != 0 {
+		return nil, fmt.Errorf("%s: error code %d", path, code)
+	}
+	return out, nil
+}
+
+// seal encrypts a TLV8 container for the encrypted data tag of a pairing
+// step.
+func seal(key [32]byte, nonce string, in util.Container) []byte {
+	encrypted, mac, _ := chacha20poly1305.EncryptAndSeal(key[:], []byte(nonce), in.BytesBuffer().Bytes(), nil)
+	return append(encrypted, mac[:]...)
+}
+
+func unseal(key [32]byte, nonce string, data []byte) (util.Container, error) {
+	if len(data) < 16 {
+		return nil, errors.New("encrypted data too short")
+	}
+	var mac [16]byte
+	copy(mac[:], data[len(data)-16:])
+	decrypted, err := chacha20poly1305.DecryptAndVerify(key[:], []byte(nonce), data[:len(data)-16], mac, nil)
+	if err != nil {
+		return nil, err
+	}
+	return util.NewTLV8ContainerFromReader(bytes.NewReader(decrypted))
+}
+
+// pairSetup pairs with the bridge using its setup code and keeps the long
+// term public key of the bridge for pairVerify.
+func (c *hapClient) pairSetup(pin string) error {
+	session := pair.NewSetupClientSession("Pair-Setup", pin)
+
+	start := util.NewTLV8Container()
+	start.SetByte(pair.TagPairingMethod, 0)
+	start.SetByte(pair.TagSequence, pair.PairStepStartRequest.Byte())
+	in, err := c.post("/pair-setup", start)
+	if err != nil {
+		return err
+	}
+	if err := session.GenerateKeys(in.GetBytes(pair.TagSalt), in.GetBytes(pair.TagPublicKey)); err != nil {
+		return err
+	}
+
+	verify := util.NewTLV8Container()
+	verify.SetByte(pair.TagPairingMethod, 0)
+	verify.SetByte(pair.TagSequence, pair.PairStepVerifyRequest.Byte())
+	verify.SetBytes(pair.TagPublicKey, session.PublicKey)
+	verify.SetBytes(pair.TagProof, session.Proof)
+	if in, err = c.post("/pair-setup", verify); err != nil {
+		return err
+	}
+	if !session.IsServerProofValid(in.GetBytes(pair.TagProof)) {
+		return errors.New("the bridge sent an invalid proof, is the pin right?")
+	}
+	if err := session.SetupEncryptionKey([]byte("Pair-Setup-Encrypt-Salt"), []byte("Pair-Setup-Encrypt-Info")); err != nil {
+		return err
+	}
+
+	hash, err := hkdf.Sha512(session.PrivateKey, []byte("Pair-Setup-Controller-Sign-Salt"), []byte("Pair-Setup-Controller-Sign-Info"))
+	if err != nil {
+		return err
+	}
+	material := append(append(hash[:], c.name...), c.publicKey...)
+
+	identity := util.NewTLV8Container()
+	identity.SetString(pair.TagUsername, c.name)
+	identity.SetBytes(pair.TagPublicKey, c.publicKey)
+	identity.SetBytes(pair.TagSignature, ed25519.Sign(c.privateKey, material))
+
+	exchange := util.NewTLV8Container()
+	exchange.SetByte(pair.TagPairingMethod, 0)
+	exchange.SetByte(pair.TagSequence, pair.PairStepKeyExchangeRequest.Byte())
+	exchange.SetBytes(pair.TagEncryptedData, seal(session.EncryptionKey, "PS-Msg05", identity))
+	if in, err = c.post("/pair-setup", exchange); err != nil {
+		return err
+	}
+
+	accessory, err := unseal(session.EncryptionKey, "PS-Msg06", in.GetBytes(pair.TagEncryptedData))
+	if err != nil {
+		return err
+	}
+	name := accessory.GetString(pair.TagUsername)
+	key := accessory.GetBytes(pair.TagPublicKey)
+
+	hash, err = hkdf.Sha512(session.PrivateKey, []byte("Pair-Setup-Accessory-Sign-Salt"), []byte("Pair-Setup-Accessory-Sign-Info"))
+	if err != nil {
+		return err
+	}
+	material = append(append(hash[:], name...), key...)
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, material, accessory.GetBytes(pair.TagSignature)) {
+		return errors.New("the bridge sent an invalid signature")
+	}
+
+	c.accessoryName = name
+	c.accessoryKey = key
+	return nil
+}
+
+// pairVerify proves both sides know each other from pairSetup and switches
+// the connection to encryption.
+func (c *hapClient) pairVerify() error {
+	session := pair.NewVerifySession()
+
+	start := util.NewTLV8Container()
+	start.SetByte(pair.TagSequence, pair.VerifyStepStartRequest.Byte())
+	start.SetBytes(pair.TagPublicKey, session.PublicKey[:])
+	in, err := c.post("/pair-verify", start)
+	if err != nil {
+		return err
+	}
+
+	var otherPublicKey [32]byte
+	if copy(otherPublicKey[:], in.GetBytes(pair.TagPublicKey)) != len(otherPublicKey) {
+		return errors.New("the bridge sent an invalid public key")
+	}
+	session.GenerateSharedKeyWithOtherPublicKey(otherPublicKey)
+	if err := session.SetupEncryptionKey([]byte("Pair-Verify-Encrypt-Salt"), []byte("Pair-Verify-Encrypt-Info")); err != nil {
+		return err
+	}
+
+	accessory, err := unseal(session.EncryptionKey, "PV-Msg02", in.GetBytes(pair.TagEncryptedData))
+	if err != nil {
+		return err
+	}
+	name := accessory.GetString(pair.TagUsername)
+	material := append(append(otherPublicKey[:], name...), session.PublicKey[:]...)
+	if name != c.accessoryName || !ed25519.Verify(c.accessoryKey, material, accessory.GetBytes(pair.TagSignature)) {
+		return fmt.Errorf("bridge <%s> is not the one we paired with", name)
+	}
+
+	material = append(append(session.PublicKey[:], c.name...), otherPublicKey[:]...)
+	identity := util.NewTLV8Container()
+	identity.SetString(pair.TagUsername, c.name)
+	identity.SetBytes(pair.TagSignature, ed25519.Sign(c.privateKey, material))
+
+	finish := util.NewTLV8Container()
+	finish.SetByte(pair.TagSequence, pair.VerifyStepFinishRequest.Byte())
+	finish.SetBytes(pair.TagEncryptedData, seal(session.EncryptionKey, "PV-Msg03", identity))
+	if _, err := c.post("/pair-verify", finish); err != nil {
+		return err
+	}
+
+	c.session, err = crypto.NewSecureClientSessionFromSharedKey(session.SharedKey)
+	return err
+}
+
+// hapAccessory is an accessory as the bridge lists it.
+type hapAccessory struct {
+	AID      uint64 `json:"aid"`
+	Services []struct {
+		Type            string `json:"type"`
+		Characteristics []struct {
+			IID   uint64      `json:"iid"`
+			Type  string      `json:"type"`
+			Value interface{} `json:"value"`
+		} `json:"characteristics"`
+	} `json:"services"`
+}
+
+// characteristic returns the instance ID and value of the first
+// characteristic of a type. The value is the last one the bridge pushed,
+// readCharacteristic asks for the current one.
+func (a hapAccessory) characteristic(typ string) (uint64, interface{}, bool) {
+	for _, service := range a.Services {
+		for _, characteristic := range service.Characteristics {
+			if characteristic.Type == typ {
+				return characteristic.IID, characteristic.Value, true
+			}
+		}
+	}
+	return 0, nil, false
+}
+
+func (c *hapClient) accessories() ([]hapAccessory, error) {
+	b, err := c.do("GET", "/accessories", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Accessories []hapAccessory `json:"accessories"`
+	}
+	if err := json.Unmarshal(b, &response); err != nil {
+		return nil, err
+	}
+	return response.Accessories, nil
+}
+
+// readCharacteristic reads a characteristic like the Home app does when it
+// shows an accessory.
+func (c *hapClient) readCharacteristic(aid, iid uint64) (interface{}, error) {
+	b, err := c.do("GET", fmt.Sprintf("/characteristics?id=%d.%d", aid, iid), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Characteristics []struct {
+			AID   uint64      `json:"aid"`
+			IID   uint64      `json:"iid"`
+			Value interface{} `json:"value"`
+		} `json:"characteristics"`
+	}
+	if err := json.Unmarshal(b, &response); err != nil {
+		return nil, err
+	}
+	for _, characteristic := range response.Characteristics {
+		if characteristic.AID == aid && characteristic.IID == iid {
+			return characteristic.Value, nil
+		}
+	}
+	return nil, fmt.Errorf("no characteristic %d.%d", aid, iid)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// receiverHeartbeat is how often the receive loop wakes up when no packets
+// arrive, so that a hung loop can be told apart from a quiet network.
+const receiverHeartbeat = 5 * time.Second
+
+type Health struct {
+	mutex            sync.Mutex
+	receiverBound    bool
+	receiverLoops    map[string]time.Time
+	transportStarted bool
+	transportOff     bool
+	standbyInSync    bool
+}
+
+var health = &Health{receiverLoops: map[string]time.Time{}}
+
+// ReceiverBound marks a receiver as listening. Receivers that have a receive
+// loop pass their tag so the loop is watched; others pass an empty tag.
+func (h *Health) ReceiverBound(tag string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.receiverBound = true
+	if tag != "" {
+		h.receiverLoops[tag] = clock.Now()
+	}
+}
+
+func (h *Health) ReceiverAlive(tag string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.receiverLoops[tag] = clock.Now()
+}
+
+func (h *Health) TransportStarted() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.transportStarted = true
+}
+
+func (h *Health) TransportStopped() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.transportStarted = false
+}
+
+// TransportDisabled marks the HomeKit transport as intentionally not running,
+// so that it does not count against readiness.
+func (h *Health) TransportDisabled() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.transportOff = true
+}
+
+// StandbyInSync marks a standby as having copied the state of its peer, which
+// is all it has to do while the peer leads.
+func (h *Health) StandbyInSync() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.standbyInSync = true
+}
+
+// Ready returns true once the receivers are bound and the HomeKit transport
+// started, is disabled, or is left to the peer by a standby in sync.
+func (h *Health) Ready() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.receiverBound && (h.transportStarted || h.transportOff || h.standbyInSync)
+}
+
+// ReceiverHealthy returns false if any receive loop has not come around for
+// a couple of heartbeats.
+func (h *Health) ReceiverHealthy() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.receiverBound {
+		return false
+	}
+	for _, last := range h.receiverLoops {
+		if clock.Since(last) >= 3*receiverHeartbeat {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Health) checks(storagePath string) map[string]bool {
+	h.mutex.Lock()
+	checks := map[string]bool{
+		"receiver_bound": h.receiverBound,
+	}
+	if !h.transportOff {
+		checks["transport_started"] = h.transportStarted
+	}
+	h.mutex.Unlock()
+
+	checks["receiver_loop"] = h.ReceiverHealthy()
+	checks["storage_writable"] = storageWritable(storagePath)
+
+	return checks
+}
+
+func storageWritable(path string) bool {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return false
+	}
+	file, err := ioutil.TempFile(path, ".healthcheck")
+	if err != nil {
+		return false
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return true
+}
+
+func writeChecks(w http.ResponseWriter, checks map[string]bool) {
+	status := http.StatusOK
+	for _, ok := range checks {
+		if !ok {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(checks); err != nil {
+		log.Println("Failed to encode health checks: ", err)
+	}
+}
+
+// handleHealthz reports whether the bridge is alive. It only fails when the
+// receive loop is wedged, which a restart should fix.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeChecks(w, map[string]bool{"receiver_loop": health.ReceiverHealthy()})
+}
+
+// handleReadyz reports whether the bridge is fully up and able to do its job.
+func handleReadyz(storagePath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeChecks(w, health.checks(storagePath))
+	}
+}
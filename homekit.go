@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/brutella/hc"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+)
+
+func runHomeKit(config Config, bridge *accessory.Bridge, sensors []*accessory.Accessory) {
+	hcConfig := hc.Config{
+		Pin:         config.Bridge.Pin,
+		StoragePath: storagePath,
+		IP:          config.Bridge.Address,
+		Port:        config.Bridge.Port,
+	}
+
+	// hc picks a random port that it keeps to itself when none is configured,
+	// so the bridge picks one to be able to check that the transport listens
+	if hcConfig.Port == "" {
+		if port, err := freePort("tcp"); err != nil {
+			log.Println("[!] Could not pick a port for HomeKit: ", err)
+		} else {
+			hcConfig.Port = strconv.Itoa(port)
+		}
+	}
+
+	if config.Bridge.Address != "" {
+		err := retry("find bridge address", startupAttempts, func() error {
+			return hasAddress(config.Bridge.Address)
+		})
+		if err != nil {
+			log.Println("[!] Starting anyway: ", err)
+		}
+	}
+
+	// On termination we stop all timers and then the transport
+
+	terminated := make(chan struct{})
+	hc.OnTermination(func() {
+		// TODO Stop all Accessory timers ...
+		sdNotify("STOPPING=1")
+		close(terminated)
+	})
+
+	go notifyReady()
+	go runWatchdog(hcConfig.Port)
+
+	// A standby publishes the bridge only while its peer is down. When the
+	// transport cannot start, because its port is taken or its storage is
+	// broken, everything else keeps running and HomeKit is tried again later.
+	delay := transportRetryDelay
+	var transport *homekitTransport
+	for {
+		select {
+		case <-ha.until(true):
+		case <-terminated:
+			return
+		}
+
+		var err error
+		if transport == nil {
+			transport, err = newTransport(hcConfig, bridge, sensors)
+		}
+		if err == nil {
+			if err = runTransport(transport, hcConfig.Port, terminated); err == nil {
+				transport.removeListeners()
+				transport = nil
+				select {
+				case <-terminated:
+					return
+				default:
+				}
+				log.Println("[*] Stopped HomeKit, the peer leads")
+				delay = transportRetryDelay
+				continue
+			}
+		}
+
+		log.Printf("[!] HomeKit is not available, retrying in %s: %v", delay, err)
+		select {
+		case <-clock.After(delay):
+		case <-terminated:
+			return
+		}
+		if delay *= 2; delay > maxTransportRetryDelay {
+			delay = maxTransportRetryDelay
+		}
+	}
+}
+
+const (
+	transportRetryDelay    = 5 * time.Second
+	maxTransportRetryDelay = 5 * time.Minute
+)
+
+// homekitTransport is a transport with the listeners it added to the
+// characteristics of the accessories. hc cannot start a transport again once
+// it stopped and never removes these listeners, so a transport is kept across
+// failed starts and its listeners are removed once it stopped.
+type homekitTransport struct {
+	hc.Transport
+	listeners []transportListeners
+}
+
+// transportListeners are the ranges of listeners of a characteristic that a
+// transport added.
+type transportListeners struct {
+	characteristic *characteristic.Characteristic
+	conn, value    [2]int
+}
+
+func newTransport(hcConfig hc.Config, bridge *accessory.Bridge, sensors []*accessory.Accessory) (*homekitTransport, error) {
+	accessories := append([]*accessory.Accessory{bridge.Accessory}, sensors...)
+
+	if missing := missingListenerFields(); len(missing) > 0 {
+		log.Printf("[!] hc has no listener fields %v, the listeners of stopped transports are not removed", missing)
+	}
+
+	saveConfigurationNumber, err := updateConfigurationNumber(accessories)
+	if err != nil {
+		log.Println("[!] Could not update the configuration number: ", err)
+	}
+
+	var listeners []transportListeners
+	for _, a := range accessories {
+		for _, s := range a.Services {
+			for _, c := range s.Characteristics {
+				conn, value := listenerCounts(c)
+				listeners = append(listeners, transportListeners{characteristic: c, conn: [2]int{conn, conn}, value: [2]int{value, value}})
+			}
+		}
+	}
+
+	transport, err := hc.NewIPTransport(hcConfig, bridge.Accessory, sensors...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create ip transport: %v", err)
+	}
+	for i := range listeners {
+		listeners[i].conn[1], listeners[i].value[1] = listenerCounts(listeners[i].characteristic)
+	}
+
+	if saveConfigurationNumber != nil {
+		if err := saveConfigurationNumber(); err != nil {
+			log.Println("[!] Could not save the configuration number: ", err)
+		}
+	}
+	return &homekitTransport{Transport: transport, listeners: listeners}, nil
+}
+
+// removeListeners removes the listeners the transport added, which would
+// otherwise pile up with every failover.
+func (t *homekitTransport) removeListeners() {
+	for _, l := range t.listeners {
+		removeListeners(l.characteristic, connListenersField, l.conn)
+		removeListeners(l.characteristic, valueListenersField, l.value)
+	}
+	t.listeners = nil
+}
+
+// listenerCounts returns how many listeners a characteristic has, for
+// updates from controllers and for all updates.
+func listenerCounts(c *characteristic.Characteristic) (int, int) {
+	return listenerField(c, connListenersField).Len(), listenerField(c, valueListenersField).Len()
+}
+
+// removeListeners removes a range of listeners. Listeners are only ever
+// appended, so the range stays where it was added.
+func removeListeners(c *characteristic.Characteristic, name string, added [2]int) {
+	field := listenerField(c, name)
+	if added[0] >= added[1] || added[1] > field.Len() {
+		return
+	}
+	field.Set(reflect.AppendSlice(field.Slice(0, added[0]), field.Slice(added[1], field.Len())))
+}
+
+// The fields hc keeps the listeners of a characteristic in, for updates from
+// controllers and for all updates.
+const (
+	connListenersField  = "connValueUpdateFuncs"
+	valueListenersField = "valueChangeFuncs"
+)
+
+// missingListenerFields returns the listener fields that hc does not have
+// (anymore), so that the listeners cannot be removed.
+func missingListenerFields() []string {
+	var missing []string
+	c := reflect.TypeOf(characteristic.Characteristic{})
+	for _, name := range []string{connListenersField, valueListenersField} {
+		if field, ok := c.FieldByName(name); !ok || field.Type.Kind() != reflect.Slice {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// listenerField returns a settable list of listeners of a characteristic.
+// hc keeps them unexported and offers no way to remove them.
+func listenerField(c *characteristic.Characteristic, name string) reflect.Value {
+	field := reflect.ValueOf(c).Elem().FieldByName(name)
+	if field.Kind() != reflect.Slice {
+		return reflect.ValueOf([]struct{}{})
+	}
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+}
+
+// runTransport publishes the bridge until it terminates or the peer takes
+// over. It returns an error if the transport could not be started, in which
+// case it can be started again.
+func runTransport(transport hc.Transport, port string, terminated chan struct{}) error {
+	// The transport panics when it cannot listen on its port
+	failed := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer func() {
+			if r := recover(); r != nil {
+				failed <- fmt.Errorf("could not start ip transport: %v", r)
+			}
+		}()
+		transport.Start()
+	}()
+
+	stop := func() error {
+		<-transport.Stop()
+		<-stopped
+		health.TransportStopped()
+		return nil
+	}
+
+	// It only counts as started once it accepts connections
+	for listening := false; !listening; {
+		select {
+		case err := <-failed:
+			return err
+		case <-terminated:
+			return stop()
+		case <-ha.until(false):
+			return stop()
+		case <-clock.After(transportCheckInterval):
+			listening = transportListening(port)
+		}
+	}
+	health.TransportStarted()
+
+	select {
+	case err := <-failed:
+		health.TransportStopped()
+		return err
+	case <-terminated:
+	case <-ha.until(false):
+	}
+	return stop()
+}
+
+const transportCheckInterval = 100 * time.Millisecond
+
+// transportListening returns whether the transport accepts connections on
+// its port.
+func transportListening(port string) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// runWithoutHomeKit keeps the bridge running for its other duties until it is
+// asked to stop.
+func runWithoutHomeKit() {
+	log.Println("[*] HomeKit is disabled")
+
+	health.TransportDisabled()
+
+	go notifyReady()
+	go runWatchdog("")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	sdNotify("STOPPING=1")
+}
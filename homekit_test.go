@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/brutella/hc"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+)
+
+// inTempDir runs a test in a directory of its own, as the transport keeps its
+// storage relative to it.
+func inTempDir(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+func TestTransportListenersAreRemoved(t *testing.T) {
+	inTempDir(t)
+
+	bridge := accessory.NewBridge(accessory.Info{Name: "Bridge"})
+	sensor := accessory.NewTemperatureSensor(accessory.Info{Name: "Sensor", ID: 2}, 20, -40, 80, 0.1)
+	temperature := sensor.TempSensor.CurrentTemperature.Characteristic
+	temperature.OnValueUpdate(func(*characteristic.Characteristic, interface{}, interface{}) {})
+	conn, value := listenerCounts(temperature)
+	if value != 1 {
+		t.Fatalf("expected 1 listener, got %d", value)
+	}
+
+	for i := 0; i < 3; i++ {
+		transport, err := newTransport(hc.Config{Pin: "00102003", StoragePath: storagePath}, bridge, []*accessory.Accessory{sensor.Accessory})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, added := listenerCounts(temperature); added <= value {
+			t.Fatalf("transport added no listeners")
+		}
+
+		// Listeners added while the transport runs stay
+		temperature.OnValueUpdateFromConn(func(net.Conn, *characteristic.Characteristic, interface{}, interface{}) {})
+		conn++
+
+		transport.removeListeners()
+		if c, v := listenerCounts(temperature); c != conn || v != value {
+			t.Fatalf("expected %d and %d listeners after transport %d, got %d and %d", conn, value, i, c, v)
+		}
+	}
+}
+
+// The listeners of a stopped transport are removed through fields hc does
+// not export, which an update of hc may rename.
+func TestListenerFieldsExist(t *testing.T) {
+	if missing := missingListenerFields(); len(missing) > 0 {
+		t.Fatalf("hc has no listener fields %v", missing)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	hclog "github.com/brutella/hc/log"
+)
+
+// HomeKitEvent is a controller reading, subscribing to or writing a
+// characteristic, or a notification of a change sent to a controller.
+// Controllers are known by their address, hc does not tell which pairing a
+// connection belongs to.
+type HomeKitEvent struct {
+	Time       time.Time   `json:"time"`
+	Controller string      `json:"controller"`
+	Event      string      `json:"event"`
+	AID        uint64      `json:"aid"`
+	IID        uint64      `json:"iid"`
+	SensorID   string      `json:"sensor_id,omitempty"`
+	Type       string      `json:"type,omitempty"`
+	Value      interface{} `json:"value,omitempty"`
+}
+
+// maxHomeKitEvents is how many events are kept for the API.
+const maxHomeKitEvents = 500
+
+// HomeKitEvents collects the events from the debug log of hc, which is the
+// only place that sees the requests of controllers. Each line is written
+// separately, the body of a PUT follows the line that announces it.
+type HomeKitEvents struct {
+	mutex  sync.Mutex
+	events []HomeKitEvent
+	put    string
+}
+
+var homeKitEvents = &HomeKitEvents{}
+
+// captureHomeKitEvents sends the debug log of hc to homeKitEvents, nothing
+// else reads it.
+func captureHomeKitEvents() {
+	hclog.Debug.SetFlags(0)
+	hclog.Debug.SetPrefix("")
+	hclog.Debug.SetOutput(homeKitEvents)
+}
+
+var characteristicIDs = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+// hapCharacteristics is the body of a PUT /characteristics request or of a
+// notification.
+type hapCharacteristics struct {
+	Characteristics []struct {
+		AID    uint64      `json:"aid"`
+		IID    uint64      `json:"iid"`
+		Value  interface{} `json:"value"`
+		Events *bool       `json:"ev"`
+	} `json:"characteristics"`
+}
+
+func (h *HomeKitEvents) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	now := clock.Now()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	switch {
+	case strings.Contains(line, " GET /characteristics "):
+		i := strings.Index(line, " GET /characteristics ")
+		for _, ids := range characteristicIDs.FindAllStringSubmatch(line[i:], -1) {
+			h.record(HomeKitEvent{Time: now, Controller: line[:i], Event: "read", AID: parseID(ids[1]), IID: parseID(ids[2])})
+		}
+	case strings.HasSuffix(line, " PUT /characteristics"):
+		h.put = strings.TrimSuffix(line, " PUT /characteristics")
+	case strings.HasPrefix(line, `{"characteristics"`) && h.put != "":
+		var body hapCharacteristics
+		if json.Unmarshal(p, &body) == nil {
+			for _, c := range body.Characteristics {
+				event := HomeKitEvent{Time: now, Controller: h.put, AID: c.AID, IID: c.IID}
+				if c.Events != nil {
+					event.Event = "unsubscribe"
+					if *c.Events {
+						event.Event = "subscribe"
+					}
+					h.record(event)
+				}
+				if c.Value != nil {
+					event.Event, event.Value = "write", c.Value
+					h.record(event)
+				}
+			}
+		}
+		h.put = ""
+	case strings.Contains(line, " <- EVENT/1.0"):
+		i := strings.Index(line, " <- ")
+		var body hapCharacteristics
+		if j := strings.Index(line, "{"); j != -1 && json.NewDecoder(strings.NewReader(line[j:])).Decode(&body) == nil {
+			for _, c := range body.Characteristics {
+				h.record(HomeKitEvent{Time: now, Controller: line[:i], Event: "notify", AID: c.AID, IID: c.IID, Value: c.Value})
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func parseID(s string) uint64 {
+	id, _ := strconv.ParseUint(s, 10, 64)
+	return id
+}
+
+// record adds an event with the sensor and type of its characteristic. The
+// caller must hold the lock.
+func (h *HomeKitEvents) record(event HomeKitEvent) {
+	event.SensorID, event.Type = lookupCharacteristic(event.AID, event.IID)
+	h.events = append(h.events, event)
+	if len(h.events) > maxHomeKitEvents {
+		h.events = h.events[len(h.events)-maxHomeKitEvents:]
+	}
+}
+
+// lookupCharacteristic returns the serial of the sensor an accessory ID
+// belongs to and the type of a characteristic.
+func lookupCharacteristic(aid, iid uint64) (string, string) {
+	accessoriesMutex.Lock()
+	defer accessoriesMutex.Unlock()
+
+	for serial, ac := range accessories {
+		if ac.ID != aid {
+			continue
+		}
+		for _, svc := range ac.Services {
+			for _, c := range svc.Characteristics {
+				if c.ID == iid {
+					return serial, c.Type
+				}
+			}
+		}
+		return serial, ""
+	}
+	return "", ""
+}
+
+// List returns the recent events of a sensor, or of all accessories when
+// sensorID is empty, newest first.
+func (h *HomeKitEvents) List(sensorID string) []HomeKitEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	events := []HomeKitEvent{}
+	for i := len(h.events) - 1; i >= 0; i-- {
+		if sensorID == "" || h.events[i].SensorID == sensorID {
+			events = append(events, h.events[i])
+		}
+	}
+	return events
+}
+
+func handleHomeKitEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(homeKitEvents.List(r.URL.Query().Get("sensor"))); err != nil {
+		log.Println("Failed to encode HomeKit events: ", err)
+	}
+}
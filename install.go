@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"text/template"
+)
+
+var systemdUnitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=Sensor Bridge
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+User={{.User}}
+WorkingDirectory={{.Directory}}
+ExecStart={{.Executable}}
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=5
+WatchdogSec=60
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var launchdPlistTemplate = template.Must(template.New("plist").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key>
+    <string>{{.Label}}</string>
+    <key>UserName</key>
+    <string>{{.User}}</string>
+    <key>WorkingDirectory</key>
+    <string>{{.Directory}}</string>
+    <key>ProgramArguments</key>
+    <array>
+        <string>{{.Executable}}</string>
+    </array>
+    <key>RunAtLoad</key>
+    <true/>
+    <key>KeepAlive</key>
+    <dict>
+        <key>SuccessfulExit</key>
+        <false/>
+    </dict>
+    <key>StandardOutPath</key>
+    <string>{{.Directory}}/sensor-bridge.log</string>
+    <key>StandardErrorPath</key>
+    <string>{{.Directory}}/sensor-bridge.log</string>
+</dict>
+</plist>
+`))
+
+type serviceDefinition struct {
+	Label      string
+	User       string
+	Directory  string
+	Executable string
+}
+
+// installServiceCommand writes a systemd unit, or a launchd plist on macOS,
+// that runs the bridge from the directory holding its config file.
+func installServiceCommand(args []string) {
+	flags := flag.NewFlagSet("install-service", flag.ExitOnError)
+	username := flags.String("user", "", "user to run the bridge as (default: current user)")
+	directory := flags.String("dir", "", "directory with sensor-bridge.json (default: current directory)")
+	output := flags.String("output", "", "where to write the service file")
+	printOnly := flags.Bool("print", false, "print the service file instead of installing it")
+	noStart := flags.Bool("no-start", false, "install but do not enable and start the service")
+	flags.Parse(args)
+
+	definition := serviceDefinition{Label: "com.github.st3fan.sensor-bridge", User: *username, Directory: *directory}
+
+	if definition.User == "" {
+		current, err := user.Current()
+		if err != nil {
+			log.Fatal("Could not determine current user: ", err)
+		}
+		definition.User = current.Username
+	}
+
+	if definition.Directory == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatal("Could not determine working directory: ", err)
+		}
+		definition.Directory = wd
+	}
+
+	var err error
+	if definition.Directory, err = filepath.Abs(definition.Directory); err != nil {
+		log.Fatal("Invalid directory: ", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(definition.Directory, configPath)); err != nil {
+		log.Fatalf("No %s in %s", configPath, definition.Directory)
+	}
+
+	if definition.Executable, err = os.Executable(); err != nil {
+		log.Fatal("Could not determine executable: ", err)
+	}
+
+	tmpl, path := systemdUnitTemplate, "/etc/systemd/system/sensor-bridge.service"
+	start := [][]string{{"systemctl", "daemon-reload"}, {"systemctl", "enable", "--now", "sensor-bridge"}}
+	if runtime.GOOS == "darwin" {
+		tmpl, path = launchdPlistTemplate, "/Library/LaunchDaemons/"+definition.Label+".plist"
+		start = [][]string{{"launchctl", "load", "-w", path}}
+	}
+	if *output != "" {
+		path = *output
+	}
+
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, definition); err != nil {
+		log.Fatal("Could not generate service file: ", err)
+	}
+
+	if *printOnly {
+		os.Stdout.Write(buffer.Bytes())
+		return
+	}
+
+	if err := ioutil.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+		log.Fatal("Could not write service file: ", err)
+	}
+	log.Printf("[*] Wrote %s", path)
+
+	if *noStart {
+		return
+	}
+
+	for _, command := range start {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Fatalf("Could not run %v: %v", command, err)
+		}
+	}
+
+	fmt.Println("The sensor bridge is installed and running.")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// References in config values keep secrets out of the config file itself. A
+// value can include environment variables as ${NAME}, $$ is a literal $. A
+// value of file://path is replaced by the contents of the file, relative to
+// the config file, without trailing newlines.
+var envReference = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+const fileReference = "file://"
+
+// interpolate resolves the references in all string values of a JSON
+// document. dir is where relative files are found.
+func interpolate(encoded []byte, dir string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	resolved, err := resolveReferences(document, dir)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resolved)
+}
+
+func resolveReferences(v interface{}, dir string) (interface{}, error) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, element := range value {
+			resolved, err := resolveReferences(element, dir)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			value[key] = resolved
+		}
+	case []interface{}:
+		for i, element := range value {
+			resolved, err := resolveReferences(element, dir)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = resolved
+		}
+	case string:
+		return resolveString(value, dir)
+	}
+	return v, nil
+}
+
+func resolveString(s, dir string) (string, error) {
+	if strings.HasPrefix(s, fileReference) {
+		path := strings.TrimPrefix(s, fileReference)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(contents), "\r\n"), nil
+	}
+
+	var missing []string
+	resolved := envReference.ReplaceAllStringFunc(s, func(reference string) string {
+		if reference == "$$" {
+			return "$"
+		}
+		name := envReference.FindStringSubmatch(reference)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) != 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return resolved, nil
+}
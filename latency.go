@@ -0,0 +1,22 @@
+package main
+
+import "time"
+
+// movingAverage folds value into average the way the signal strength is
+// averaged, so that one slow packet does not stand out.
+func movingAverage(average *float64, value float64) *float64 {
+	if average != nil {
+		value = 0.8**average + 0.2*value
+	}
+	return &value
+}
+
+// RecordNotifyLag tracks how long a measurement of the sensor took from the
+// store to HomeKit, which includes the time it was held back to coalesce
+// updates.
+func (s *Store) RecordNotifyLag(sensorID string, lag time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.statsFor(sensorID)
+	stats.NotifyLag = movingAverage(stats.NotifyLag, lag.Seconds())
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// loadTest keeps track of the packets sent and the ACKs they got.
+type loadTest struct {
+	mutex     sync.Mutex
+	sent      map[string]time.Time
+	latencies []time.Duration
+	failed    int
+}
+
+func (t *loadTest) send(conn net.Conn, key string, sensor int, seq int) {
+	temperature := float32(15 + rand.Float64()*10)
+	humidity := float32(40 + rand.Float64()*20)
+	measurement := Measurement{
+		SensorID:        fmt.Sprintf("loadtest-%03d", sensor),
+		SensorTime:      time.Now().Unix(),
+		MeasurementID:   fmt.Sprintf("lt-%d", seq),
+		MeasurementData: MeasurementData{Temperature: &temperature, Humidity: &humidity},
+	}
+
+	payload, err := json.Marshal(measurement)
+	if err == nil && key != "" {
+		payload, err = sign(key, payload)
+	}
+	if err != nil {
+		log.Fatal("Could not encode packet: ", err)
+	}
+
+	t.mutex.Lock()
+	t.sent[measurement.MeasurementID] = time.Now()
+	t.mutex.Unlock()
+
+	if _, err := conn.Write(payload); err != nil {
+		t.mutex.Lock()
+		t.failed++
+		t.mutex.Unlock()
+	}
+}
+
+// receive matches the ACKs of the bridge to the packets they are for.
+func (t *loadTest) receive(conn net.Conn) {
+	buffer := make([]byte, 2048)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		var ack Ack
+		if err := json.Unmarshal(buffer[:n], &ack); err != nil {
+			continue
+		}
+
+		t.mutex.Lock()
+		if sent, ok := t.sent[ack.Ack]; ok {
+			t.latencies = append(t.latencies, time.Since(sent))
+			delete(t.sent, ack.Ack)
+		}
+		t.mutex.Unlock()
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// loadtestCommand sends synthetic packets from a number of sensors at a fixed
+// rate to a bridge and reports how many it acknowledged and how fast. Only
+// receivers with acks enabled answer, and unknown sensors do not get one when
+// quarantine is enabled.
+func loadtestCommand(args []string) {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	target := flags.String("target", "127.0.0.1:3232", "address of the receiver")
+	rate := flags.Int("rate", 100, "packets per second")
+	sensors := flags.Int("sensors", 10, "number of sensors to simulate")
+	duration := flags.Duration("duration", 10*time.Second, "how long to send")
+	key := flags.String("key", "", "hex HMAC key to sign the packets with")
+	flags.Parse(args)
+
+	if *rate <= 0 || *sensors <= 0 {
+		log.Fatal("The rate and number of sensors must be positive")
+	}
+
+	conn, err := net.Dial("udp", *target)
+	if err != nil {
+		log.Fatal("Could not connect to the bridge: ", err)
+	}
+	defer conn.Close()
+
+	test := &loadTest{sent: map[string]time.Time{}}
+	go test.receive(conn)
+
+	fmt.Printf("Sending %d packets per second from %d sensors to %s for %s\n", *rate, *sensors, *target, *duration)
+
+	start := time.Now()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	seq := 0
+	for now := range ticker.C {
+		elapsed := now.Sub(start)
+		if elapsed >= *duration {
+			break
+		}
+		// Catch up with the schedule, a slow tick sends a bigger burst
+		for due := int(elapsed.Seconds() * float64(*rate)); seq < due; seq++ {
+			test.send(conn, *key, seq%*sensors, seq)
+		}
+	}
+	ticker.Stop()
+	elapsed := time.Since(start)
+
+	// Give the last ACKs a moment to arrive
+	time.Sleep(time.Second)
+
+	test.mutex.Lock()
+	defer test.mutex.Unlock()
+
+	latencies := append([]time.Duration(nil), test.latencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	acked := len(latencies)
+	fmt.Printf("Sent:     %d packets, %.0f per second, %d failed to send\n", seq, float64(seq)/elapsed.Seconds(), test.failed)
+	if acked == 0 {
+		fmt.Println("Acked:    none, is ack enabled on the receiver and quarantine disabled?")
+		return
+	}
+	fmt.Printf("Acked:    %d packets, %.0f per second\n", acked, float64(acked)/elapsed.Seconds())
+	fmt.Printf("Dropped:  %d packets, %.2f%%\n", seq-acked, 100*float64(seq-acked)/float64(seq))
+	fmt.Printf("Latency:  p50 %s, p95 %s, p99 %s, max %s\n",
+		percentile(latencies, 0.50), percentile(latencies, 0.95), percentile(latencies, 0.99), latencies[len(latencies)-1])
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	hclog "github.com/brutella/hc/log"
+)
+
+// LoggingConfig controls the chatty logs: one line per received packet and
+// per characteristic read. Errors and state changes are always logged.
+type LoggingConfig struct {
+	Quiet       bool `json:"quiet"`
+	SampleEvery int  `json:"sample_every"`
+	LogReads    bool `json:"log_reads"`
+	HomeKit     bool `json:"homekit"`
+}
+
+type packetLogger struct {
+	mutex  sync.Mutex
+	config LoggingConfig
+	counts map[string]int
+}
+
+var packetLog = &packetLogger{
+	config: LoggingConfig{SampleEvery: 1, LogReads: true, HomeKit: true},
+	counts: map[string]int{},
+}
+
+func configureLogging(config LoggingConfig) {
+	packetLog.mutex.Lock()
+	defer packetLog.mutex.Unlock()
+
+	packetLog.config = config
+	captureHomeKitEvents()
+	if !config.HomeKit || config.Quiet {
+		hclog.Info.Disable()
+	}
+}
+
+// Packet logs one in SampleEvery packets of each sensor, or none at all in
+// quiet mode.
+func (p *packetLogger) Packet(sensorID string, format string, v ...interface{}) {
+	p.mutex.Lock()
+	if p.config.Quiet {
+		p.mutex.Unlock()
+		return
+	}
+	count := p.counts[sensorID]
+	p.counts[sensorID] = count + 1
+	sample := p.config.SampleEvery
+	p.mutex.Unlock()
+
+	if sample <= 1 || count%sample == 0 {
+		log.Printf(format, v...)
+	}
+}
+
+func (p *packetLogger) Read(format string, v ...interface{}) {
+	p.mutex.Lock()
+	enabled := p.config.LogReads && !p.config.Quiet
+	p.mutex.Unlock()
+
+	if enabled {
+		log.Printf(format, v...)
+	}
+}
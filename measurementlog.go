@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// loggedMeasurement is a line of the measurement log. Time is when the
+// measurement was taken, or when it was received if the sensor clock is off.
+type loggedMeasurement struct {
+	Time        time.Time   `json:"time"`
+	Received    time.Time   `json:"received"`
+	Receiver    string      `json:"receiver"`
+	Address     string      `json:"address"`
+	Measurement Measurement `json:"measurement"`
+}
+
+// measurementLog appends every accepted measurement as a JSON line. It is nil
+// when the log is disabled.
+var measurementLog *rotatingFile
+
+func openMeasurementLog(config RotateConfig) error {
+	if config.Path == "" {
+		return nil
+	}
+
+	file, err := openRotatingFile(config)
+	if err != nil {
+		return err
+	}
+
+	measurementLog = file
+	return nil
+}
+
+func logMeasurement(measurement Measurement, receiver, address string) {
+	if measurementLog == nil {
+		return
+	}
+
+	measurement = outputUnits(measurement, liveConfig().Units, "measurement_log")
+
+	now := clock.Now()
+	line, err := json.Marshal(loggedMeasurement{
+		Time:        measurementTime(measurement.SensorTime, now),
+		Received:    now,
+		Receiver:    receiver,
+		Address:     address,
+		Measurement: measurement,
+	})
+	if err != nil {
+		log.Println("Could not encode measurement: ", err)
+		return
+	}
+
+	if _, err := measurementLog.Write(append(line, '\n')); err != nil {
+		log.Println("Could not write measurement log: ", err)
+	}
+}
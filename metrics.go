@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
+
+// MetricConfig declares a value that sensors report in the metrics object of
+// their packets, like {"metrics": {"co2": 612}}, so that it needs no field of
+// its own. Type is "gauge" (the default) or "counter", Unit becomes part of
+// the Prometheus name and Labels are added to it. HomeKit is the service
+// sensors that list the metric show it with: "temperature", "humidity",
+// "light" or "carbon_dioxide".
+type MetricConfig struct {
+	Type    string            `json:"type,omitempty"`
+	Unit    string            `json:"unit,omitempty"`
+	Help    string            `json:"help,omitempty"`
+	HomeKit string            `json:"homekit,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+var metricNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// CO2 levels above this are abnormal for HomeKit, in ppm
+const carbonDioxideThreshold = 1000
+
+// homeKitMetrics create the service for a metric and return a function that
+// updates it with a new value.
+var homeKitMetrics = map[string]func(config SensorConfig, name string) (*service.Service, func(float64)){
+	"temperature": func(config SensorConfig, name string) (*service.Service, func(float64)) {
+		svc := service.NewTemperatureSensor()
+		configureTemperature(config.Temperature, svc.CurrentTemperature, nil)
+		return svc.Service, func(v float64) { svc.CurrentTemperature.UpdateValue(config.homeKitValue(float32(v))) }
+	},
+	"humidity": func(config SensorConfig, name string) (*service.Service, func(float64)) {
+		svc := service.NewHumiditySensor()
+		return svc.Service, func(v float64) { svc.CurrentRelativeHumidity.UpdateValue(config.homeKitValue(float32(v))) }
+	},
+	"light": func(config SensorConfig, name string) (*service.Service, func(float64)) {
+		svc := service.NewLightSensor()
+		return svc.Service, func(v float64) { svc.CurrentAmbientLightLevel.UpdateValue(config.homeKitValue(float32(v))) }
+	},
+	"carbon_dioxide": func(config SensorConfig, name string) (*service.Service, func(float64)) {
+		svc := service.NewCarbonDioxideSensor()
+		level := characteristic.NewCarbonDioxideLevel()
+		svc.AddCharacteristic(level.Characteristic)
+		return svc.Service, func(v float64) {
+			level.UpdateValue(config.homeKitValue(float32(v)))
+			if v > carbonDioxideThreshold {
+				svc.CarbonDioxideDetected.UpdateValue(characteristic.CarbonDioxideDetectedCO2LevelsAbnormal)
+			} else {
+				svc.CarbonDioxideDetected.UpdateValue(characteristic.CarbonDioxideDetectedCO2LevelsNormal)
+			}
+		}
+	},
+}
+
+func (c MetricConfig) validate(name string) error {
+	if !metricNamePattern.MatchString(name) {
+		return fmt.Errorf("metric name <%s> must be lowercase letters, digits and underscores", name)
+	}
+	if metricKind(name) != reflect.Invalid {
+		return fmt.Errorf("metric <%s> is a built-in value", name)
+	}
+	if c.Type != "" && c.Type != "gauge" && c.Type != "counter" {
+		return fmt.Errorf("metric <%s> has unknown type <%s>", name, c.Type)
+	}
+	if c.Unit != "" && !metricNamePattern.MatchString(c.Unit) {
+		return fmt.Errorf("metric <%s> has invalid unit <%s>", name, c.Unit)
+	}
+	if _, ok := homeKitMetrics[c.HomeKit]; c.HomeKit != "" && !ok {
+		return fmt.Errorf("metric <%s> has unknown HomeKit service <%s>", name, c.HomeKit)
+	}
+	return nil
+}
+
+// declaredMetrics are the names of the metrics the config declares. Names
+// are only ever added, so that the values of a running bridge stay valid
+// while a new config is checked.
+var declaredMetrics = struct {
+	sync.RWMutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+func declareMetrics(metrics map[string]MetricConfig) error {
+	for name, metric := range metrics {
+		if err := metric.validate(name); err != nil {
+			return err
+		}
+	}
+
+	declaredMetrics.Lock()
+	defer declaredMetrics.Unlock()
+	for name := range metrics {
+		declaredMetrics.names[name] = true
+	}
+	return nil
+}
+
+func isDeclaredMetric(name string) bool {
+	declaredMetrics.RLock()
+	defer declaredMetrics.RUnlock()
+	return declaredMetrics.names[name]
+}
+
+// prometheusName is the name the metric is exported with, like
+// sensor_bridge_co2_ppm.
+func (c MetricConfig) prometheusName(name string) string {
+	name = "sensor_bridge_" + name
+	if c.Unit != "" {
+		name += "_" + c.Unit
+	}
+	if c.Type == "counter" {
+		name += "_total"
+	}
+	return name
+}
+
+// writeDeclaredMetrics exports the declared metrics of the sensors that
+// reported them.
+func writeDeclaredMetrics(w http.ResponseWriter, metrics map[string]MetricConfig, states []SensorState) {
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		metric := metrics[name]
+
+		typ, help := metric.Type, metric.Help
+		if typ == "" {
+			typ = "gauge"
+		}
+		if help == "" {
+			help = "Latest reported " + name + "."
+		}
+
+		var extra string
+		var keys []string
+		for key := range metric.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			extra += fmt.Sprintf(",%s=%q", key, metric.Labels[key])
+		}
+
+		fmt.Fprintf(w, "# HELP %s %s\n", metric.prometheusName(name), help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", metric.prometheusName(name), typ)
+		for _, state := range states {
+			if v, ok := state.Measurement.MeasurementData.Metrics[name]; ok {
+				fmt.Fprintf(w, "%s{%s%s} %g\n", metric.prometheusName(name), metricLabels(state), extra, v)
+			}
+		}
+	}
+}
+
+// addMetricServices adds a service for each of the declared metrics a sensor
+// lists, named after the metric.
+func addMetricServices(config SensorConfig, ac *accessory.Accessory) error {
+	metrics := liveConfig().Metrics
+	for _, name := range config.Metrics {
+		name := name
+
+		metric, ok := metrics[name]
+		if !ok {
+			return fmt.Errorf("metric <%s> is not declared", name)
+		}
+		create, ok := homeKitMetrics[metric.HomeKit]
+		if !ok {
+			return fmt.Errorf("metric <%s> has no HomeKit service", name)
+		}
+
+		svc, update := create(config, name)
+		addServiceName(config, svc, name)
+
+		if measurement, ok := store.Latest(config.Serial); ok {
+			if v, ok := measurement.MeasurementData.Metrics[name]; ok {
+				update(v)
+			}
+		}
+		onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+			if v, ok := measurement.MeasurementData.Metrics[name]; ok {
+				update(v)
+			}
+		})
+
+		ac.AddService(svc)
+	}
+	return nil
+}
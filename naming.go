@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
+
+var typeNames = map[string]string{
+	"":                "Sensor",
+	"sensor":          "Sensor",
+	"virtual":         "Sensor",
+	"switch":          "Switch",
+	"thermostat":      "Thermostat",
+	"fan":             "Fan",
+	"window_covering": "Window Covering",
+	"soil_moisture":   "Soil Moisture",
+	"energy_meter":    "Energy Meter",
+	"tank":            "Tank",
+	"occupancy":       "Occupancy",
+	"garage_door":     "Garage Door",
+	"contact":         "Contact",
+}
+
+// expandName fills in a name template like "{room} {type}". Sensors without a
+// name get the template of the bridge.
+func (c SensorConfig) expandName(template string) string {
+	name := c.Name
+	if name == "" {
+		name = template
+	}
+	if !strings.Contains(name, "{") {
+		return name
+	}
+
+	typeName, ok := typeNames[c.Type]
+	if !ok {
+		typeName = c.Type
+	}
+
+	replacer := strings.NewReplacer(
+		"{room}", c.Room,
+		"{group}", c.Group,
+		"{type}", typeName,
+		"{serial}", c.Serial,
+		"{model}", c.Model,
+	)
+
+	// Placeholders without a value should not leave double spaces behind
+	return strings.Join(strings.Fields(replacer.Replace(name)), " ")
+}
+
+type serviceName struct {
+	name   *characteristic.Name
+	suffix string
+}
+
+// serviceNames are the names of services that follow the name of their
+// accessory, by serial.
+var serviceNames = map[string][]serviceName{}
+
+// addServiceName names a service after its accessory, like "Kitchen Humidity".
+func addServiceName(config SensorConfig, svc *service.Service, suffix string) {
+	name := characteristic.NewName()
+	name.SetValue(config.Name + " " + suffix)
+	svc.AddCharacteristic(name.Characteristic)
+
+	accessoriesMutex.Lock()
+	defer accessoriesMutex.Unlock()
+	serviceNames[config.Serial] = append(serviceNames[config.Serial], serviceName{name: name, suffix: suffix})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// NotificationsConfig sets where alerts and summaries are sent, on top of the
+// log. Webhook is a URL that gets a JSON object with a subject and a message.
+// Spool is how many notifications to keep on disk for each channel that
+// cannot be reached, they are sent in order once it is back. Without it a
+// notification that fails is dropped.
+type NotificationsConfig struct {
+	Webhook  string         `json:"webhook"`
+	Telegram TelegramConfig `json:"telegram"`
+	Email    *EmailConfig   `json:"email"`
+	Spool    int            `json:"spool,omitempty"`
+}
+
+// TelegramConfig sends notifications as a Telegram bot to a chat.
+type TelegramConfig struct {
+	Token  string `json:"token"`
+	ChatID string `json:"chat_id"`
+}
+
+type Notifier interface {
+	Notify(subject, message string) error
+}
+
+type notification struct {
+	subject, message string
+	channels         []string
+}
+
+// notifyQueue holds the notifications that have not been sent yet. They are
+// sent one at a time so that they arrive in order.
+var notifyQueue chan notification
+
+// notifiers are the configured channels by name: webhook, telegram or email.
+var notifiers map[string]Notifier
+
+// notifySpools hold the notifications of each channel until it takes them,
+// when spooling is configured.
+var notifySpools map[string]*notifySpool
+
+type notifySpool struct {
+	*Spool
+	wake chan struct{}
+}
+
+// spooledNotification is how a notification is kept in a spool.
+type spooledNotification struct {
+	Subject string `json:"subject"`
+	Message string `json:"message"`
+}
+
+// Spooled notifications are retried this often while their channel is down,
+// a batch at a time.
+const (
+	notifyRetryInterval = 30 * time.Second
+	notifyDrainBatch    = 10
+)
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+func configureNotifications(config NotificationsConfig) error {
+	notifiers = map[string]Notifier{}
+	if config.Webhook != "" {
+		notifiers["webhook"] = webhookNotifier{url: config.Webhook}
+	}
+	if config.Telegram.Token != "" && config.Telegram.ChatID != "" {
+		notifiers["telegram"] = telegramNotifier{config: config.Telegram}
+	}
+	if config.Email != nil {
+		notifier, err := newEmailNotifier(*config.Email)
+		if err != nil {
+			return err
+		}
+		notifiers["email"] = notifier
+	}
+
+	notifySpools = map[string]*notifySpool{}
+	if config.Spool > 0 {
+		for name, notifier := range notifiers {
+			spool, err := openSpool(filepath.Join(storagePath, "notify-"+name+".spool"), config.Spool)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			if n := spool.Len(); n != 0 {
+				log.Printf("[*] %d notifications by %s are spooled", n, name)
+			}
+			s := &notifySpool{Spool: spool, wake: make(chan struct{}, 1)}
+			s.wake <- struct{}{}
+			notifySpools[name] = s
+			go s.drain(name, notifier)
+		}
+	}
+
+	if len(notifiers) != 0 {
+		notifyQueue = make(chan notification, 100)
+		go sendNotifications(notifiers)
+	}
+	return nil
+}
+
+// drain sends the spooled notifications of a channel as they come in, and
+// retries those it could not send until the channel is back.
+func (s *notifySpool) drain(name string, notifier Notifier) {
+	ticker := clock.NewTicker(notifyRetryInterval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-s.wake:
+		case <-ticker.Chan():
+		}
+
+		for s.Len() != 0 {
+			sent := 0
+			var err error
+			notifications, head := s.Peek(notifyDrainBatch)
+			for _, b := range notifications {
+				var n spooledNotification
+				// What cannot be decoded can never be sent
+				if json.Unmarshal(b, &n) == nil {
+					if err = notifier.Notify(n.Subject, n.Message); err != nil {
+						break
+					}
+				}
+				sent++
+			}
+			if derr := s.Discard(head, sent); derr != nil {
+				log.Printf("[!] Could not update spool of %s: %v", name, derr)
+			}
+			if err != nil {
+				if !failing {
+					log.Printf("[!] Could not send notification by %s, keeping %d until it is back: %v", name, s.Len(), err)
+				}
+				failing = true
+				break
+			}
+		}
+
+		if failing && s.Len() == 0 {
+			log.Printf("[*] Sent all spooled notifications by %s", name)
+			failing = false
+		}
+	}
+}
+
+func sendNotifications(notifiers map[string]Notifier) {
+	var names []string
+	for name := range notifiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for n := range notifyQueue {
+		for _, name := range names {
+			if len(n.channels) != 0 && !contains(n.channels, name) {
+				continue
+			}
+			if spool, ok := notifySpools[name]; ok {
+				spool.push(name, n)
+				continue
+			}
+			if err := notifiers[name].Notify(n.subject, n.message); err != nil {
+				log.Printf("Could not send notification <%s> by %s: %v", n.subject, name, err)
+			}
+		}
+	}
+}
+
+// push spools a notification and wakes up the drain of the channel. A full
+// spool drops the oldest notification.
+func (s *notifySpool) push(name string, n notification) {
+	b, err := json.Marshal(spooledNotification{Subject: n.subject, Message: n.message})
+	if err == nil {
+		err = s.Push(b)
+	}
+	if err != nil {
+		log.Printf("[!] Could not spool notification <%s> for %s: %v", n.subject, name, err)
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// notify logs a message that is not tied to an alert, like a summary, and
+// delivers it.
+func notify(subject, message string) {
+	log.Printf("[*] %s:\n%s", subject, message)
+	deliver(subject, message)
+}
+
+// deliver queues a message for all notifiers.
+func deliver(subject, message string) {
+	deliverTo(nil, subject, message)
+}
+
+// deliverTo queues a message for the named notifiers, or all of them when
+// channels is empty, so that a slow service does not hold up the caller.
+// Messages are dropped when the queue is full, which with spooling only
+// happens when the disk cannot keep up.
+func deliverTo(channels []string, subject, message string) {
+	// The leader of a pair sends the notifications
+	if notifyQueue == nil || !ha.Leader() {
+		return
+	}
+	select {
+	case notifyQueue <- notification{subject: subject, message: message, channels: channels}:
+	default:
+		log.Printf("Dropped notification <%s>, too many are queued", subject)
+	}
+}
+
+type webhookNotifier struct {
+	url string
+}
+
+func (n webhookNotifier) Notify(subject, message string) error {
+	body, err := json.Marshal(map[string]string{"subject": subject, "message": message})
+	if err != nil {
+		return err
+	}
+
+	resp, err := notifyClient.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+type telegramNotifier struct {
+	config TelegramConfig
+}
+
+func (n telegramNotifier) Notify(subject, message string) error {
+	resp, err := notifyClient.PostForm("https://api.telegram.org/bot"+n.config.Token+"/sendMessage", url.Values{
+		"chat_id": {n.config.ChatID},
+		"text":    {subject + "\n\n" + message},
+	})
+	if err != nil {
+		// The URL holds the token, which must not end up in the logs
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = "https://api.telegram.org/bot<token>/sendMessage"
+		}
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("telegram returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig lets browser dashboards on other origins use the API. An origin
+// of "*" allows all of them.
+type CORSConfig struct {
+	Origins []string `json:"origins,omitempty"`
+	MaxAge  int      `json:"max_age,omitempty"`
+}
+
+func (c CORSConfig) allowed(origin string) bool {
+	for _, o := range c.Origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS adds CORS headers for allowed origins and answers preflight
+// requests, which never carry credentials, before they reach authentication.
+func withCORS(config CORSConfig, handler http.Handler) http.Handler {
+	if len(config.Origins) == 0 {
+		return handler
+	}
+
+	maxAge := config.MaxAge
+	if maxAge == 0 {
+		maxAge = 600
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !config.allowed(origin) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPI))
+}
+
+// openAPI describes the API. Keep it in sync with the handlers in serveAPI.
+const openAPI = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "sensor-bridge",
+    "description": "Measurements, alerts and management of the sensors of a sensor-bridge.",
+    "version": "1"
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer"},
+      "basic": {"type": "http", "scheme": "basic"}
+    },
+    "parameters": {
+      "sensorID": {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+      "secrets": {"name": "secrets", "in": "query", "schema": {"type": "boolean"}}
+    },
+    "schemas": {
+      "MeasurementData": {
+        "type": "object",
+        "description": "Values are left out when the sensor did not report them.",
+        "properties": {
+          "temperature": {"type": "number"},
+          "humidity": {"type": "number"},
+          "pressure": {"type": "number"},
+          "position": {"type": "integer"},
+          "moisture": {"type": "number"},
+          "angle": {"type": "number"},
+          "level_percent": {"type": "number"},
+          "wind_speed": {"type": "number"},
+          "wind_direction": {"type": "number"},
+          "rain_mm": {"type": "number"},
+          "uv_index": {"type": "number"},
+          "noise_db": {"type": "number"},
+          "watts": {"type": "number"},
+          "kwh": {"type": "number"},
+          "voltage": {"type": "number"},
+          "current": {"type": "number"},
+          "tampered": {"type": "boolean"},
+          "fan_on": {"type": "boolean"},
+          "filter_life": {"type": "number"},
+          "motion": {"type": "boolean"},
+          "rssi": {"type": "integer"},
+          "battery": {"type": "number"},
+          "uptime": {"type": "integer"},
+          "probes": {"type": "object", "additionalProperties": {"type": "number"}},
+          "metrics": {"type": "object", "additionalProperties": {"type": "number"}},
+          "raw": {"type": "object", "additionalProperties": {"type": "number"}},
+          "status": {"type": "string"}
+        }
+      },
+      "Measurement": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "integer"},
+          "sensor_id": {"type": "string"},
+          "sensor_time": {"type": "integer"},
+          "measurement_id": {"type": "string"},
+          "measurement_data": {"$ref": "#/components/schemas/MeasurementData"},
+          "sequence": {"type": "integer"},
+          "firmware_version": {"type": "string"}
+        }
+      },
+      "SensorStats": {
+        "type": "object",
+        "properties": {
+          "first_seen": {"type": "string", "format": "date-time"},
+          "last_seen": {"type": "string", "format": "date-time"},
+          "received": {"type": "integer"},
+          "parse_errors": {"type": "integer"},
+          "lost": {"type": "integer"},
+          "duplicates": {"type": "integer"},
+          "rate_limited": {"type": "integer"},
+          "encoding": {"type": "string"},
+          "last_sequence": {"type": "integer"},
+          "out_of_order": {"type": "integer"},
+          "replayed": {"type": "integer"},
+          "clock": {"type": "string", "enum": ["ok", "skewed", "bogus"]},
+          "clock_skew_seconds": {"type": "number"},
+          "latency_seconds": {"type": "number"},
+          "notify_lag_seconds": {"type": "number"},
+          "motion": {"type": "boolean"},
+          "rssi": {"type": "integer"},
+          "rssi_average": {"type": "number"},
+          "link_quality": {"type": "string"}
+        }
+      },
+      "SensorState": {
+        "type": "object",
+        "properties": {
+          "sensor_id": {"type": "string"},
+          "room": {"type": "string"},
+          "group": {"type": "string"},
+          "tags": {"type": "array", "items": {"type": "string"}},
+          "measurement": {"allOf": [{"$ref": "#/components/schemas/Measurement"}], "nullable": true},
+          "stats": {"$ref": "#/components/schemas/SensorStats"},
+          "average_interval_seconds": {"type": "number"},
+          "diagnostics": {"type": "object", "properties": {"status": {"type": "string"}, "since": {"type": "string", "format": "date-time"}}},
+          "firmware_version": {"type": "string"},
+          "virtual": {"type": "boolean"},
+          "updated": {"type": "object", "additionalProperties": {"type": "string", "format": "date-time"}}
+        }
+      },
+      "SensorConfig": {
+        "type": "object",
+        "description": "A sensor as it is in the config file, only the common settings are listed.",
+        "required": ["serial"],
+        "properties": {
+          "serial": {"type": "string"},
+          "type": {"type": "string"},
+          "name": {"type": "string"},
+          "model": {"type": "string"},
+          "manufacturer": {"type": "string"},
+          "firmware_revision": {"type": "string"},
+          "hardware_revision": {"type": "string"},
+          "hmac_key": {"type": "string"},
+          "room": {"type": "string"},
+          "group": {"type": "string"},
+          "tags": {"type": "array", "items": {"type": "string"}},
+          "ttl": {"type": "integer"},
+          "sentinels": {"type": "array", "items": {"type": "number"}},
+          "precision": {"type": "integer", "minimum": 0, "maximum": 6},
+          "metrics": {"type": "array", "items": {"type": "string"}},
+          "probes": {"type": "object", "additionalProperties": {"type": "string"}},
+          "temperature": {
+            "type": "object",
+            "properties": {
+              "min": {"type": "number"},
+              "max": {"type": "number"},
+              "step": {"type": "number"},
+              "unit": {"type": "string", "enum": ["celsius", "fahrenheit"]}
+            }
+          },
+          "profile": {"type": "string", "enum": ["freezer", "fridge", "frost"]},
+          "setpoint": {"type": "number"},
+          "dry_threshold": {"type": "number"},
+          "noise_threshold": {"type": "number"},
+          "filter": {"type": "boolean"},
+          "filter_threshold": {"type": "number"},
+          "low_level_threshold": {"type": "number"},
+          "high_level_threshold": {"type": "number"},
+          "rssi_threshold": {"type": "integer"},
+          "calibration": {
+            "type": "object",
+            "additionalProperties": {"type": "object", "properties": {"offset": {"type": "number"}, "scale": {"type": "number"}}}
+          },
+          "pipeline": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": ["stage"],
+              "properties": {
+                "stage": {"type": "string", "enum": ["calibrate", "anomaly", "validate", "smooth", "convert", "transform"]},
+                "metrics": {"type": "array", "items": {"type": "string"}},
+                "min": {"type": "number"},
+                "max": {"type": "number"},
+                "alpha": {"type": "number"},
+                "convert": {"type": "string"},
+                "transform": {"type": "string"}
+              }
+            }
+          }
+        },
+        "additionalProperties": true
+      },
+      "AlertRule": {
+        "type": "object",
+        "required": ["name", "metric", "op", "threshold"],
+        "properties": {
+          "name": {"type": "string"},
+          "sensors": {"type": "array", "items": {"type": "string"}},
+          "metric": {"type": "string"},
+          "op": {"type": "string", "enum": [">", ">=", "<", "<="]},
+          "threshold": {"type": "number"},
+          "for": {"type": "integer", "description": "Seconds"},
+          "clear": {"type": "number"},
+          "channels": {"type": "array", "items": {"type": "string", "enum": ["webhook", "telegram", "email"]}}
+        }
+      },
+      "ConfigChange": {
+        "type": "object",
+        "properties": {
+          "section": {"type": "string"},
+          "sensor": {"type": "string"},
+          "change": {"type": "string", "enum": ["added", "removed", "changed"]},
+          "fields": {"type": "array", "items": {"type": "string"}},
+          "restart": {"type": "boolean"}
+        }
+      },
+      "PendingSensor": {
+        "type": "object",
+        "properties": {
+          "sensor_id": {"type": "string"},
+          "mac": {"type": "string"},
+          "address": {"type": "string"},
+          "hmac_key": {"type": "string"},
+          "first_seen": {"type": "string", "format": "date-time"},
+          "last_seen": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Alert": {
+        "type": "object",
+        "properties": {
+          "sensor_id": {"type": "string"},
+          "name": {"type": "string"},
+          "message": {"type": "string"},
+          "since": {"type": "string", "format": "date-time"}
+        }
+      },
+      "AlertEvent": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "sensor_id": {"type": "string"},
+          "name": {"type": "string"},
+          "event": {"type": "string", "enum": ["fired", "resolved"]},
+          "message": {"type": "string"}
+        }
+      },
+      "HomeKitEvent": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "controller": {"type": "string", "description": "Address of the controller"},
+          "event": {"type": "string", "enum": ["read", "subscribe", "unsubscribe", "write", "notify"]},
+          "aid": {"type": "integer"},
+          "iid": {"type": "integer"},
+          "sensor_id": {"type": "string"},
+          "type": {"type": "string", "description": "Type of the characteristic"},
+          "value": {}
+        }
+      },
+      "ParseFailure": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "receiver": {"type": "string"},
+          "address": {"type": "string"},
+          "sensor_id": {"type": "string"},
+          "error": {"type": "string"},
+          "fields": {"type": "array", "items": {"type": "object", "properties": {"field": {"type": "string"}, "problem": {"type": "string"}}}},
+          "payload": {"type": "string"},
+          "accepted": {"type": "boolean"}
+        }
+      },
+      "PacketTrace": {
+        "type": "object",
+        "properties": {
+          "sensor_id": {"type": "string"},
+          "address": {"type": "string"},
+          "until": {"type": "string", "format": "date-time"}
+        }
+      },
+      "QuarantinedSensor": {
+        "type": "object",
+        "properties": {
+          "sensor_id": {"type": "string"},
+          "receiver": {"type": "string"},
+          "address": {"type": "string"},
+          "packets": {"type": "integer"},
+          "first_seen": {"type": "string", "format": "date-time"},
+          "last_seen": {"type": "string", "format": "date-time"},
+          "measurement": {"$ref": "#/components/schemas/Measurement"}
+        }
+      },
+      "Rollup": {
+        "type": "object",
+        "properties": {
+          "sensor_id": {"type": "string"},
+          "name": {"type": "string"},
+          "date": {"type": "string"},
+          "metrics": {
+            "type": "object",
+            "additionalProperties": {
+              "type": "object",
+              "properties": {"min": {"type": "number"}, "max": {"type": "number"}, "mean": {"type": "number"}, "count": {"type": "integer"}}
+            }
+          },
+          "offline": {"type": "integer"},
+          "offline_seconds": {"type": "number"}
+        }
+      }
+    }
+  },
+  "security": [{"bearer": []}, {"basic": []}],
+  "paths": {
+    "/api/v1/sensors": {
+      "get": {
+        "summary": "List sensors",
+        "parameters": [
+          {"name": "room", "in": "query", "schema": {"type": "string"}},
+          {"name": "group", "in": "query", "schema": {"type": "string"}},
+          {"name": "tag", "in": "query", "schema": {"type": "string"}}
+        ],
+        "responses": {"200": {"description": "Sensors", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/SensorState"}}}}}}
+      }
+    },
+    "/api/v1/sensors/{id}": {
+      "get": {
+        "summary": "Get the latest state of a sensor",
+        "parameters": [{"$ref": "#/components/parameters/sensorID"}],
+        "responses": {"200": {"description": "Sensor", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SensorState"}}}}, "404": {"description": "Unknown sensor"}}
+      }
+    },
+    "/api/v1/sensors/{id}/command": {
+      "post": {
+        "summary": "Send a command to a device",
+        "parameters": [{"$ref": "#/components/parameters/sensorID"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "properties": {"on": {"type": "boolean"}, "speed": {"type": "integer"}, "position": {"type": "integer"}}}}}},
+        "responses": {"204": {"description": "Sent"}, "400": {"description": "Invalid command"}, "404": {"description": "Unknown sensor"}, "409": {"description": "The device cannot be reached"}}
+      }
+    },
+    "/api/v1/stream": {
+      "get": {
+        "summary": "Stream measurements as they come in, one JSON object per line",
+        "parameters": [{"name": "sensor", "in": "query", "schema": {"type": "string"}}],
+        "responses": {"200": {"description": "Measurements", "content": {"application/x-ndjson": {"schema": {"$ref": "#/components/schemas/Measurement"}}}}}
+      }
+    },
+    "/api/v1/sensors/{id}/rename": {
+      "post": {
+        "summary": "Rename a sensor",
+        "parameters": [{"$ref": "#/components/parameters/sensorID"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}}}}}},
+        "responses": {"204": {"description": "Renamed"}, "400": {"description": "Unknown sensor or invalid name"}}
+      }
+    },
+    "/api/v1/pending": {
+      "get": {
+        "summary": "List sensors waiting for approval",
+        "responses": {"200": {"description": "Pending sensors", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/PendingSensor"}}}}}}
+      }
+    },
+    "/api/v1/pending/{id}/approve": {
+      "post": {
+        "summary": "Approve a pending sensor",
+        "parameters": [{"$ref": "#/components/parameters/sensorID"}],
+        "requestBody": {"content": {"application/json": {"schema": {"type": "object", "properties": {"name": {"type": "string"}, "model": {"type": "string"}}}}}},
+        "responses": {"200": {"description": "The added sensor", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SensorConfig"}}}}, "400": {"description": "Not pending"}}
+      }
+    },
+    "/api/v1/accessories": {
+      "get": {
+        "summary": "List the HomeKit accessories with their services and characteristics and current values",
+        "responses": {"200": {"description": "The accessories as in the HAP /accessories response", "content": {"application/json": {"schema": {"type": "object"}}}}}
+      }
+    },
+    "/api/v1/homekit/events": {
+      "get": {
+        "summary": "List recent reads, subscriptions, writes and notifications of characteristics by controllers, newest first",
+        "parameters": [{"name": "sensor", "in": "query", "schema": {"type": "string"}, "description": "Only the events of this sensor"}],
+        "responses": {"200": {"description": "Events", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/HomeKitEvent"}}}}}}
+      }
+    },
+    "/api/v1/alerts": {
+      "get": {
+        "summary": "List active alerts",
+        "responses": {"200": {"description": "Alerts", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Alert"}}}}}}
+      }
+    },
+    "/api/v1/alerts/events": {
+      "get": {
+        "summary": "List recent alert events, newest first",
+        "responses": {"200": {"description": "Events", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/AlertEvent"}}}}}}
+      }
+    },
+    "/api/v1/errors": {
+      "get": {
+        "summary": "List recently rejected packets, newest first",
+        "responses": {"200": {"description": "Failures", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ParseFailure"}}}}}}
+      }
+    },
+    "/api/v1/traces": {
+      "get": {
+        "summary": "List the sensors and addresses whose packets are logged in full",
+        "responses": {"200": {"description": "Traces", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/PacketTrace"}}}}}}
+      },
+      "post": {
+        "summary": "Log the full packets of a sensor or source address for a while",
+        "parameters": [
+          {"name": "sensor", "in": "query", "schema": {"type": "string"}},
+          {"name": "address", "in": "query", "description": "IP address packets come from", "schema": {"type": "string"}},
+          {"name": "minutes", "in": "query", "description": "How long to trace, 10 by default", "schema": {"type": "integer"}}
+        ],
+        "responses": {"200": {"description": "Traces", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/PacketTrace"}}}}}, "400": {"description": "Neither or both of sensor and address, or invalid minutes"}}
+      },
+      "delete": {
+        "summary": "Stop the trace of a sensor or address, or all traces",
+        "parameters": [
+          {"name": "sensor", "in": "query", "schema": {"type": "string"}},
+          {"name": "address", "in": "query", "schema": {"type": "string"}}
+        ],
+        "responses": {"200": {"description": "Remaining traces", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/PacketTrace"}}}}}}
+      }
+    },
+    "/api/v1/quarantine": {
+      "get": {
+        "summary": "List unconfigured sensors that sent measurements",
+        "responses": {"200": {"description": "Quarantined sensors", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/QuarantinedSensor"}}}}}}
+      }
+    },
+    "/api/v1/rollups": {
+      "get": {
+        "summary": "Daily lows, highs and averages",
+        "parameters": [{"name": "date", "in": "query", "description": "YYYY-MM-DD, today or yesterday, which is the default", "schema": {"type": "string"}}],
+        "responses": {"200": {"description": "Rollups", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Rollup"}}}}}, "400": {"description": "Invalid date"}}
+      }
+    },
+    "/api/v1/config/sensors": {
+      "get": {
+        "summary": "List configured sensors, with HMAC keys only if secrets is true",
+        "parameters": [{"$ref": "#/components/parameters/secrets"}],
+        "responses": {"200": {"description": "Sensors", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/SensorConfig"}}}}}}
+      },
+      "post": {
+        "summary": "Add a sensor",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SensorConfig"}}}},
+        "responses": {"201": {"description": "Added", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SensorConfig"}}}}, "400": {"description": "Invalid, already configured or the config would not load"}, "500": {"description": "The config could not be written or reloaded"}}
+      }
+    },
+    "/api/v1/config/sensors/{id}": {
+      "get": {
+        "summary": "Get a configured sensor",
+        "parameters": [{"$ref": "#/components/parameters/sensorID"}, {"$ref": "#/components/parameters/secrets"}],
+        "responses": {"200": {"description": "Sensor", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SensorConfig"}}}}, "404": {"description": "Not configured"}}
+      },
+      "put": {
+        "summary": "Replace a sensor, a redacted HMAC key keeps the current one",
+        "parameters": [{"$ref": "#/components/parameters/sensorID"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SensorConfig"}}}},
+        "responses": {"200": {"description": "Updated", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SensorConfig"}}}}, "400": {"description": "Invalid, not configured or the config would not load"}, "500": {"description": "The config could not be written or reloaded"}}
+      },
+      "delete": {
+        "summary": "Remove a sensor",
+        "parameters": [{"$ref": "#/components/parameters/sensorID"}],
+        "responses": {"204": {"description": "Removed"}, "400": {"description": "Not configured or the config would not load"}, "500": {"description": "The config could not be written or reloaded"}}
+      }
+    },
+    "/api/v1/config/alert_rules": {
+      "get": {
+        "summary": "List alert rules",
+        "responses": {"200": {"description": "Rules", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/AlertRule"}}}}}}
+      },
+      "put": {
+        "summary": "Replace all alert rules",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/AlertRule"}}}}},
+        "responses": {"200": {"description": "Updated"}, "400": {"description": "Invalid rules or the config would not load"}, "500": {"description": "The config could not be written or reloaded"}}
+      }
+    },
+    "/api/v1/config/check": {
+      "post": {
+        "summary": "Compare the config file with the running config without applying it",
+        "responses": {"200": {"description": "Changes", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ConfigChange"}}}}}, "422": {"description": "Invalid config file"}}
+      }
+    },
+    "/api/v1/snapshot": {
+      "get": {
+        "summary": "Snapshot of the bridge state for debugging",
+        "responses": {"200": {"description": "Snapshot", "content": {"application/json": {"schema": {"type": "object"}}}}}
+      }
+    },
+    "/api/v1/replica": {
+      "get": {
+        "summary": "State for the standby of a high availability pair, includes the HomeKit keys of the leader",
+        "responses": {"200": {"description": "Replica", "content": {"application/json": {"schema": {"type": "object"}}}}}
+      }
+    },
+    "/metrics": {
+      "get": {
+        "summary": "Prometheus metrics",
+        "responses": {"200": {"description": "Metrics", "content": {"text/plain": {"schema": {"type": "string"}}}}}
+      }
+    },
+    "/healthz": {
+      "get": {
+        "summary": "Liveness",
+        "security": [],
+        "responses": {"200": {"description": "Alive"}, "503": {"description": "Not alive"}}
+      }
+    },
+    "/readyz": {
+      "get": {
+        "summary": "Readiness",
+        "security": [],
+        "responses": {"200": {"description": "Ready"}, "503": {"description": "Not ready"}}
+      }
+    }
+  }
+}
+`
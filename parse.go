@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// FieldError is a problem with a single field of a packet. Nested fields are
+// named by their path, like measurement_data.humidity.
+type FieldError struct {
+	Field   string `json:"field"`
+	Problem string `json:"problem"`
+}
+
+type ParseError struct {
+	Fields []FieldError
+}
+
+func (e *ParseError) Error() string {
+	var problems []string
+	for _, field := range e.Fields {
+		problems = append(problems, fmt.Sprintf("%s (%s)", field.Field, field.Problem))
+	}
+	return "invalid fields: " + strings.Join(problems, ", ")
+}
+
+// requiredFields must be present in strict mode. Lenient mode only needs to
+// know which sensor a packet is from.
+var (
+	strictRequiredFields  = map[string]bool{"sensor_id": true, "measurement_id": true, "measurement_data": true}
+	lenientRequiredFields = map[string]bool{"sensor_id": true}
+)
+
+// unmarshal decodes payload into v according to the parsing mode of a
+// receiver. The default mode behaves like json.Unmarshal. Strict mode rejects
+// unknown, missing and invalid fields; lenient mode skips invalid fields and
+// returns them as problems.
+func unmarshal(mode string, payload []byte, v interface{}) ([]FieldError, error) {
+	switch mode {
+	case "":
+		return nil, json.Unmarshal(payload, v)
+	case "strict":
+		if problems := decodeFields(payload, reflect.ValueOf(v).Elem(), "", true, strictRequiredFields); len(problems) != 0 {
+			return nil, &ParseError{Fields: problems}
+		}
+		return nil, nil
+	case "lenient":
+		problems := decodeFields(payload, reflect.ValueOf(v).Elem(), "", false, lenientRequiredFields)
+		for _, problem := range problems {
+			if problem.Problem == "missing" || problem.Field == "" {
+				return nil, &ParseError{Fields: problems}
+			}
+		}
+		return problems, nil
+	default:
+		return nil, fmt.Errorf("unknown parsing mode <%s>", mode)
+	}
+}
+
+// decodeFields decodes a JSON object one field at a time, so that a bad value
+// only affects its own field.
+func decodeFields(payload []byte, v reflect.Value, prefix string, strict bool, required map[string]bool) []FieldError {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &object); err != nil {
+		return []FieldError{{Field: prefix, Problem: "not an object"}}
+	}
+
+	var problems []FieldError
+	known := map[string]bool{}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		known[name] = true
+
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+
+		raw, ok := object[name]
+		if !ok {
+			if required[path] {
+				problems = append(problems, FieldError{Field: path, Problem: "missing"})
+			}
+			continue
+		}
+
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			problems = append(problems, decodeFields(raw, field, path, strict, required)...)
+			continue
+		}
+
+		value := reflect.New(field.Type())
+		if err := json.Unmarshal(raw, value.Interface()); err != nil {
+			problems = append(problems, FieldError{Field: path, Problem: "invalid"})
+			continue
+		}
+		field.Set(value.Elem())
+	}
+
+	if strict {
+		var unknown []string
+		for name := range object {
+			// Every packet may say what it is
+			if !known[name] && !(prefix == "" && name == "type") {
+				unknown = append(unknown, name)
+			}
+		}
+		sort.Strings(unknown)
+		for _, name := range unknown {
+			path := name
+			if prefix != "" {
+				path = prefix + "." + name
+			}
+			problems = append(problems, FieldError{Field: path, Problem: "unknown"})
+		}
+	}
+
+	return problems
+}
+
+// Limits on what a single packet can make the bridge keep, beyond its size.
+const (
+	maxIDLength  = 64
+	maxMapValues = 32
+)
+
+// checkLimits rejects measurements with IDs or maps of values that are
+// larger than any sensor has reason to send.
+func checkLimits(m Measurement) error {
+	if len(m.SensorID) > maxIDLength || len(m.MeasurementID) > maxIDLength {
+		return fmt.Errorf("IDs can be at most %d bytes", maxIDLength)
+	}
+	data := m.MeasurementData
+	if len(data.Raw) > maxMapValues || len(data.Probes) > maxMapValues || len(data.Metrics) > maxMapValues {
+		return fmt.Errorf("at most %d raw values, probes or metrics", maxMapValues)
+	}
+	return nil
+}
+
+// ParseFailure is a packet that could not be decoded or was rejected, or that
+// was decoded with fields dropped in lenient mode.
+type ParseFailure struct {
+	Time     time.Time    `json:"time"`
+	Receiver string       `json:"receiver"`
+	Address  string       `json:"address"`
+	SensorID string       `json:"sensor_id,omitempty"`
+	Error    string       `json:"error"`
+	Fields   []FieldError `json:"fields,omitempty"`
+	Payload  string       `json:"payload"`
+	Accepted bool         `json:"accepted"`
+}
+
+// maxFailurePayload is how much of a payload is kept with a failure.
+const maxFailurePayload = 256
+
+func newParseFailure(p packet, err error) ParseFailure {
+	failure := ParseFailure{
+		Time:     clock.Now(),
+		Receiver: p.receiver.Tag,
+		Address:  p.address.String(),
+		Error:    err.Error(),
+	}
+
+	truncated := p.payload
+	if len(truncated) > maxFailurePayload {
+		truncated = truncated[:maxFailurePayload]
+	}
+	// Binary payloads are shown as hex
+	if utf8.Valid(truncated) {
+		failure.Payload = string(truncated)
+	} else {
+		failure.Payload = hex.EncodeToString(truncated)
+	}
+	if len(truncated) < len(p.payload) {
+		failure.Payload += "..."
+	}
+
+	// The packet may still tell us which sensor sent it
+	failure.SensorID = packetSender(p)
+
+	if parseError, ok := err.(*ParseError); ok {
+		failure.Fields = parseError.Fields
+	}
+
+	return failure
+}
+
+// packetJSON returns the payload of a packet as JSON, without its signature.
+func packetJSON(p packet) ([]byte, error) {
+	signed, _ := splitSignature(p.payload)
+	if decompressed, err := decompress(signed, p.receiver.MaxDecompressedSize); err == nil {
+		signed = decompressed
+	}
+	payload, _, err := transcode(p.receiver.Encoding, signed)
+	return payload, err
+}
+
+// packetSender returns the sensor a packet claims to be from, if it can be
+// decoded at all.
+func packetSender(p packet) string {
+	var sender struct {
+		SensorID string `json:"sensor_id"`
+	}
+	if payload, err := packetJSON(p); err == nil && json.Unmarshal(payload, &sender) == nil {
+		return sender.SensorID
+	}
+	return ""
+}
+
+func recordFailure(p packet, err error) {
+	parseFailures.Add(newParseFailure(p, err))
+}
+
+// defaultRecentErrors is how many recent failures are kept for the API.
+const defaultRecentErrors = 100
+
+type ParseFailures struct {
+	mutex   sync.Mutex
+	size    int
+	recent  []ParseFailure
+	byField map[FieldError]uint64
+}
+
+var parseFailures = &ParseFailures{size: defaultRecentErrors, byField: map[FieldError]uint64{}}
+
+// SetSize sets how many recent failures are kept.
+func (f *ParseFailures) SetSize(size int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if size > 0 {
+		f.size = size
+	}
+}
+
+func (f *ParseFailures) Add(failure ParseFailure) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.recent = append(f.recent, failure)
+	if len(f.recent) > f.size {
+		f.recent = f.recent[len(f.recent)-f.size:]
+	}
+
+	for _, field := range failure.Fields {
+		f.byField[field]++
+	}
+}
+
+// List returns the recent failures, newest first.
+func (f *ParseFailures) List() []ParseFailure {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	list := make([]ParseFailure, 0, len(f.recent))
+	for i := len(f.recent) - 1; i >= 0; i-- {
+		list = append(list, f.recent[i])
+	}
+	return list
+}
+
+func (f *ParseFailures) FieldCounts() map[FieldError]uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	counts := map[FieldError]uint64{}
+	for field, count := range f.byField {
+		counts[field] = count
+	}
+	return counts
+}
+
+func handleErrors(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(parseFailures.List()); err != nil {
+		log.Println("Failed to encode parse errors: ", err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+)
+
+// FuzzDecodeMeasurement decodes JSON payloads in every format and parsing
+// mode. Decoding may fail, but what it accepts passes the limits or is
+// rejected by them, never anything in between. The seeds are in
+// testdata/fuzz/FuzzDecodeMeasurement.
+func FuzzDecodeMeasurement(f *testing.F) {
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		for _, format := range []string{"json", "legacy"} {
+			for _, parsing := range []string{"", "strict", "lenient"} {
+				measurement, _, err := decodeMeasurement(ReceiverConfig{Format: format, Parsing: parsing}, payload)
+				if err != nil || checkLimits(measurement) != nil {
+					continue
+				}
+				if len(measurement.SensorID) > maxIDLength || len(measurement.MeasurementID) > maxIDLength {
+					t.Fatalf("%s/%s: accepted IDs of %d and %d bytes", format, parsing, len(measurement.SensorID), len(measurement.MeasurementID))
+				}
+				data := measurement.MeasurementData
+				if len(data.Raw) > maxMapValues || len(data.Probes) > maxMapValues || len(data.Metrics) > maxMapValues {
+					t.Fatalf("%s/%s: accepted %d raw values, %d probes and %d metrics", format, parsing, len(data.Raw), len(data.Probes), len(data.Metrics))
+				}
+			}
+		}
+	})
+}
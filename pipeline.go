@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Stage is one step in processing a measurement before it is stored. A stage
+// that returns an error rejects the measurement.
+type Stage func(Measurement) (Measurement, error)
+
+// StageConfig configures a stage of the pipeline of a sensor:
+//
+//	calibrate  applies the calibration of the sensor
+//	anomaly    drops values the anomaly settings of the sensor find anomalous
+//	validate   rejects measurements with values outside of Min and Max
+//	smooth     replaces values with a moving average, weighing new ones Alpha
+//	convert    converts values with Convert, like "fahrenheit_to_celsius"
+//	transform  sets a value with Transform, like "watts = voltage * current"
+//
+// Metrics limits the stage to the given values, by default it applies to all.
+type StageConfig struct {
+	Stage     string   `json:"stage"`
+	Metrics   []string `json:"metrics,omitempty"`
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+	Alpha     float64  `json:"alpha,omitempty"`
+	Convert   string   `json:"convert,omitempty"`
+	Transform string   `json:"transform,omitempty"`
+}
+
+const defaultSmoothingAlpha = 0.3
+
+var conversions = map[string]func(float64) float64{
+	"fahrenheit_to_celsius": func(v float64) float64 { return (v - 32) * 5 / 9 },
+	"celsius_to_fahrenheit": func(v float64) float64 { return v*9/5 + 32 },
+	"kelvin_to_celsius":     func(v float64) float64 { return v - 273.15 },
+	"pa_to_hpa":             func(v float64) float64 { return v / 100 },
+	"inhg_to_hpa":           func(v float64) float64 { return v * 33.8639 },
+}
+
+// pipeline returns the stages a measurement of the sensor goes through. Sensors
+// without a pipeline are calibrated and then checked for anomalies.
+func (c SensorConfig) pipeline() ([]Stage, error) {
+	configs := c.Pipeline
+	if len(configs) == 0 {
+		configs = []StageConfig{{Stage: "calibrate"}}
+		if c.Anomaly != nil {
+			configs = append(configs, StageConfig{Stage: "anomaly"})
+		}
+	}
+
+	stages := make([]Stage, 0, len(configs))
+	for i, config := range configs {
+		for _, metric := range config.Metrics {
+			if !isNumericMetric(metric) {
+				return nil, fmt.Errorf("stage %d (%s): unknown metric <%s>", i+1, config.Stage, metric)
+			}
+		}
+		stage, err := c.stage(config)
+		if err != nil {
+			return nil, fmt.Errorf("stage %d (%s): %v", i+1, config.Stage, err)
+		}
+		stages = append(stages, named(config.Stage, stage))
+	}
+	return stages, nil
+}
+
+func (c SensorConfig) stage(config StageConfig) (Stage, error) {
+	switch config.Stage {
+	case "calibrate":
+		return func(m Measurement) (Measurement, error) {
+			calibrate(c.Calibration, &m.MeasurementData)
+			return m, nil
+		}, nil
+	case "anomaly":
+		anomaly := AnomalyConfig{}
+		if c.Anomaly != nil {
+			anomaly = *c.Anomaly
+		}
+		if len(config.Metrics) != 0 {
+			anomaly.Metrics = config.Metrics
+		}
+		return func(m Measurement) (Measurement, error) {
+			if dropped := anomalies.Check(anomaly, &m); len(dropped) != 0 {
+				log.Printf("[!] %s: Dropped anomalous %s", m.SensorID, strings.Join(dropped, ", "))
+			}
+			return m, nil
+		}, nil
+	case "validate":
+		if config.Min == nil && config.Max == nil {
+			return nil, fmt.Errorf("needs a min or a max")
+		}
+		return func(m Measurement) (Measurement, error) {
+			var err error
+			mapValues(&m.MeasurementData, config.Metrics, func(name string, value float64) float64 {
+				if err == nil && (config.Min != nil && value < *config.Min || config.Max != nil && value > *config.Max) {
+					err = fmt.Errorf("%s <%g> is out of range", name, value)
+				}
+				return value
+			})
+			return m, err
+		}, nil
+	case "smooth":
+		alpha := config.Alpha
+		if alpha == 0 {
+			alpha = defaultSmoothingAlpha
+		}
+		if alpha < 0 || alpha > 1 {
+			return nil, fmt.Errorf("alpha must be between 0 and 1")
+		}
+		return func(m Measurement) (Measurement, error) {
+			mapValues(&m.MeasurementData, config.Metrics, func(name string, value float64) float64 {
+				return smoother.smooth(m.SensorID+"/"+name, value, alpha)
+			})
+			return m, nil
+		}, nil
+	case "convert":
+		convert, ok := conversions[config.Convert]
+		if !ok {
+			return nil, fmt.Errorf("unknown conversion <%s>", config.Convert)
+		}
+		if len(config.Metrics) == 0 {
+			return nil, fmt.Errorf("needs the metrics to convert")
+		}
+		return func(m Measurement) (Measurement, error) {
+			mapValues(&m.MeasurementData, config.Metrics, func(name string, value float64) float64 {
+				return convert(value)
+			})
+			return m, nil
+		}, nil
+	case "transform":
+		transform, err := parseTransform(config.Transform)
+		if err != nil {
+			return nil, err
+		}
+		return func(m Measurement) (Measurement, error) {
+			return m, transform.Apply(&m.MeasurementData)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown stage")
+}
+
+func named(name string, stage Stage) Stage {
+	return func(m Measurement) (Measurement, error) {
+		m, err := stage(m)
+		if err != nil {
+			return m, fmt.Errorf("%s: %v", name, err)
+		}
+		return m, nil
+	}
+}
+
+// runPipeline passes a measurement through the stages in order.
+func runPipeline(stages []Stage, m Measurement) (Measurement, error) {
+	for _, stage := range stages {
+		var err error
+		if m, err = stage(m); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+// mapValues replaces the decimal values of a measurement, or only those of
+// the given metrics, with what fn returns for them.
+func mapValues(data *MeasurementData, metrics []string, fn func(name string, value float64) float64) {
+	v := reflect.ValueOf(data).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() != reflect.Ptr || field.IsNil() || field.Elem().Kind() != reflect.Float32 {
+			continue
+		}
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if len(metrics) != 0 && !contains(metrics, name) {
+			continue
+		}
+		// The measurement may share its values with others
+		value := float32(fn(name, field.Elem().Float()))
+		field.Set(reflect.ValueOf(&value))
+	}
+	if len(data.Metrics) != 0 {
+		values := map[string]float64{}
+		for name, value := range data.Metrics {
+			if isDeclaredMetric(name) && (len(metrics) == 0 || contains(metrics, name)) {
+				value = fn(name, value)
+			}
+			values[name] = value
+		}
+		data.Metrics = values
+	}
+}
+
+// Smoother keeps the moving averages of the smooth stage.
+type Smoother struct {
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+var smoother = &Smoother{values: map[string]float64{}}
+
+func (s *Smoother) smooth(key string, value, alpha float64) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if average, ok := s.values[key]; ok {
+		value = average + alpha*(value-average)
+	}
+	s.values[key] = value
+	return value
+}
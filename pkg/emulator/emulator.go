@@ -0,0 +1,204 @@
+// Package emulator emulates a fleet of sensors that report to a bridge over
+// UDP, the way the firmware does, so that a bridge can be tested with more
+// sensors than there is hardware for. Reports can be late, lost and carry a
+// skewed clock.
+package emulator
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Config describes the emulated sensors. Each sensor reports every Interval,
+// give or take up to Jitter, and loses a Loss fraction of its reports. Every
+// sensor gets its own clock that is off by up to ClockSkew either way. Key,
+// when set, is the hex HMAC key the reports are signed with. Seed makes the
+// randomness repeatable.
+type Config struct {
+	Target    string
+	Sensors   int
+	Prefix    string
+	Interval  time.Duration
+	Jitter    time.Duration
+	Loss      float64
+	ClockSkew time.Duration
+	Key       string
+	Seed      int64
+}
+
+// Stats counts the reports of all sensors. Lost reports were dropped on
+// purpose, Failed ones could not be sent.
+type Stats struct {
+	Sent   uint64
+	Lost   uint64
+	Failed uint64
+}
+
+// Emulator sends the reports of the sensors of a Config.
+type Emulator struct {
+	config Config
+	key    []byte
+
+	mutex sync.Mutex
+	stats Stats
+}
+
+type measurementData struct {
+	Temperature float32 `json:"temperature"`
+	Humidity    float32 `json:"humidity"`
+}
+
+type measurement struct {
+	SensorID        string          `json:"sensor_id"`
+	SensorTime      int64           `json:"sensor_time"`
+	MeasurementID   string          `json:"measurement_id"`
+	Sequence        uint32          `json:"sequence"`
+	MeasurementData measurementData `json:"measurement_data"`
+}
+
+// New checks a Config and returns an Emulator for it.
+func New(config Config) (*Emulator, error) {
+	if config.Target == "" {
+		return nil, errors.New("no target")
+	}
+	if config.Sensors <= 0 {
+		return nil, errors.New("the number of sensors must be positive")
+	}
+	if config.Interval <= 0 {
+		return nil, errors.New("the interval must be positive")
+	}
+	if config.Jitter < 0 || config.Jitter >= config.Interval {
+		return nil, errors.New("the jitter must be less than the interval")
+	}
+	if config.Loss < 0 || config.Loss > 1 {
+		return nil, errors.New("the loss must be between 0 and 1")
+	}
+	if config.Prefix == "" {
+		config.Prefix = "emulator"
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+
+	e := &Emulator{config: config}
+	if config.Key != "" {
+		key, err := hex.DecodeString(config.Key)
+		if err != nil {
+			return nil, errors.New("invalid hmac key")
+		}
+		e.key = key
+	}
+	return e, nil
+}
+
+// SensorIDs returns the IDs the sensors report with.
+func (e *Emulator) SensorIDs() []string {
+	ids := make([]string, e.config.Sensors)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%s-%03d", e.config.Prefix, i)
+	}
+	return ids
+}
+
+// Stats returns the counts so far.
+func (e *Emulator) Stats() Stats {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.stats
+}
+
+// Run sends reports until ctx is done. The sensors start spread out over the
+// first interval, like a fleet that was not switched on all at once.
+func (e *Emulator) Run(ctx context.Context) error {
+	conn, err := net.Dial("udp", e.config.Target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+	for i, id := range e.SensorIDs() {
+		wg.Add(1)
+		go func(id string, r *rand.Rand) {
+			defer wg.Done()
+			e.runSensor(ctx, conn, id, r)
+		}(id, rand.New(rand.NewSource(e.config.Seed+int64(i))))
+	}
+	wg.Wait()
+	return nil
+}
+
+func (e *Emulator) runSensor(ctx context.Context, conn net.Conn, id string, r *rand.Rand) {
+	skew := time.Duration((2*r.Float64() - 1) * float64(e.config.ClockSkew))
+	temperature := 15 + r.Float64()*10
+	humidity := 40 + r.Float64()*20
+
+	timer := time.NewTimer(time.Duration(r.Int63n(int64(e.config.Interval))))
+	defer timer.Stop()
+
+	for seq := 1; ; seq++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		// The values drift slowly, like a real room
+		temperature += (r.Float64() - 0.5) * 0.2
+		humidity += (r.Float64() - 0.5) * 0.5
+
+		if r.Float64() < e.config.Loss {
+			e.count(func(s *Stats) { s.Lost++ })
+		} else if err := e.send(conn, measurement{
+			SensorID:      id,
+			SensorTime:    time.Now().Add(skew).Unix(),
+			MeasurementID: fmt.Sprintf("%d", seq),
+			Sequence:      uint32(seq),
+			MeasurementData: measurementData{
+				Temperature: float32(temperature),
+				Humidity:    float32(humidity),
+			},
+		}); err != nil {
+			e.count(func(s *Stats) { s.Failed++ })
+		} else {
+			e.count(func(s *Stats) { s.Sent++ })
+		}
+
+		next := e.config.Interval
+		if e.config.Jitter > 0 {
+			next += time.Duration((2*r.Float64() - 1) * float64(e.config.Jitter))
+		}
+		timer.Reset(next)
+	}
+}
+
+func (e *Emulator) count(fn func(*Stats)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	fn(&e.stats)
+}
+
+// send writes a report, signed the way the firmware does it: the hex
+// HMAC-SHA256 of the payload after a newline.
+func (e *Emulator) send(conn net.Conn, m measurement) error {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if e.key != nil {
+		mac := hmac.New(sha256.New, e.key)
+		mac.Write(payload)
+		payload = append(append(payload, '\n'), hex.EncodeToString(mac.Sum(nil))...)
+	}
+	_, err = conn.Write(payload)
+	return err
+}
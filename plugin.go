@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Decoder plugins turn payloads in formats the bridge does not know into
+// JSON. A plugin is a program that reads one base64 encoded payload per line
+// on stdin and writes one JSON packet, or {"error": "..."}, per line on
+// stdout. A receiver uses a plugin by naming it as its encoding. Plugins
+// compiled to WebAssembly run under a WASI runtime, like
+// ["wasmtime", "decoder.wasm"].
+type DecoderConfig struct {
+	Command []string `json:"command"`
+	Timeout int      `json:"timeout,omitempty"`
+}
+
+const defaultDecoderTimeout = 2 * time.Second
+
+var errDecoderTimeout = errors.New("decoder timed out")
+
+// Decoder is a running plugin. It is started on the first payload and
+// restarted when it exits or stops answering.
+type Decoder struct {
+	mutex   sync.Mutex
+	name    string
+	config  DecoderConfig
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	replies chan []byte
+	done    chan struct{}
+}
+
+var decoders = map[string]*Decoder{}
+
+func configureDecoders(configs map[string]DecoderConfig) error {
+	for name, config := range configs {
+		switch name {
+		case "", "json", "cbor", "msgpack", "auto":
+			return fmt.Errorf("decoder <%s> has the name of a built-in encoding", name)
+		}
+		if len(config.Command) == 0 {
+			return fmt.Errorf("decoder <%s> has no command", name)
+		}
+		decoders[name] = &Decoder{name: name, config: config}
+	}
+	return nil
+}
+
+func (d *Decoder) start() error {
+	cmd := exec.Command(d.config.Command[0], d.config.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	replies, done := make(chan []byte), make(chan struct{})
+	go func() {
+		defer cmd.Wait()
+		defer close(replies)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			select {
+			case replies <- append([]byte(nil), scanner.Bytes()...):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	log.Printf("[*] Started decoder <%s>", d.name)
+	d.cmd, d.stdin, d.replies, d.done = cmd, stdin, replies, done
+	return nil
+}
+
+func (d *Decoder) stop() {
+	if d.cmd != nil {
+		close(d.done)
+		d.stdin.Close()
+		d.cmd.Process.Kill()
+		d.cmd = nil
+	}
+}
+
+// Decode has the plugin turn a payload into JSON.
+func (d *Decoder) Decode(payload []byte) ([]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.cmd == nil {
+		if err := d.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	line := base64.StdEncoding.EncodeToString(payload) + "\n"
+	if _, err := io.WriteString(d.stdin, line); err != nil {
+		d.stop()
+		return nil, err
+	}
+
+	timeout := defaultDecoderTimeout
+	if d.config.Timeout > 0 {
+		timeout = time.Duration(d.config.Timeout) * time.Second
+	}
+
+	select {
+	case reply, ok := <-d.replies:
+		if !ok {
+			d.stop()
+			return nil, fmt.Errorf("decoder exited")
+		}
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(reply, &failure) == nil && failure.Error != "" {
+			return nil, errors.New(failure.Error)
+		}
+		return bytes.TrimSpace(reply), nil
+	case <-time.After(timeout):
+		// A late reply would be taken for the next payload
+		d.stop()
+		return nil, errDecoderTimeout
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// homeKitValue turns a value of a sensor into what HomeKit gets. Values are
+// float32, which HomeKit would get as 21.399999618530273 for 21.4, so they
+// go through their shortest decimal form first. With a precision the value
+// is rounded to that many decimals.
+func (c SensorConfig) homeKitValue(value float32) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(value), 'g', -1, 32), 64)
+	if c.Precision == nil {
+		return v
+	}
+	scale := math.Pow(10, float64(*c.Precision))
+	return math.Round(v*scale) / scale
+}
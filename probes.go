@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
+
+// addProbeServices adds a temperature service for each of the probes of a
+// sensor that has several, named like "Garden Soil" for {"soil": "Soil"}.
+// Probes can also be their own accessory with a source that has a probe.
+func addProbeServices(config SensorConfig, ac *accessory.Accessory) {
+	var probes []string
+	for probe := range config.Probes {
+		probes = append(probes, probe)
+	}
+	sort.Strings(probes)
+
+	for _, probe := range probes {
+		probe := probe
+
+		probeSensor := service.NewTemperatureSensor()
+		addServiceName(config, probeSensor.Service, config.Probes[probe])
+		configureTemperature(config.Temperature, probeSensor.CurrentTemperature, nil)
+
+		statusActive := characteristic.NewStatusActive()
+		probeSensor.AddCharacteristic(statusActive.Characteristic)
+
+		probeSensor.CurrentTemperature.OnValueGet(func() interface{} {
+			if measurement, ok := store.Latest(config.Serial); ok {
+				if temperature, ok := measurement.MeasurementData.Probes[probe]; ok {
+					statusActive.UpdateValue(true)
+					return config.homeKitValue(temperature)
+				}
+			}
+			statusActive.UpdateValue(false)
+			return 0.0
+		})
+
+		onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+			if temperature, ok := measurement.MeasurementData.Probes[probe]; ok {
+				probeSensor.CurrentTemperature.UpdateValue(config.homeKitValue(temperature))
+			}
+		})
+
+		ac.AddService(probeSensor.Service)
+	}
+}
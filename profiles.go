@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
+
+// profile is a built-in alert rule for a common use of a temperature sensor.
+// The alert resolves once the temperature is Margin back past the setpoint.
+type profile struct {
+	op       string
+	setpoint float64
+	margin   float64
+	seconds  int
+}
+
+// A freezer or fridge door that is left open takes a while to warm up, so
+// these only alert once the temperature stays up for half an hour.
+var profiles = map[string]profile{
+	"freezer": {op: ">", setpoint: -12, margin: 3, seconds: 30 * 60},
+	"fridge":  {op: ">", setpoint: 7, margin: 2, seconds: 30 * 60},
+	"frost":   {op: "<", setpoint: 2, margin: 1, seconds: 10 * 60},
+}
+
+// profileRules returns the alert rule of the profile of a sensor, if it has
+// one. The rule is named after the profile.
+func (c SensorConfig) profileRules() ([]AlertRule, error) {
+	if c.Profile == "" {
+		return nil, nil
+	}
+
+	p, ok := profiles[c.Profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile <%s>", c.Profile)
+	}
+
+	setpoint := p.setpoint
+	if c.Setpoint != nil {
+		setpoint = *c.Setpoint
+	}
+	clear := setpoint - p.margin
+	if p.op == "<" {
+		clear = setpoint + p.margin
+	}
+
+	return []AlertRule{{
+		Name:      c.Profile,
+		Sensors:   []string{c.Serial},
+		Metric:    "temperature",
+		Op:        p.op,
+		Threshold: setpoint,
+		For:       p.seconds,
+		Clear:     &clear,
+	}}, nil
+}
+
+// addProfileAlarm adds a contact sensor that opens while the alert of the
+// profile of the sensor is active, so that it can drive HomeKit automations
+// and notifications.
+func addProfileAlarm(config SensorConfig, ac *accessory.Accessory) {
+	if config.Profile == "" {
+		return
+	}
+
+	alarm := service.NewContactSensor()
+	addServiceName(config, alarm.Service, "Alarm")
+	alarm.ContactSensorState.SetValue(characteristic.ContactSensorStateContactDetected)
+
+	alerts.OnChange(config.Serial, config.Profile, func(active bool) {
+		if active {
+			alarm.ContactSensorState.SetValue(characteristic.ContactSensorStateContactNotDetected)
+		} else {
+			alarm.ContactSensorState.SetValue(characteristic.ContactSensorStateContactDetected)
+		}
+	})
+
+	ac.AddService(alarm.Service)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ProvisioningConfig struct {
+	Enabled        bool `json:"enabled"`
+	ReportInterval int  `json:"report_interval"`
+}
+
+type Hello struct {
+	Type string `json:"type"`
+	MAC  string `json:"mac"`
+}
+
+type Welcome struct {
+	Type           string `json:"type"`
+	SensorID       string `json:"sensor_id"`
+	ReportInterval int    `json:"report_interval"`
+	HMACKey        string `json:"hmac_key,omitempty"`
+}
+
+type PendingSensor struct {
+	SensorID  string    `json:"sensor_id"`
+	MAC       string    `json:"mac"`
+	Address   string    `json:"address"`
+	HMACKey   string    `json:"hmac_key,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type PendingSensors struct {
+	mutex   sync.Mutex
+	path    string
+	sensors map[string]PendingSensor
+}
+
+var pendingSensors = &PendingSensors{
+	path:    filepath.Join(storagePath, "pending-sensors.json"),
+	sensors: map[string]PendingSensor{},
+}
+
+func (p *PendingSensors) Load() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	encoded, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var sensors []PendingSensor
+	if err := json.Unmarshal(encoded, &sensors); err != nil {
+		return err
+	}
+
+	for _, sensor := range sensors {
+		p.sensors[sensor.SensorID] = sensor
+	}
+
+	return nil
+}
+
+func (p *PendingSensors) List() []PendingSensor {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.list()
+}
+
+func (p *PendingSensors) Get(sensorID string) (PendingSensor, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	sensor, ok := p.sensors[sensorID]
+	return sensor, ok
+}
+
+func (p *PendingSensors) Remove(sensorID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.sensors, sensorID)
+	return p.save()
+}
+
+func (p *PendingSensors) list() []PendingSensor {
+	sensors := []PendingSensor{}
+	for _, sensor := range p.sensors {
+		sensors = append(sensors, sensor)
+	}
+	sort.Slice(sensors, func(i, j int) bool {
+		return sensors[i].SensorID < sensors[j].SensorID
+	})
+	return sensors
+}
+
+func (p *PendingSensors) save() error {
+	encoded, err := json.MarshalIndent(p.list(), "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p.path, encoded, 0600)
+}
+
+// Register records a sensor that said hello, or refreshes it if we have
+// already seen it. The same HMAC key is handed out every time so that a sensor
+// that missed our welcome can simply try again.
+func (p *PendingSensors) Register(mac string, address net.Addr) (PendingSensor, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	sensorID, err := sensorIDFromMAC(mac)
+	if err != nil {
+		return PendingSensor{}, err
+	}
+	now := clock.Now()
+
+	sensor, ok := p.sensors[sensorID]
+	if !ok {
+		key, err := generateHMACKey()
+		if err != nil {
+			return PendingSensor{}, err
+		}
+		sensor = PendingSensor{
+			SensorID:  sensorID,
+			MAC:       mac,
+			HMACKey:   key,
+			FirstSeen: now,
+		}
+		log.Printf("[*] New sensor <%s> is awaiting approval", sensorID)
+	}
+
+	sensor.Address = address.String()
+	sensor.LastSeen = now
+	p.sensors[sensorID] = sensor
+
+	return sensor, p.save()
+}
+
+// sensorIDFromMAC turns a MAC address, with or without separators, into the
+// sensor ID. Only 48 and 64 bit addresses are accepted.
+func sensorIDFromMAC(mac string) (string, error) {
+	sensorID := strings.ToLower(strings.NewReplacer(":", "", "-", "").Replace(mac))
+	if _, err := hex.DecodeString(sensorID); err != nil || (len(sensorID) != 12 && len(sensorID) != 16) {
+		return "", fmt.Errorf("invalid MAC <%s>", mac)
+	}
+	return sensorID, nil
+}
+
+func generateHMACKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func processHello(config Config, p packet, payload []byte) error {
+	if !config.Provisioning.Enabled {
+		return nil
+	}
+
+	var hello Hello
+	if err := json.Unmarshal(payload, &hello); err != nil {
+		return err
+	}
+
+	sensorID, err := sensorIDFromMAC(hello.MAC)
+	if err != nil {
+		return err
+	}
+
+	welcome := Welcome{
+		Type:           "welcome",
+		SensorID:       sensorID,
+		ReportInterval: config.Provisioning.ReportInterval,
+	}
+
+	// Sensors that are already configured just get their settings back, but
+	// never their key: the MAC is no secret, it is in every packet they send
+	if _, ok := config.Bridge.sensor(sensorID); !ok {
+		pending, err := pendingSensors.Register(hello.MAC, p.address)
+		if err != nil {
+			return err
+		}
+		audit(auditPairingRequested, pending.SensorID, p.address.String(), "mac "+hello.MAC)
+		welcome.HMACKey = pending.HMACKey
+	}
+
+	encodedWelcome, err := json.Marshal(welcome)
+	if err != nil {
+		return err
+	}
+
+	return p.reply(encodedWelcome)
+}
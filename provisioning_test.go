@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// usePendingSensors starts a test without pending sensors, stored in a
+// directory of its own.
+func usePendingSensors(t *testing.T) {
+	inTempDir(t)
+	previous := pendingSensors
+	pendingSensors = &PendingSensors{path: previous.path, sensors: map[string]PendingSensor{}}
+	t.Cleanup(func() { pendingSensors = previous })
+}
+
+func hello(config Config, mac string) (Welcome, error) {
+	var welcome Welcome
+	p := packet{
+		address: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000},
+		reply: func(b []byte) error {
+			return json.Unmarshal(b, &welcome)
+		},
+	}
+	payload, _ := json.Marshal(Hello{Type: "hello", MAC: mac})
+	return welcome, processHello(config, p, payload)
+}
+
+func TestHelloNeverRevealsConfiguredKey(t *testing.T) {
+	usePendingSensors(t)
+	config := Config{Provisioning: ProvisioningConfig{Enabled: true}}
+	config.Bridge.Sensors = []SensorConfig{{Serial: "f008d1d4092c", HMACKey: "secret"}}
+
+	welcome, err := hello(config, "F0:08:D1:D4:09:2C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if welcome.SensorID != "f008d1d4092c" || welcome.HMACKey != "" {
+		t.Fatalf("unexpected welcome %+v", welcome)
+	}
+
+	// A new sensor gets the key it is to sign with once approved
+	welcome, err = hello(config, "f0-08-d1-d4-09-2d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if welcome.SensorID != "f008d1d4092d" || welcome.HMACKey == "" {
+		t.Fatalf("unexpected welcome %+v", welcome)
+	}
+}
+
+func TestHelloRejectsInvalidMAC(t *testing.T) {
+	usePendingSensors(t)
+	config := Config{Provisioning: ProvisioningConfig{Enabled: true}}
+
+	for _, mac := range []string{"", "f0:08", "zz:08:d1:d4:09:2c", "f0:08:d1:d4:09:2c:00"} {
+		if _, err := hello(config, mac); err == nil {
+			t.Errorf("accepted MAC <%s>", mac)
+		}
+	}
+	if sensors := pendingSensors.List(); len(sensors) != 0 {
+		t.Fatalf("registered %d pending sensors", len(sensors))
+	}
+}
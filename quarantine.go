@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QuarantineConfig keeps measurements of sensors that are not in the config
+// out of the store, so that a typo in the sensor ID of a firmware stands out
+// instead of showing up as yet another sensor.
+type QuarantineConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+type QuarantinedSensor struct {
+	SensorID    string       `json:"sensor_id"`
+	FirstSeen   time.Time    `json:"first_seen"`
+	LastSeen    time.Time    `json:"last_seen"`
+	Packets     uint64       `json:"packets"`
+	Receiver    string       `json:"receiver"`
+	Address     string       `json:"address"`
+	Measurement *Measurement `json:"measurement,omitempty"`
+}
+
+// maxQuarantined is how many unknown sensors are remembered. The one that has
+// not been heard from the longest makes room for a new one.
+const maxQuarantined = 256
+
+type Quarantine struct {
+	mutex   sync.Mutex
+	sensors map[string]*QuarantinedSensor
+}
+
+var quarantine = &Quarantine{sensors: map[string]*QuarantinedSensor{}}
+
+// known returns true if the sensor is configured or is a source of a
+// configured sensor.
+func (c BridgeConfig) known(sensorID string) bool {
+	for _, sensor := range c.Sensors {
+		if sensor.Serial == sensorID {
+			return true
+		}
+		for _, source := range sensor.sources() {
+			for _, member := range source.Sensors {
+				if member == sensorID {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (q *Quarantine) Add(receiver, address string, measurement *Measurement, sensorID string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := clock.Now()
+
+	sensor, ok := q.sensors[sensorID]
+	if !ok {
+		if len(q.sensors) >= maxQuarantined {
+			q.evict()
+		}
+		sensor = &QuarantinedSensor{SensorID: sensorID, FirstSeen: now}
+		q.sensors[sensorID] = sensor
+		log.Printf("[!] %s: Quarantined packets from unknown sensor", sensorID)
+		audit(auditUnknownSensor, sensorID, address, "")
+	}
+
+	sensor.LastSeen = now
+	sensor.Packets++
+	sensor.Receiver = receiver
+	sensor.Address = address
+	if measurement != nil {
+		sensor.Measurement = measurement
+	}
+}
+
+func (q *Quarantine) evict() {
+	var oldest *QuarantinedSensor
+	for _, sensor := range q.sensors {
+		if oldest == nil || sensor.LastSeen.Before(oldest.LastSeen) {
+			oldest = sensor
+		}
+	}
+	if oldest != nil {
+		delete(q.sensors, oldest.SensorID)
+	}
+}
+
+func (q *Quarantine) List() []QuarantinedSensor {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	list := []QuarantinedSensor{}
+	for _, sensor := range q.sensors {
+		list = append(list, *sensor)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].SensorID < list[j].SensorID
+	})
+
+	return list
+}
+
+func handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(quarantine.List()); err != nil {
+		log.Println("Failed to encode quarantine: ", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig limits how many packets per second are accepted from a
+// single sensor and from a single IP address. A rate of zero disables the
+// limit. Burst defaults to one second worth of packets.
+type RateLimitConfig struct {
+	SensorRate   float64 `json:"sensor_rate"`
+	SensorBurst  int     `json:"sensor_burst"`
+	AddressRate  float64 `json:"address_rate"`
+	AddressBurst int     `json:"address_burst"`
+}
+
+var errRateLimited = errors.New("rate limited")
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type RateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+// maxBuckets is how many buckets are kept at most, so that a flood of spoofed
+// addresses or sensor IDs cannot grow them without bound.
+const maxBuckets = 1024
+
+var (
+	sensorLimiter  *RateLimiter
+	addressLimiter *RateLimiter
+)
+
+func configureRateLimits(config RateLimitConfig) {
+	sensorLimiter = newRateLimiter(config.SensorRate, config.SensorBurst)
+	addressLimiter = newRateLimiter(config.AddressRate, config.AddressBurst)
+}
+
+func newRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &RateLimiter{rate: rate, burst: float64(burst), buckets: map[string]*tokenBucket{}}
+}
+
+// Allow takes a token from the bucket of key and returns false if there was
+// none left. A nil RateLimiter allows everything.
+func (l *RateLimiter) Allow(key string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := clock.Now()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// prune drops the buckets that have refilled completely, which are no
+// different from a new bucket. When none has, it drops the one that was used
+// the longest ago to make room.
+func (l *RateLimiter) prune(now time.Time) {
+	oldest := ""
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		} else if oldest == "" || bucket.last.Before(l.buckets[oldest].last) {
+			oldest = key
+		}
+	}
+	if len(l.buckets) >= maxBuckets {
+		delete(l.buckets, oldest)
+	}
+}
+
+func addressHost(address net.Addr) string {
+	host, _, err := net.SplitHostPort(address.String())
+	if err != nil {
+		return address.String()
+	}
+	return host
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBucketsAreCapped(t *testing.T) {
+	c := useManualClock(t)
+	l := newRateLimiter(1, 1)
+
+	// None of the buckets refills before the next key comes in
+	for i := 0; i < 3*maxBuckets; i++ {
+		l.Allow(strconv.Itoa(i))
+		c.Advance(time.Millisecond)
+		if len(l.buckets) > maxBuckets {
+			t.Fatalf("%d buckets after %d keys", len(l.buckets), i+1)
+		}
+	}
+
+	// The most recent keys are still limited
+	if l.Allow(strconv.Itoa(3*maxBuckets - 1)) {
+		t.Fatal("recent key was not limited")
+	}
+}
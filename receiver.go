@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Ack struct {
+	Ack      string         `json:"ack"`
+	Firmware *FirmwareOffer `json:"firmware,omitempty"`
+
+	// Schema is the newest payload version we understand, sent to sensors
+	// that use an older or newer one
+	Schema int    `json:"schema,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type packetType struct {
+	Type string `json:"type"`
+}
+
+// packet is a single uplink message together with where it came from and how
+// to answer it.
+type packet struct {
+	receiver ReceiverConfig
+	address  net.Addr
+	payload  []byte
+	conn     net.PacketConn // nil unless the packet came in over UDP
+	reply    func([]byte) error
+}
+
+const defaultMaxPacketSize = 1024
+
+var errPacketTooLarge = errors.New("packet too large")
+
+type receiverStats struct {
+	Packets     uint64
+	Errors      uint64
+	RateLimited uint64
+	Oversized   uint64
+	ReadErrors  uint64
+	Rebinds     uint64
+}
+
+var (
+	receiverStatsMutex sync.Mutex
+	receiverStatsByTag = map[string]*receiverStats{}
+)
+
+// statsFor returns the stats of a receiver. The caller must hold the lock.
+func statsFor(tag string) *receiverStats {
+	stats, ok := receiverStatsByTag[tag]
+	if !ok {
+		stats = &receiverStats{}
+		receiverStatsByTag[tag] = stats
+	}
+	return stats
+}
+
+func countPacket(tag string, err error) {
+	receiverStatsMutex.Lock()
+	defer receiverStatsMutex.Unlock()
+
+	stats := statsFor(tag)
+	stats.Packets++
+	switch {
+	case err == errRateLimited:
+		stats.RateLimited++
+	case err == errPacketTooLarge:
+		stats.Oversized++
+	case err != nil:
+		stats.Errors++
+	}
+}
+
+// countSocketEvent counts a failed read, or a socket that had to be bound
+// again.
+func countSocketEvent(tag string, rebind bool) {
+	receiverStatsMutex.Lock()
+	defer receiverStatsMutex.Unlock()
+
+	if rebind {
+		statsFor(tag).Rebinds++
+	} else {
+		statsFor(tag).ReadErrors++
+	}
+}
+
+func receiverStatsSnapshot() map[string]receiverStats {
+	receiverStatsMutex.Lock()
+	defer receiverStatsMutex.Unlock()
+
+	snapshot := map[string]receiverStats{}
+	for tag, stats := range receiverStatsByTag {
+		snapshot[tag] = *stats
+	}
+	return snapshot
+}
+
+// legacyMeasurement is the flat format, without measurement_data, that some
+// sensors still send.
+type legacyMeasurement struct {
+	SensorID      string   `json:"sensor_id"`
+	SensorTime    int64    `json:"sensor_time"`
+	MeasurementID string   `json:"measurement_id"`
+	Temperature   *float32 `json:"temperature"`
+	Humidity      *float32 `json:"humidity"`
+	Pressure      *float32 `json:"pressure"`
+}
+
+func decodeMeasurement(receiver ReceiverConfig, payload []byte) (Measurement, []FieldError, error) {
+	switch receiver.Format {
+	case "", "json":
+		var measurement Measurement
+		problems, err := unmarshal(receiver.Parsing, payload, &measurement)
+		return measurement, problems, err
+	case "legacy":
+		var legacy legacyMeasurement
+		problems, err := unmarshal(receiver.Parsing, payload, &legacy)
+		if err != nil {
+			return Measurement{}, nil, err
+		}
+		return Measurement{
+			SensorID:      legacy.SensorID,
+			SensorTime:    legacy.SensorTime,
+			MeasurementID: legacy.MeasurementID,
+			MeasurementData: MeasurementData{
+				Temperature: legacy.Temperature,
+				Humidity:    legacy.Humidity,
+				Pressure:    legacy.Pressure,
+			},
+		}, problems, nil
+	default:
+		return Measurement{}, nil, fmt.Errorf("unknown format <%s>", receiver.Format)
+	}
+}
+
+// process handles a packet and keeps the ones that fail for the recent errors
+// API, rate limited packets aside.
+func process(config Config, p packet) error {
+	p.receiver = p.receiver.forSource(p.address)
+	err := processPacket(config, p)
+	packetTraces.Trace(p, err)
+	if err != nil && err != errRateLimited {
+		recordFailure(p, err)
+	}
+	return err
+}
+
+func processPacket(config Config, p packet) error {
+	// Sensors can be changed at runtime
+	config.Bridge = liveConfig().Bridge
+
+	if !addressLimiter.Allow(addressHost(p.address)) {
+		return errRateLimited
+	}
+
+	signed, signature := splitSignature(p.payload)
+
+	// The signature covers the payload as it was sent
+	decompressed, err := decompress(signed, p.receiver.MaxDecompressedSize)
+	if err != nil {
+		return err
+	}
+
+	payload, encoding, err := transcode(p.receiver.Encoding, decompressed)
+	if err != nil {
+		return err
+	}
+
+	var typ packetType
+	if err := json.Unmarshal(payload, &typ); err != nil {
+		return err
+	}
+
+	switch typ.Type {
+	case "hello":
+		return processHello(config, p, payload)
+	case "discover":
+		return processDiscover(config, p)
+	}
+
+	measurement, problems, err := decodeMeasurement(p.receiver, payload)
+	if err == nil {
+		err = checkLimits(measurement)
+	}
+	if err == nil {
+		var schemaProblems []FieldError
+		schemaProblems, err = checkSchema(p.receiver.Parsing, &measurement)
+		problems = append(problems, schemaProblems...)
+		if err != nil && measurement.Version > maxSchemaVersion && p.receiver.Ack {
+			replyAck(p, Ack{Ack: measurement.MeasurementID, Schema: maxSchemaVersion, Error: err.Error()})
+		}
+	}
+	if err != nil {
+		// The packet may still tell us which sensor sent it
+		var sender struct {
+			SensorID string `json:"sensor_id"`
+		}
+		if json.Unmarshal(payload, &sender) == nil && sender.SensorID != "" && len(sender.SensorID) <= maxIDLength {
+			if config.Quarantine.Enabled && !config.Bridge.known(sender.SensorID) {
+				quarantine.Add(p.receiver.Tag, p.address.String(), nil, sender.SensorID)
+			} else {
+				store.RecordParseError(sender.SensorID)
+			}
+		}
+		return err
+	}
+
+	countEncoding(encoding)
+
+	if len(problems) != 0 {
+		failure := newParseFailure(p, &ParseError{Fields: problems})
+		failure.Accepted = true
+		parseFailures.Add(failure)
+	}
+
+	sensorConfig, known := config.Bridge.sensor(measurement.SensorID)
+	if known && sensorConfig.HMACKey != "" {
+		if err := verifySignature(sensorConfig.HMACKey, signed, signature); err != nil {
+			audit(auditPacketRejected, measurement.SensorID, p.address.String(), err.Error())
+			return fmt.Errorf("rejected packet from <%s>: %v", measurement.SensorID, err)
+		}
+		replayed, err := replays.Check(measurement, clock.Now())
+		if err != nil {
+			audit(auditPacketRejected, measurement.SensorID, p.address.String(), err.Error())
+			return fmt.Errorf("rejected packet from <%s>: %v", measurement.SensorID, err)
+		}
+		// A repeat is acknowledged like any duplicate, the sensor may have
+		// missed our ACK, but it is not taken again
+		if replayed {
+			store.RecordReplayed(measurement.SensorID)
+			if p.receiver.Ack {
+				return replyAck(p, Ack{Ack: measurement.MeasurementID})
+			}
+			return nil
+		}
+	}
+
+	// Unknown sensors get no ACK, just like packets that fail verification
+	if config.Quarantine.Enabled && !config.Bridge.known(measurement.SensorID) {
+		quarantine.Add(p.receiver.Tag, p.address.String(), &measurement, measurement.SensorID)
+		return nil
+	}
+
+	if !sensorLimiter.Allow(measurement.SensorID) {
+		store.RecordRateLimited(measurement.SensorID)
+		return errRateLimited
+	}
+
+	relay(measurement.SensorID, known, signed, p.payload)
+
+	if p.conn != nil {
+		downlink.Route(measurement.SensorID, p.conn)
+	}
+
+	store.RecordEncoding(measurement.SensorID, encoding)
+
+	// Sentinels are checked before calibration can move them, and what the
+	// pipeline computed is checked again
+	sanitized := sanitize(&measurement.MeasurementData, sensorConfig.sentinels())
+	normalizeUnits(&measurement.MeasurementData, config.Units.inputFor(sensorConfig))
+	if known {
+		stages, err := sensorConfig.pipeline()
+		if err != nil {
+			return fmt.Errorf("sensor <%s> has a bad pipeline: %v", measurement.SensorID, err)
+		}
+		if measurement, err = runPipeline(stages, measurement); err != nil {
+			return fmt.Errorf("rejected measurement from <%s>: %v", measurement.SensorID, err)
+		}
+		sanitized = append(sanitized, sanitize(&measurement.MeasurementData, nil)...)
+	}
+	if len(sanitized) != 0 {
+		failure := newParseFailure(p, &ParseError{Fields: sanitized})
+		failure.Accepted = true
+		parseFailures.Add(failure)
+	}
+
+	if store.Update(measurement, p.address) {
+		logMeasurement(measurement, p.receiver.Tag, p.address.String())
+		packetLog.Packet(measurement.SensorID, "%s: Temperature <%s> Humidity <%s>\n", measurement.SensorID,
+			formatValue(measurement.MeasurementData.Temperature, "%f"), formatValue(measurement.MeasurementData.Humidity, "%f"))
+	}
+
+	// Duplicates are acknowledged too, the sensor is probably retransmitting
+	// because our previous ACK got lost.
+	if p.receiver.Ack {
+		ack := Ack{Ack: measurement.MeasurementID}
+		if version, ok := store.FirmwareVersion(measurement.SensorID); ok && known {
+			ack.Firmware, _ = firmware.Offer(sensorConfig, version)
+		}
+		if measurement.Version < maxSchemaVersion {
+			ack.Schema = maxSchemaVersion
+		}
+		return replyAck(p, ack)
+	}
+
+	return nil
+}
+
+func replyAck(p packet, ack Ack) error {
+	encodedAck, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+	return p.reply(encodedAck)
+}
+
+func startReceivers(config Config) {
+	for i, receiverConfig := range config.receivers() {
+		switch receiverConfig.Type {
+		case "", "udp":
+			// Only the first UDP receiver can take over a socket from systemd
+			go udpReceiver(config, receiverConfig, i == 0)
+		case "http":
+			go httpReceiver(config, receiverConfig)
+		default:
+			log.Fatalf("Unknown receiver type <%s>", receiverConfig.Type)
+		}
+	}
+}
+
+// A socket that fails this many reads in a row, like after its interface
+// went away, is closed and bound again. The delay keeps the loop from
+// spinning on a broken socket.
+const (
+	maxReadErrors  = 10
+	readErrorDelay = 100 * time.Millisecond
+)
+
+func udpReceiver(config Config, receiverConfig ReceiverConfig, activation bool) {
+	var pc net.PacketConn
+	var err error
+
+	if activation {
+		if pc, err = activatedPacketConn(); err != nil {
+			log.Fatal("Could not use activated socket: ", err)
+		}
+	}
+
+	if pc == nil {
+		err = retry("bind receiver", startupAttempts, func() (err error) {
+			pc, err = listenUDP(receiverConfig)
+			return err
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	defer func() { pc.Close() }()
+
+	setReadBuffer(pc, receiverConfig)
+
+	maxPacketSize := receiverConfig.MaxPacketSize
+	if maxPacketSize <= 0 {
+		maxPacketSize = defaultMaxPacketSize
+	}
+
+	log.Printf("[*] Receiver <%s> listening on %s", receiverConfig.Tag, pc.LocalAddr())
+	if receiverConfig.Group != "" {
+		log.Printf("[*] Receiver <%s> joined multicast group %s", receiverConfig.Tag, receiverConfig.Group)
+	}
+	health.ReceiverBound(receiverConfig.Tag)
+
+	readErrors := 0
+	lastPacket := clock.Now()
+	for {
+		// One spare byte tells us the packet did not fit
+		buf := make([]byte, maxPacketSize+1)
+		pc.SetReadDeadline(time.Now().Add(receiverHeartbeat))
+		n, addr, err := pc.ReadFrom(buf)
+		health.ReceiverAlive(receiverConfig.Tag)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if idle := time.Duration(receiverConfig.IdleRebind) * time.Second; idle > 0 && clock.Since(lastPacket) > idle {
+					log.Printf("[!] Receiver <%s> got nothing for %s, binding it again", receiverConfig.Tag, idle)
+					pc = rebindUDP(pc, receiverConfig)
+					lastPacket = clock.Now()
+				}
+				continue
+			}
+
+			countSocketEvent(receiverConfig.Tag, false)
+			if readErrors++; readErrors == 1 {
+				log.Printf("[!] Receiver <%s> could not read: %v", receiverConfig.Tag, err)
+			}
+			if readErrors >= maxReadErrors {
+				log.Printf("[!] Receiver <%s> failed %d reads in a row, binding it again: %v", receiverConfig.Tag, readErrors, err)
+				pc = rebindUDP(pc, receiverConfig)
+				readErrors = 0
+			} else {
+				clock.Sleep(readErrorDelay)
+			}
+			continue
+		}
+		readErrors = 0
+		lastPacket = clock.Now()
+
+		if n > maxPacketSize {
+			recordFailure(packet{receiver: receiverConfig, address: addr, payload: buf[:n]}, errPacketTooLarge)
+			countPacket(receiverConfig.Tag, errPacketTooLarge)
+			log.Printf("Dropped packet from %s: larger than %d bytes", addr, maxPacketSize)
+			continue
+		}
+
+		conn := pc
+		p := packet{
+			receiver: receiverConfig,
+			address:  addr,
+			payload:  buf[:n],
+			conn:     conn,
+			reply: func(b []byte) error {
+				_, err := conn.WriteTo(b, addr)
+				return err
+			},
+		}
+
+		err = process(config, p)
+		countPacket(receiverConfig.Tag, err)
+		if err != nil && err != errRateLimited {
+			log.Println("Failed to process packet: ", err)
+		}
+	}
+}
+
+func setReadBuffer(pc net.PacketConn, receiverConfig ReceiverConfig) {
+	if receiverConfig.ReadBuffer > 0 {
+		if conn, ok := pc.(interface{ SetReadBuffer(int) error }); ok {
+			if err := conn.SetReadBuffer(receiverConfig.ReadBuffer); err != nil {
+				log.Printf("Could not set read buffer of receiver <%s>: %v", receiverConfig.Tag, err)
+			}
+		}
+	}
+}
+
+// rebindUDP closes the socket of a receiver and binds a new one, trying until
+// it gets one. A socket that systemd passed in is replaced by one of our own.
+func rebindUDP(pc net.PacketConn, receiverConfig ReceiverConfig) net.PacketConn {
+	old := pc
+	pc.Close()
+	retry("bind receiver <"+receiverConfig.Tag+"> again", 0, func() (err error) {
+		pc, err = listenUDP(receiverConfig)
+		return err
+	})
+	downlink.Replace(old, pc)
+	setReadBuffer(pc, receiverConfig)
+	countSocketEvent(receiverConfig.Tag, true)
+	log.Printf("[*] Receiver <%s> listening on %s again", receiverConfig.Tag, pc.LocalAddr())
+	return pc
+}
+
+func listenUDP(config ReceiverConfig) (net.PacketConn, error) {
+	network := config.Network
+	if network == "" {
+		network = "udp"
+	}
+
+	if config.Group == "" {
+		return net.ListenPacket(network, net.JoinHostPort(config.Address, strconv.Itoa(config.Port)))
+	}
+
+	group, err := net.ResolveUDPAddr(network, net.JoinHostPort(config.Group, strconv.Itoa(config.Port)))
+	if err != nil {
+		return nil, err
+	}
+	if !group.IP.IsMulticast() {
+		return nil, fmt.Errorf("<%s> is not a multicast address", config.Group)
+	}
+
+	// A nil interface lets the system pick one
+	var ifi *net.Interface
+	if config.Interface != "" {
+		if ifi, err = net.InterfaceByName(config.Interface); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.ListenMulticastUDP(network, ifi, group)
+}
+
+type httpAddr string
+
+func (a httpAddr) Network() string { return "http" }
+func (a httpAddr) String() string  { return string(a) }
+
+// httpReceiver accepts packets POSTed to it. Whatever would have been sent
+// back over UDP becomes the response body.
+func httpReceiver(config Config, receiverConfig ReceiverConfig) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var response bytes.Buffer
+		p := packet{
+			receiver: receiverConfig,
+			address:  httpAddr(r.RemoteAddr),
+			payload:  payload,
+			reply: func(b []byte) error {
+				_, err := response.Write(b)
+				return err
+			},
+		}
+
+		err = process(config, p)
+		countPacket(receiverConfig.Tag, err)
+		if err == errRateLimited {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if response.Len() == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response.Bytes())
+	})
+
+	address := receiverConfig.Address
+	if address == "" {
+		address = ":http"
+	}
+
+	var listener net.Listener
+	err := retry("bind receiver", startupAttempts, func() (err error) {
+		listener, err = net.Listen("tcp", address)
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("[*] Receiver <%s> listening on %s", receiverConfig.Tag, listener.Addr())
+	health.ReceiverBound("")
+
+	log.Fatal(http.Serve(listener, handler))
+}
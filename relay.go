@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RelayConfig forwards the packets of sensors to an upstream bridge, like
+// from a gateway in an outbuilding to the bridge in the house. Packets go out
+// as they came in, or signed again with HMACKey when the upstream bridge
+// knows the relay rather than the sensors. Only the packets of configured
+// sensors are signed again, the relay does not vouch for others, and packets
+// that are quarantined or rate limited are not relayed at all. Sensors limits
+// the relay to the given sensors. Spool is how many packets to keep on disk
+// while the upstream cannot be reached, they are sent in order once it is
+// back. Upstream bridges with a replay window reject what is older than the
+// window.
+type RelayConfig struct {
+	Address string   `json:"address"`
+	Sensors []string `json:"sensors,omitempty"`
+	HMACKey string   `json:"hmac_key,omitempty"`
+	Spool   int      `json:"spool,omitempty"`
+}
+
+type Relay struct {
+	config RelayConfig
+	conn   net.Conn
+	spool  *Spool
+	last   []byte
+
+	mutex      sync.Mutex
+	sent       uint64
+	failed     uint64
+	lastFailed time.Time
+}
+
+var relays []*Relay
+
+func configureRelays(configs []RelayConfig) error {
+	for _, config := range configs {
+		if config.HMACKey != "" {
+			if _, err := sign(config.HMACKey, nil); err != nil {
+				return fmt.Errorf("relay <%s>: %v", config.Address, err)
+			}
+		}
+		conn, err := net.Dial("udp", config.Address)
+		if err != nil {
+			return fmt.Errorf("relay <%s>: %v", config.Address, err)
+		}
+		r := &Relay{config: config, conn: conn}
+		if config.Spool > 0 {
+			if r.spool, err = openSpool(spoolPath(config.Address), config.Spool); err != nil {
+				return fmt.Errorf("relay <%s>: %v", config.Address, err)
+			}
+			if n := r.spool.Len(); n != 0 {
+				log.Printf("[*] Relay <%s> has %d spooled packets", config.Address, n)
+			}
+			go r.drain()
+		}
+		relays = append(relays, r)
+		log.Printf("[*] Relaying packets to <%s>", config.Address)
+	}
+	return nil
+}
+
+// Spooled packets are sent in batches, so that the upstream does not rate
+// limit the sensors
+const (
+	relayDrainInterval = time.Second
+	relayDrainBatch    = 20
+	relayProbeTimeout  = 100 * time.Millisecond
+)
+
+func spoolPath(address string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, address)
+	return filepath.Join(storagePath, "relay-"+name+".spool")
+}
+
+// drain sends the spooled packets of a relay once the upstream is back. Each
+// batch starts with a single packet that has to go through first, a closed
+// port is only reported after a write and would swallow a whole batch.
+func (r *Relay) drain() {
+	write := func(packet []byte) error {
+		_, err := r.conn.Write(packet)
+		return err
+	}
+	probe := func(packet []byte) error {
+		if err := write(packet); err != nil {
+			return err
+		}
+		// Anything but the refusal, an ACK or nothing at all, will do
+		r.conn.SetReadDeadline(time.Now().Add(relayProbeTimeout))
+		buffer := make([]byte, 1024)
+		if _, err := r.conn.Read(buffer); err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ticker := clock.NewTicker(relayDrainInterval)
+	defer ticker.Stop()
+	for range ticker.Chan() {
+		// The spool is not held while sending, packets keep coming in
+		packets, head := r.spool.Peek(relayDrainBatch)
+		if len(packets) == 0 {
+			continue
+		}
+		sent := 0
+		var err error
+		for i, packet := range packets {
+			send := write
+			if i == 0 {
+				send = probe
+			}
+			if err = send(packet); err != nil {
+				break
+			}
+			sent++
+		}
+		if derr := r.spool.Discard(head, sent); derr != nil {
+			log.Printf("[!] Could not update spool for <%s>: %v", r.config.Address, derr)
+		}
+
+		r.mutex.Lock()
+		r.sent += uint64(sent)
+		r.mutex.Unlock()
+
+		if sent != 0 && err == nil && r.spool.Len() == 0 {
+			log.Printf("[*] Relayed all spooled packets to <%s>", r.config.Address)
+		}
+	}
+}
+
+// queue spools a packet, a full spool drops the oldest.
+func (r *Relay) queue(packets ...[]byte) {
+	for _, packet := range packets {
+		if len(packet) == 0 {
+			continue
+		}
+		if err := r.spool.Push(packet); err != nil {
+			log.Printf("[!] Could not spool packet for <%s>: %v", r.config.Address, err)
+		}
+	}
+}
+
+// relay sends a packet of a sensor to the upstream bridges. Payload is the
+// packet without its signature, packet the packet as it was received. Known
+// tells if the sensor is configured, which it has to be to be signed again.
+func relay(sensorID string, known bool, payload, packet []byte) {
+	for _, r := range relays {
+		if len(r.config.Sensors) != 0 && !contains(r.config.Sensors, sensorID) {
+			continue
+		}
+
+		out := packet
+		if r.config.HMACKey != "" && known {
+			out, _ = sign(r.config.HMACKey, payload)
+		}
+
+		// Packets wait behind those that are spooled, so they arrive in order
+		if r.spool != nil && r.spool.Len() != 0 {
+			r.queue(out)
+			continue
+		}
+
+		_, err := r.conn.Write(out)
+
+		r.mutex.Lock()
+		if err == nil {
+			r.sent++
+			if r.spool != nil {
+				r.last = append(r.last[:0], out...)
+			}
+		} else {
+			// A refused packet is only reported on the next write, the one
+			// before may not have arrived either
+			if r.spool != nil {
+				r.queue(r.last, out)
+				r.last = r.last[:0]
+			}
+			r.failed++
+			// An unreachable upstream fails every packet, once a minute is enough
+			if clock.Since(r.lastFailed) > time.Minute {
+				log.Printf("[!] Could not relay to <%s>: %v", r.config.Address, err)
+			}
+			r.lastFailed = clock.Now()
+		}
+		r.mutex.Unlock()
+	}
+}
+
+func writeRelayMetrics(w http.ResponseWriter) {
+	if len(relays) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP sensor_bridge_relayed_packets_total Packets forwarded per upstream bridge.\n")
+	fmt.Fprintf(w, "# TYPE sensor_bridge_relayed_packets_total counter\n")
+	for _, r := range relays {
+		r.mutex.Lock()
+		fmt.Fprintf(w, "sensor_bridge_relayed_packets_total{relay=%q,result=\"sent\"} %d\n", r.config.Address, r.sent)
+		fmt.Fprintf(w, "sensor_bridge_relayed_packets_total{relay=%q,result=\"failed\"} %d\n", r.config.Address, r.failed)
+		r.mutex.Unlock()
+		if r.spool != nil {
+			fmt.Fprintf(w, "sensor_bridge_relayed_packets_total{relay=%q,result=\"dropped\"} %d\n", r.config.Address, r.spool.Dropped())
+		}
+	}
+
+	var spooling bool
+	for _, r := range relays {
+		spooling = spooling || r.spool != nil
+	}
+	if !spooling {
+		return
+	}
+	fmt.Fprintf(w, "# HELP sensor_bridge_relay_spooled_packets Packets waiting on disk for an upstream bridge.\n")
+	fmt.Fprintf(w, "# TYPE sensor_bridge_relay_spooled_packets gauge\n")
+	for _, r := range relays {
+		if r.spool != nil {
+			fmt.Fprintf(w, "sensor_bridge_relay_spooled_packets{relay=%q} %d\n", r.config.Address, r.spool.Len())
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+)
+
+// AccessoryIDs hands out accessory IDs that stay with a sensor, so that
+// reordering, removing or renaming sensors in the config does not make
+// HomeKit see them as new accessories.
+type AccessoryIDs struct {
+	mutex sync.Mutex
+	path  string
+	ids   map[string]uint64
+}
+
+var accessoryIDs = &AccessoryIDs{
+	path: filepath.Join(storagePath, "accessory-ids.json"),
+	ids:  map[string]uint64{},
+}
+
+func (a *AccessoryIDs) Load() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	encoded, err := ioutil.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, &a.ids)
+}
+
+// ID returns the accessory ID of a sensor, assigning the next free one to
+// sensors that have not been seen before. The bridge itself is ID 1.
+func (a *AccessoryIDs) ID(serial string) (uint64, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if id, ok := a.ids[serial]; ok {
+		return id, nil
+	}
+
+	id := uint64(2)
+	for _, existing := range a.ids {
+		if existing >= id {
+			id = existing + 1
+		}
+	}
+	a.ids[serial] = id
+
+	return id, a.save()
+}
+
+func (a *AccessoryIDs) save() error {
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return err
+	}
+
+	encoded, err := json.MarshalIndent(a.ids, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, encoded, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+var (
+	accessoriesMutex sync.Mutex
+	accessories      = map[string]*accessory.Accessory{}
+)
+
+func registerAccessory(serial string, ac *accessory.Accessory) {
+	accessoriesMutex.Lock()
+	defer accessoriesMutex.Unlock()
+	accessories[serial] = ac
+}
+
+// setAccessoryName changes the name HomeKit shows for a sensor. The accessory
+// keeps its ID, so it keeps its room and automations.
+func setAccessoryName(serial, name string) error {
+	accessoriesMutex.Lock()
+	ac, ok := accessories[serial]
+	accessoriesMutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no sensor <%s>", serial)
+	}
+
+	if ac.Info.Name.GetValue() != name {
+		log.Printf("[*] Renaming sensor <%s> to <%s>", serial, name)
+		ac.Info.Name.SetValue(name)
+
+		accessoriesMutex.Lock()
+		for _, service := range serviceNames[serial] {
+			service.name.SetValue(name + " " + service.suffix)
+		}
+		accessoriesMutex.Unlock()
+	}
+	return nil
+}
+
+// renameSensor renames a sensor in the config file and in HomeKit. The name
+// may be a template.
+func renameSensor(serial, name string) error {
+	if name == "" {
+		return fmt.Errorf("name of <%s> cannot be empty", serial)
+	}
+
+	err := updateSensorsInConfig(configPath, func(sensors []SensorConfig) ([]SensorConfig, error) {
+		for i := range sensors {
+			if sensors[i].Serial == serial {
+				sensors[i].Name = name
+				return sensors, nil
+			}
+		}
+		return nil, fmt.Errorf("sensor <%s> is not configured", serial)
+	})
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	setLiveConfig(config)
+	sensor, _ := config.Bridge.sensor(serial)
+
+	return setAccessoryName(serial, sensor.Name)
+}
+
+// reloadConfig picks up the sensors from the config file. Their names,
+// locations, keys, thresholds, calibration and alert rules take effect right
+// away, new sensors need a restart to be published to HomeKit.
+func reloadConfig() error {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	logConfigChanges(diffConfig(liveConfig(), config))
+	setLiveConfig(config)
+
+	for _, sensorConfig := range config.Bridge.Sensors {
+		store.SetTTL(sensorConfig.Serial, time.Duration(sensorConfig.TTL)*time.Second)
+		store.SetMetadata(sensorConfig.Serial, Metadata{Room: sensorConfig.Room, Group: sensorConfig.Group, Tags: sensorConfig.Tags})
+		// New sensors have no accessory until the bridge restarts
+		setAccessoryName(sensorConfig.Serial, sensorConfig.Name)
+	}
+
+	log.Println("[*] Reloaded config")
+	return nil
+}
+
+func watchReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := reloadConfig(); err != nil {
+			log.Println("Could not reload config: ", err)
+		}
+	}
+}
+
+type renameRequest struct {
+	Name string `json:"name"`
+}
+
+// handleRename handles POST /api/v1/sensors/<id>/rename
+func handleRename(w http.ResponseWriter, r *http.Request, sensorID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request renameRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := renameSensor(sensorID, request.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
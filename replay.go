@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ReplayConfig closes the window for replaying recorded packets of sensors
+// that sign them. With a Window, in seconds, signed packets must carry a
+// measurement ID and a sensor time within Window of ours, and a measurement
+// ID is only taken once within Window.
+type ReplayConfig struct {
+	Window int `json:"window"`
+}
+
+var (
+	errReplayNoID   = errors.New("signed packet has no measurement ID")
+	errReplayNoTime = errors.New("signed packet has no sensor time")
+	errReplayStale  = errors.New("signed packet is outside the replay window")
+)
+
+// ReplayGuard remembers the measurement IDs seen within the window.
+type ReplayGuard struct {
+	mutex     sync.Mutex
+	window    time.Duration
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+var replays = &ReplayGuard{seen: map[string]time.Time{}}
+
+func configureReplay(config ReplayConfig) {
+	replays.mutex.Lock()
+	defer replays.mutex.Unlock()
+	replays.window = time.Duration(config.Window) * time.Second
+}
+
+// Check returns an error for a signed measurement that falls outside the
+// window, and whether it is a repeat of one seen within the window.
+func (g *ReplayGuard) Check(measurement Measurement, received time.Time) (bool, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.window <= 0 {
+		return false, nil
+	}
+	if measurement.MeasurementID == "" {
+		return false, errReplayNoID
+	}
+	if measurement.SensorTime == 0 {
+		return false, errReplayNoTime
+	}
+	if skew := time.Unix(measurement.SensorTime, 0).Sub(received); math.Abs(skew.Seconds()) > g.window.Seconds() {
+		return false, errReplayStale
+	}
+
+	// A packet is valid from a window before its sensor time until a window
+	// after it, so IDs are kept for twice the window
+	keep := 2 * g.window
+	if received.Sub(g.lastPrune) > g.window {
+		for key, seen := range g.seen {
+			if received.Sub(seen) > keep {
+				delete(g.seen, key)
+			}
+		}
+		g.lastPrune = received
+	}
+
+	key := measurement.SensorID + "/" + measurement.MeasurementID
+	if seen, ok := g.seen[key]; ok && received.Sub(seen) <= keep {
+		return true, nil
+	}
+	g.seen[key] = received
+	return false, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// startupAttempts bounds how long we wait for the network at boot, with the
+// backoff below this adds up to roughly two minutes.
+const startupAttempts = 8
+
+// retry calls fn until it succeeds or attempts, unless zero, run out, doubling
+// the delay between attempts up to 30 seconds.
+func retry(what string, attempts int, fn func() error) error {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == attempts {
+			return err
+		}
+
+		log.Printf("Could not %s (attempt %d/%d), retrying in %s: %v", what, attempt, attempts, delay, err)
+		time.Sleep(delay)
+
+		if delay *= 2; delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+}
+
+// hasAddress checks that ip is assigned to one of our interfaces. Until DHCP
+// has done its thing the HomeKit transport would announce an address that
+// does not exist yet.
+func hasAddress(ip string) error {
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		if ipnet, ok := address.(*net.IPNet); ok && ipnet.IP.String() == ip {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("address %s is not assigned to any interface", ip)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReportingConfig sets the timezone that days are counted in, which defaults
+// to the local time of the bridge. With DailySummary on, a summary of
+// yesterday is sent as a notification just after midnight. WeeklySummary does
+// the same for the past week every Monday.
+type ReportingConfig struct {
+	Timezone      string `json:"timezone"`
+	DailySummary  bool   `json:"daily_summary"`
+	WeeklySummary bool   `json:"weekly_summary"`
+}
+
+func (c ReportingConfig) location() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(c.Timezone)
+}
+
+// rollupDays is how many days of rollups are kept, including today.
+const rollupDays = 8
+
+const dateFormat = "2006-01-02"
+
+type MetricSummary struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	Count int     `json:"count"`
+}
+
+func (m *MetricSummary) add(other MetricSummary) {
+	if other.Min < m.Min {
+		m.Min = other.Min
+	}
+	if other.Max > m.Max {
+		m.Max = other.Max
+	}
+	total := m.Count + other.Count
+	m.Mean = (m.Mean*float64(m.Count) + other.Mean*float64(other.Count)) / float64(total)
+	m.Count = total
+}
+
+// Rollup summarizes each value of a sensor over a day, or over a week for
+// weekly summaries. Offline counts the times the sensor was silent for longer
+// than its TTL.
+type Rollup struct {
+	SensorID       string                    `json:"sensor_id"`
+	Name           string                    `json:"name,omitempty"`
+	Date           string                    `json:"date"`
+	Metrics        map[string]*MetricSummary `json:"metrics"`
+	Offline        int                       `json:"offline"`
+	OfflineSeconds float64                   `json:"offline_seconds"`
+}
+
+func (r *Rollup) add(other Rollup) {
+	for name, summary := range other.Metrics {
+		if existing, ok := r.Metrics[name]; ok {
+			existing.add(*summary)
+		} else {
+			copied := *summary
+			r.Metrics[name] = &copied
+		}
+	}
+	r.Offline += other.Offline
+	r.OfflineSeconds += other.OfflineSeconds
+}
+
+type Rollups struct {
+	mutex    sync.Mutex
+	location *time.Location
+	names    map[string]string
+	ttls     map[string]time.Duration
+	seen     map[string]time.Time
+	days     map[string]map[string]*Rollup
+}
+
+var rollups = &Rollups{
+	location: time.Local,
+	names:    map[string]string{},
+	ttls:     map[string]time.Duration{},
+	seen:     map[string]time.Time{},
+	days:     map[string]map[string]*Rollup{},
+}
+
+func (r *Rollups) SetLocation(location *time.Location) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.location = location
+}
+
+// Day returns the date of t in the reporting timezone.
+func (r *Rollups) Day(t time.Time) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return t.In(r.location).Format(dateFormat)
+}
+
+// Add counts the numeric values of a measurement towards the day it was taken,
+// and a silence before it towards the day it ended.
+func (r *Rollups) Add(measurement Measurement, taken, received time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	id := measurement.SensorID
+	if seen, ok := r.seen[id]; ok && r.ttls[id] > 0 && received.Sub(seen) > r.ttls[id] {
+		rollup := r.rollup(id, received.In(r.location).Format(dateFormat))
+		rollup.Offline++
+		rollup.OfflineSeconds += received.Sub(seen).Seconds()
+	}
+	r.seen[id] = received
+
+	rollup := r.rollup(id, taken.In(r.location).Format(dateFormat))
+	for name, value := range metricValues(measurement.MeasurementData) {
+		v, ok := numericValue(value)
+		if !ok {
+			continue
+		}
+		if summary, ok := rollup.Metrics[name]; ok {
+			summary.add(MetricSummary{Min: v, Max: v, Mean: v, Count: 1})
+		} else {
+			rollup.Metrics[name] = &MetricSummary{Min: v, Max: v, Mean: v, Count: 1}
+		}
+	}
+}
+
+// rollup returns the rollup of a sensor for a date. The caller must hold the
+// lock.
+func (r *Rollups) rollup(sensorID, date string) *Rollup {
+	day, ok := r.days[date]
+	if !ok {
+		day = map[string]*Rollup{}
+		r.days[date] = day
+		r.prune()
+	}
+
+	rollup, ok := day[sensorID]
+	if !ok {
+		rollup = &Rollup{SensorID: sensorID, Name: r.names[sensorID], Date: date, Metrics: map[string]*MetricSummary{}}
+		day[sensorID] = rollup
+	}
+	return rollup
+}
+
+// prune drops the oldest days beyond rollupDays. The caller must hold the lock.
+func (r *Rollups) prune() {
+	var dates []string
+	for date := range r.days {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	for len(dates) > rollupDays {
+		delete(r.days, dates[0])
+		dates = dates[1:]
+	}
+}
+
+// List returns the rollups of all sensors for a date.
+func (r *Rollups) List(date string) []Rollup {
+	return r.Combine([]string{date}, date)
+}
+
+// Combine returns the rollups of all sensors over several dates, labeled with
+// label.
+func (r *Rollups) Combine(dates []string, label string) []Rollup {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	combined := map[string]*Rollup{}
+	for _, date := range dates {
+		for id, rollup := range r.days[date] {
+			if _, ok := combined[id]; !ok {
+				combined[id] = &Rollup{SensorID: id, Name: rollup.Name, Date: label, Metrics: map[string]*MetricSummary{}}
+			}
+			combined[id].add(*rollup)
+		}
+	}
+
+	list := []Rollup{}
+	for _, rollup := range combined {
+		list = append(list, *rollup)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].SensorID < list[j].SensorID
+	})
+	return list
+}
+
+func numericValue(value reflect.Value) (float64, bool) {
+	switch value.Elem().Kind() {
+	case reflect.Float32, reflect.Float64:
+		return value.Elem().Float(), true
+	case reflect.Int, reflect.Int64:
+		return float64(value.Elem().Int()), true
+	}
+	return 0, false
+}
+
+// watchRollups counts the measurements of a sensor towards its rollups.
+func watchRollups(config SensorConfig) {
+	rollups.mutex.Lock()
+	rollups.names[config.Serial] = config.Name
+	rollups.ttls[config.Serial] = time.Duration(config.TTL) * time.Second
+	rollups.mutex.Unlock()
+
+	store.OnUpdate(config.Serial, func(measurement Measurement) {
+		now := clock.Now()
+		rollups.Add(measurement, measurementTime(measurement.SensorTime, now), now)
+	})
+}
+
+// handleRollups serves the rollups of ?date=, which is a date, today or
+// yesterday. It defaults to yesterday.
+func handleRollups(w http.ResponseWriter, r *http.Request) {
+	date := r.URL.Query().Get("date")
+	switch date {
+	case "", "yesterday":
+		date = rollups.Day(clock.Now().AddDate(0, 0, -1))
+	case "today":
+		date = rollups.Day(clock.Now())
+	default:
+		if _, err := time.Parse(dateFormat, date); err != nil {
+			http.Error(w, "date must be YYYY-MM-DD, today or yesterday", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rollups.List(date)); err != nil {
+		log.Println("Failed to encode rollups: ", err)
+	}
+}
+
+// summary describes the lows, highs and averages of the sensors in rollups,
+// and how often they were offline.
+func summary(list []Rollup) string {
+	var lines []string
+	for _, rollup := range list {
+		name := rollup.Name
+		if name == "" {
+			name = rollup.SensorID
+		}
+
+		var metrics []string
+		for metric := range rollup.Metrics {
+			metrics = append(metrics, metric)
+		}
+		sort.Strings(metrics)
+
+		var values []string
+		for _, metric := range metrics {
+			m := rollup.Metrics[metric]
+			values = append(values, fmt.Sprintf("%s %.1f to %.1f (average %.1f)", metric, m.Min, m.Max, m.Mean))
+		}
+		if rollup.Offline > 0 {
+			values = append(values, fmt.Sprintf("offline %d times for %s", rollup.Offline, time.Duration(rollup.OfflineSeconds)*time.Second))
+		}
+		if _, ok := store.Latest(rollup.SensorID); !ok {
+			values = append(values, "offline now")
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", name, strings.Join(values, ", ")))
+	}
+	if len(lines) == 0 {
+		return "No measurements"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sendSummaries sends the summary of the previous day every night, just after
+// midnight in the reporting timezone, and of the previous week on Mondays.
+func sendSummaries(config ReportingConfig, location *time.Location) {
+	for {
+		now := clock.Now().In(location)
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, location)
+		clock.Sleep(midnight.Sub(now) + time.Minute)
+
+		today := clock.Now().In(location)
+		if config.DailySummary {
+			date := rollups.Day(today.AddDate(0, 0, -1))
+			notify("Daily summary for "+date, summary(rollups.List(date)))
+		}
+		if config.WeeklySummary && today.Weekday() == time.Monday {
+			var dates []string
+			for i := 7; i >= 1; i-- {
+				dates = append(dates, rollups.Day(today.AddDate(0, 0, -i)))
+			}
+			label := dates[0] + " to " + dates[len(dates)-1]
+			notify("Weekly summary for "+label, summary(rollups.Combine(dates, label)))
+		}
+	}
+}
+
+func configureReporting(config ReportingConfig) error {
+	location, err := config.location()
+	if err != nil {
+		return fmt.Errorf("could not load timezone <%s>: %v", config.Timezone, err)
+	}
+	rollups.SetLocation(location)
+
+	if config.DailySummary || config.WeeklySummary {
+		go sendSummaries(config, location)
+	}
+	return nil
+}
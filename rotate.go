@@ -0,0 +1,171 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type RotateConfig struct {
+	Path        string `json:"path"`
+	MaxSizeMB   int    `json:"max_size_mb"`
+	MaxAgeHours int    `json:"max_age_hours"`
+	MaxFiles    int    `json:"max_files"`
+	Compress    bool   `json:"compress"`
+}
+
+// rotatingFile is an append-only file that is moved aside once it gets too big
+// or too old. Rotated files are named <path>.<timestamp>, with a .gz suffix
+// when compression is enabled.
+type rotatingFile struct {
+	mutex  sync.Mutex
+	config RotateConfig
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(config RotateConfig) (*rotatingFile, error) {
+	r := &rotatingFile{config: config}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.config.Path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(r.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file, r.size, r.opened = file, info.Size(), info.ModTime()
+	if r.size == 0 {
+		r.opened = clock.Now()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.needsRotation(len(p)) {
+		if err := r.rotate(); err != nil {
+			log.Println("Could not rotate log file: ", err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) needsRotation(n int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.config.MaxSizeMB > 0 && r.size+int64(n) > int64(r.config.MaxSizeMB)*1024*1024 {
+		return true
+	}
+	if r.config.MaxAgeHours > 0 && clock.Since(r.opened) > time.Duration(r.config.MaxAgeHours)*time.Hour {
+		return true
+	}
+	return false
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	rotated := r.config.Path + "." + clock.Now().Format("20060102-150405.000")
+	if err := os.Rename(r.config.Path, rotated); err != nil {
+		return err
+	}
+
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	go func() {
+		if r.config.Compress {
+			if err := compressFile(rotated); err != nil {
+				log.Printf("Could not compress <%s>: %v", rotated, err)
+			}
+		}
+		r.prune()
+	}()
+
+	return nil
+}
+
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// prune removes the oldest rotated files beyond MaxFiles.
+func (r *rotatingFile) prune() {
+	if r.config.MaxFiles <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(r.config.Path + ".*")
+	if err != nil {
+		return
+	}
+
+	// The timestamp suffix makes lexical order chronological
+	sort.Strings(matches)
+	for len(matches) > r.config.MaxFiles {
+		if err := os.Remove(matches[0]); err != nil {
+			log.Printf("Could not remove <%s>: %v", matches[0], err)
+		}
+		matches = matches[1:]
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file.Close()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertRule raises an alert when a value of a sensor compares to Threshold
+// for at least For seconds, and resolves it once the value is back on the
+// other side of Clear. Clear defaults to Threshold, setting it apart keeps a
+// value that hovers around the threshold from flapping. Rules apply to the
+// listed sensors, or to all of them, and notify the listed channels or all of
+// them. Rules are evaluated as measurements come in.
+type AlertRule struct {
+	Name      string   `json:"name"`
+	Sensors   []string `json:"sensors,omitempty"`
+	Metric    string   `json:"metric"`
+	Op        string   `json:"op"`
+	Threshold float64  `json:"threshold"`
+	For       int      `json:"for,omitempty"`
+	Clear     *float64 `json:"clear,omitempty"`
+	Channels  []string `json:"channels,omitempty"`
+}
+
+var comparisons = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+}
+
+var opNames = map[string]string{">": "above", ">=": "at or above", "<": "below", "<=": "at or below"}
+
+func (r AlertRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("alert rule has no name")
+	}
+	if _, ok := comparisons[r.Op]; !ok {
+		return fmt.Errorf("alert rule <%s> has unknown op <%s>", r.Name, r.Op)
+	}
+	if !isNumericMetric(r.Metric) {
+		return fmt.Errorf("alert rule <%s> has unknown metric <%s>", r.Name, r.Metric)
+	}
+	if r.Clear != nil {
+		// The clear threshold must be on the good side of the threshold
+		if (r.Op[0] == '>' && *r.Clear > r.Threshold) || (r.Op[0] == '<' && *r.Clear < r.Threshold) {
+			return fmt.Errorf("alert rule <%s> clears on the wrong side of its threshold", r.Name)
+		}
+	}
+	for _, channel := range r.Channels {
+		if _, ok := notifiers[channel]; !ok {
+			return fmt.Errorf("alert rule <%s> uses unconfigured channel <%s>", r.Name, channel)
+		}
+	}
+	return nil
+}
+
+func (r AlertRule) appliesTo(sensorID string) bool {
+	return len(r.Sensors) == 0 || contains(r.Sensors, sensorID)
+}
+
+// isNumericMetric returns true if metric is the JSON name of a numeric value
+// of MeasurementData.
+func isNumericMetric(metric string) bool {
+	if isDeclaredMetric(metric) {
+		return true
+	}
+	switch metricKind(metric) {
+	case reflect.Float32, reflect.Float64, reflect.Int, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+// metricKind is the kind of the named value, or Invalid if there is none.
+func metricKind(metric string) reflect.Kind {
+	t := reflect.TypeOf(MeasurementData{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if strings.Split(field.Tag.Get("json"), ",")[0] == metric && field.Type.Kind() == reflect.Ptr {
+			return field.Type.Elem().Kind()
+		}
+	}
+	return reflect.Invalid
+}
+
+// ruleState follows a rule for one sensor: pending since the first value
+// that broke the threshold, and firing once that lasted long enough.
+type ruleState struct {
+	pending time.Time
+	firing  bool
+}
+
+type ruleEngine struct {
+	mutex  sync.Mutex
+	states map[string]*ruleState
+}
+
+var rules = &ruleEngine{states: map[string]*ruleState{}}
+
+func validateRules(list []AlertRule) error {
+	names := map[string]bool{}
+	for _, rule := range list {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("alert rule <%s> is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return nil
+}
+
+// evaluate updates the state of a rule for a sensor after a new value came
+// in, and fires or resolves its alert.
+func (e *ruleEngine) evaluate(rule AlertRule, config SensorConfig, value float64, now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	key := config.Serial + "/" + rule.Name
+	state, ok := e.states[key]
+	if !ok {
+		state = &ruleState{}
+		e.states[key] = state
+	}
+
+	broken := comparisons[rule.Op](value, rule.Threshold)
+
+	if state.firing {
+		clear := rule.Threshold
+		if rule.Clear != nil {
+			clear = *rule.Clear
+		}
+		if comparisons[rule.Op](value, clear) {
+			return
+		}
+		state.firing = false
+		state.pending = time.Time{}
+		alerts.ClearTo(rule.Channels, config.Serial, rule.Name)
+		return
+	}
+
+	if !broken {
+		state.pending = time.Time{}
+		return
+	}
+	if state.pending.IsZero() {
+		state.pending = now
+	}
+	if now.Sub(state.pending) < time.Duration(rule.For)*time.Second {
+		return
+	}
+
+	state.firing = true
+	message := fmt.Sprintf("%s %s %g is %s %g", config.Name, rule.Metric, value, opNames[rule.Op], rule.Threshold)
+	if rule.For > 0 {
+		message += fmt.Sprintf(" for %s", now.Sub(state.pending).Round(time.Second))
+	}
+	alerts.RaiseTo(rule.Channels, config.Serial, rule.Name, message)
+}
+
+// liveRules returns the rules that apply to a sensor as the config is now.
+func liveRules(serial string) (SensorConfig, []AlertRule) {
+	config := liveConfig()
+	sensor, ok := config.Bridge.sensor(serial)
+	if !ok {
+		return sensor, nil
+	}
+
+	applicable, _ := sensor.profileRules()
+	for _, rule := range config.AlertRules {
+		if rule.appliesTo(serial) {
+			applicable = append(applicable, rule)
+		}
+	}
+	return sensor, applicable
+}
+
+// watchRules evaluates the rules that apply to a sensor as its measurements
+// come in.
+func watchRules(serial string) {
+	store.OnUpdate(serial, func(measurement Measurement) {
+		config, applicable := liveRules(serial)
+		values := metricValues(measurement.MeasurementData)
+		for _, rule := range applicable {
+			if value, ok := values[rule.Metric]; ok {
+				if v, ok := numericValue(value); ok {
+					rules.evaluate(rule, config, v, clock.Now())
+				}
+			}
+		}
+	})
+}
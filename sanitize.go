@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+)
+
+// defaultSentinels are values sensors report when a reading failed, like
+// -127 from a disconnected DS18B20 or 65535 from an unanswered register.
+var defaultSentinels = []float64{-127, -999, 65535}
+
+func (c SensorConfig) sentinels() []float64 {
+	if c.Sentinels != nil {
+		return *c.Sentinels
+	}
+	return defaultSentinels
+}
+
+func sanitizeProblem(value float64, sentinels []float64) string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return "not finite"
+	}
+	for _, sentinel := range sentinels {
+		if value == sentinel {
+			return "sentinel"
+		}
+	}
+	return ""
+}
+
+// sanitize removes the decimal values of data that are NaN, infinite or one
+// of the sentinels, so that they never reach HomeKit or the exporters, and
+// returns them as problems. Integer values are left alone, for them a
+// sentinel like 65535 can be a real reading.
+func sanitize(data *MeasurementData, sentinels []float64) []FieldError {
+	var problems []FieldError
+
+	v := reflect.ValueOf(data).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() != reflect.Ptr || field.IsNil() || field.Elem().Kind() != reflect.Float32 {
+			continue
+		}
+		if problem := sanitizeProblem(field.Elem().Float(), sentinels); problem != "" {
+			name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+			problems = append(problems, FieldError{Field: "measurement_data." + name, Problem: problem})
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+
+	// The maps may be shared with other measurements
+	if len(data.Probes) != 0 {
+		probes := map[string]float32{}
+		for name, value := range data.Probes {
+			if problem := sanitizeProblem(float64(value), sentinels); problem != "" {
+				problems = append(problems, FieldError{Field: "measurement_data.probes." + name, Problem: problem})
+				continue
+			}
+			probes[name] = value
+		}
+		data.Probes = probes
+	}
+	if len(data.Metrics) != 0 {
+		metrics := map[string]float64{}
+		for name, value := range data.Metrics {
+			if problem := sanitizeProblem(value, sentinels); problem != "" {
+				problems = append(problems, FieldError{Field: "measurement_data.metrics." + name, Problem: problem})
+				continue
+			}
+			metrics[name] = value
+		}
+		data.Metrics = metrics
+	}
+
+	return problems
+}
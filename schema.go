@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// The measurement payload is versioned so that firmware and bridge can be
+// upgraded independently. Packets without a version are version 1. Version 2
+// adds the battery and uptime of the sensor.
+const maxSchemaVersion = 2
+
+// schemaFields are the fields that a version of the payload introduced.
+var schemaFields = map[int][]string{
+	2: {"battery", "uptime"},
+}
+
+// checkSchema removes the fields from a measurement that are newer than the
+// version it claims to be. In strict mode they are an error instead.
+func checkSchema(mode string, measurement *Measurement) ([]FieldError, error) {
+	version := measurement.Version
+	if version == 0 {
+		version = 1
+	}
+	if version > maxSchemaVersion {
+		return nil, fmt.Errorf("unsupported schema version %d", version)
+	}
+
+	var problems []FieldError
+	values := metricValues(measurement.MeasurementData)
+	for v := version + 1; v <= maxSchemaVersion; v++ {
+		for _, name := range schemaFields[v] {
+			if _, ok := values[name]; ok {
+				problems = append(problems, FieldError{Field: "measurement_data." + name, Problem: fmt.Sprintf("needs version %d", v)})
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil, nil
+	}
+
+	if mode == "strict" {
+		return nil, &ParseError{Fields: problems}
+	}
+
+	v := reflect.ValueOf(&measurement.MeasurementData).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if newerField(strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0], version) {
+			v.Field(i).Set(reflect.Zero(v.Field(i).Type()))
+		}
+	}
+
+	return problems, nil
+}
+
+func newerField(name string, version int) bool {
+	for v := version + 1; v <= maxSchemaVersion; v++ {
+		for _, field := range schemaFields[v] {
+			if field == name {
+				return true
+			}
+		}
+	}
+	return false
+}
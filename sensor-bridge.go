@@ -2,79 +2,122 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"time"
 
-	"github.com/brutella/hc"
 	"github.com/brutella/hc/accessory"
 	"github.com/brutella/hc/characteristic"
 	"github.com/brutella/hc/service"
 )
 
+// MeasurementData holds the values a sensor reported. Values are nil when a
+// packet did not include them.
 type MeasurementData struct {
-	Temperature float32 `json:"temperature"`
-	Humidity    float32 `json:"humidity"`
-	Pressure    float32 `json:"pressure"`
+	Temperature *float32 `json:"temperature,omitempty"`
+	Humidity    *float32 `json:"humidity,omitempty"`
+	Pressure    *float32 `json:"pressure,omitempty"`
+	On          *bool    `json:"on,omitempty"`
+	Speed       *int     `json:"speed,omitempty"`
+	Position    *int     `json:"position,omitempty"`
+	Moisture    *float32 `json:"moisture,omitempty"`
+	Angle       *float32 `json:"angle,omitempty"`
+	Level       *float32 `json:"level_percent,omitempty"`
+
+	WindSpeed     *float32 `json:"wind_speed,omitempty"`
+	WindDirection *float32 `json:"wind_direction,omitempty"`
+	Rain          *float32 `json:"rain_mm,omitempty"`
+	UVIndex       *float32 `json:"uv_index,omitempty"`
+	Noise         *float32 `json:"noise_db,omitempty"`
+
+	Watts   *float32 `json:"watts,omitempty"`
+	KWh     *float32 `json:"kwh,omitempty"`
+	Voltage *float32 `json:"voltage,omitempty"`
+	Current *float32 `json:"current,omitempty"`
+
+	Tampered *bool `json:"tampered,omitempty"`
+	RSSI     *int  `json:"rssi,omitempty"`
+
+	// Fan and filter of sensor boxes that pull air through, in percent of
+	// filter life left
+	FanOn      *bool    `json:"fan_on,omitempty"`
+	FilterLife *float32 `json:"filter_life,omitempty"`
+
+	// Motion is an event rather than a state, like a PIR sensor triggering
+	Motion *bool `json:"motion,omitempty"`
+
+	// Battery voltage and seconds since boot, from version 2 of the payload
+	Battery *float32 `json:"battery,omitempty"`
+	Uptime  *int64   `json:"uptime,omitempty"`
+
+	// Temperatures of sensors with several probes, like {"air": 21.2, "soil": 14.8}
+	Probes map[string]float32 `json:"probes,omitempty"`
+
+	// Values of the metrics the config declares, like {"co2": 612}
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+
+	// Values for transforms to turn into metrics, like {"adc": 1234}
+	Raw map[string]float64 `json:"raw,omitempty"`
+
+	// Status is empty or "ok" for a healthy sensor, otherwise it is a fault
+	// code like "sensor_read_failed" or "low_vcc"
+	Status string `json:"status,omitempty"`
 }
 
-type Measurement struct {
-	SensorID        string          `json:"sensor_id"`
-	SensorTime      int64           `json:"sensor_time"`
-	MeasurementID   string          `json:"measurement_id"`
-	MeasurementData MeasurementData `json:"measurement_data"`
+func (d MeasurementData) Faulted() bool {
+	return d.Status != "" && d.Status != "ok"
 }
 
-// TODO Needs a mutex
-var latestMeasurements map[string]Measurement = map[string]Measurement{}
-
-func process(pc net.PacketConn, address net.Addr, payload []byte) error {
-	var measurement Measurement
-	if err := json.Unmarshal(payload, &measurement); err != nil {
-		return err
-	}
-
-	latestMeasurements[measurement.SensorID] = measurement
-	log.Printf("%s: Temperature <%f> Humidity <%f>\n", measurement.SensorID,
-		measurement.MeasurementData.Temperature, measurement.MeasurementData.Humidity)
-
-	return nil
-}
-
-func receiver() {
-	pc, err := net.ListenPacket("udp", ":3232")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	defer pc.Close()
-
-	for {
-		buf := make([]byte, 1024)
-		n, addr, err := pc.ReadFrom(buf)
-		if err != nil {
+// eventMetrics only hold for the packet they are in.
+var eventMetrics = map[string]bool{"motion": true}
+
+// merge fills in the values that are missing from d with those of previous,
+// so that a packet with only some values does not wipe out the others. The
+// status and events are not merged, they always describe the latest packet.
+func (d MeasurementData) merge(previous MeasurementData) MeasurementData {
+	merged := reflect.ValueOf(&d).Elem()
+	old := reflect.ValueOf(previous)
+	for i := 0; i < merged.NumField(); i++ {
+		if eventMetrics[strings.Split(merged.Type().Field(i).Tag.Get("json"), ",")[0]] {
 			continue
 		}
-
-		if err := process(pc, addr, buf[:n]); err != nil {
-			log.Println("Failed to process packet: ", err)
+		if field := merged.Field(i); field.Kind() == reflect.Ptr && field.IsNil() {
+			field.Set(old.Field(i))
 		}
 	}
+	if len(previous.Metrics) != 0 {
+		metrics := map[string]float64{}
+		for name, value := range previous.Metrics {
+			metrics[name] = value
+		}
+		for name, value := range d.Metrics {
+			metrics[name] = value
+		}
+		d.Metrics = metrics
+	}
+	return d
 }
 
-func createSensor(config SensorConfig, id uint64) (*accessory.Accessory, error) {
-	info := accessory.Info{
-		Name:         config.Name,
-		Manufacturer: "Stefan",
-		Model:        config.Model,
-		SerialNumber: config.Serial,
-		ID:           id,
-	}
+type Measurement struct {
+	Version         int             `json:"version,omitempty"`
+	SensorID        string          `json:"sensor_id"`
+	SensorTime      int64           `json:"sensor_time"`
+	MeasurementID   string          `json:"measurement_id"`
+	MeasurementData MeasurementData `json:"measurement_data"`
+	Sequence        *uint32         `json:"sequence,omitempty"`
+	FirmwareVersion string          `json:"firmware_version,omitempty"`
+}
 
-	ac := accessory.New(info, accessory.TypeSensor)
+func createSensor(config SensorConfig, id uint64) (*accessory.Accessory, error) {
+	ac := accessory.New(accessoryInfo(config, id), accessory.TypeSensor)
 
 	tempSensor := service.NewTemperatureSensor()
+	addServiceName(config, tempSensor.Service, "Temperature")
 
 	tempStatusActive := characteristic.NewStatusActive()
 	tempSensor.AddCharacteristic(tempStatusActive.Characteristic)
@@ -82,23 +125,52 @@ func createSensor(config SensorConfig, id uint64) (*accessory.Accessory, error)
 	tempStatusFault := characteristic.NewStatusFault()
 	tempSensor.AddCharacteristic(tempStatusFault.Characteristic)
 
+	configureTemperature(config.Temperature, tempSensor.CurrentTemperature, addTemperatureUnits(config.Temperature, tempSensor))
+
 	var fetchTemperature = func(serial string) interface{} {
-		log.Printf("fetchTemperature for %s", serial)
-		tempStatusFault.UpdateValue(characteristic.StatusFaultNoFault)
-		if measurement, ok := latestMeasurements[serial]; ok {
+		packetLog.Read("fetchTemperature for %s", serial)
+		if measurement, ok := store.Latest(serial); ok && measurement.MeasurementData.Temperature != nil {
 			tempStatusActive.UpdateValue(true)
-			return measurement.MeasurementData.Temperature
+			if measurement.MeasurementData.Faulted() {
+				tempStatusFault.UpdateValue(characteristic.StatusFaultGeneralFault)
+			} else {
+				tempStatusFault.UpdateValue(characteristic.StatusFaultNoFault)
+			}
+			return config.homeKitValue(*measurement.MeasurementData.Temperature)
 		}
 		tempStatusActive.UpdateValue(false)
 		return 0.0
 	}
 
 	tempSensor.CurrentTemperature.OnValueGet(func() interface{} {
-		log.Println("tempSensor.CurrentTemperature.OnValueGet")
+		packetLog.Read("tempSensor.CurrentTemperature.OnValueGet")
 		return fetchTemperature(config.Serial)
 	})
 
-	tempIntervalTicker := time.NewTicker(time.Second * 60)
+	// Humidity has its own status, it can go stale or come from another
+	// sensor independently of the temperature
+	humiditySensor := service.NewHumiditySensor()
+	addServiceName(config, humiditySensor.Service, "Humidity")
+
+	humidityStatusActive := characteristic.NewStatusActive()
+	humiditySensor.AddCharacteristic(humidityStatusActive.Characteristic)
+
+	var fetchHumidity = func(serial string) interface{} {
+		packetLog.Read("fetchHumidity for %s", serial)
+		if measurement, ok := store.Latest(serial); ok && measurement.MeasurementData.Humidity != nil {
+			humidityStatusActive.UpdateValue(true)
+			return config.homeKitValue(*measurement.MeasurementData.Humidity)
+		}
+		humidityStatusActive.UpdateValue(false)
+		return 0.0
+	}
+
+	humiditySensor.CurrentRelativeHumidity.OnValueGet(func() interface{} {
+		packetLog.Read("humiditySensor.CurrentRelativeHumidity.OnValueGet")
+		return fetchHumidity(config.Serial)
+	})
+
+	tempIntervalTicker := clock.NewTicker(time.Second * 60)
 	tempIntervalTimerChan := make(chan bool)
 
 	go func() {
@@ -106,21 +178,165 @@ func createSensor(config SensorConfig, id uint64) (*accessory.Accessory, error)
 			select {
 			case <-tempIntervalTimerChan:
 				return
-			case <-tempIntervalTicker.C:
+			case <-tempIntervalTicker.Chan():
 				tempSensor.CurrentTemperature.UpdateValue(fetchTemperature(config.Serial))
+				humiditySensor.CurrentRelativeHumidity.UpdateValue(fetchHumidity(config.Serial))
 			}
 		}
 	}()
 
+	addStatusTampered(config, tempSensor.Service)
+
+	if err := addCustomCharacteristics(config, tempSensor.Service); err != nil {
+		return nil, err
+	}
+
 	ac.AddService(tempSensor.Service)
+	ac.AddService(humiditySensor.Service)
+	addProbeServices(config, ac)
+	addFilterServices(config, ac)
+	if err := addMetricServices(config, ac); err != nil {
+		return nil, err
+	}
+	addProfileAlarm(config, ac)
 
 	return ac, nil
 }
 
+func createAccessory(config SensorConfig, id uint64) (*accessory.Accessory, error) {
+	switch config.Type {
+	case "", "sensor", "virtual":
+		return createSensor(config, id)
+	case "switch":
+		return createSwitch(config, id)
+	case "thermostat":
+		return createThermostat(config, id)
+	case "fan":
+		return createFan(config, id)
+	case "window_covering":
+		return createWindowCovering(config, id)
+	case "soil_moisture":
+		return createSoilMoistureSensor(config, id)
+	case "energy_meter":
+		return createEnergyMeter(config, id)
+	case "tank":
+		return createTankSensor(config, id)
+	case "occupancy":
+		return createOccupancySensor(config, id)
+	case "garage_door":
+		return createGarageDoor(config, id)
+	case "contact":
+		return createContactSensor(config, id)
+	default:
+		return nil, fmt.Errorf("unknown accessory type <%s>", config.Type)
+	}
+}
+
 type SensorConfig struct {
-	Serial string `json:"serial"`
-	Name   string `json:"name"`
-	Model  string `json:"model"`
+	Serial  string `json:"serial"`
+	Type    string `json:"type,omitempty"`
+	Name    string `json:"name"`
+	Model   string `json:"model"`
+	HMACKey string `json:"hmac_key,omitempty"`
+
+	// What the Home app shows about the sensor besides the Model, from the
+	// sensor defaults of the bridge when empty
+	Manufacturer     string `json:"manufacturer,omitempty"`
+	FirmwareRevision string `json:"firmware_revision,omitempty"`
+	HardwareRevision string `json:"hardware_revision,omitempty"`
+
+	// Where the sensor is, for grouping in the API and in metrics
+	Room  string   `json:"room,omitempty"`
+	Group string   `json:"group,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+
+	// Optional custom characteristics, like "wind_speed" or "rain"
+	Characteristics []string `json:"characteristics,omitempty"`
+
+	// Thermostat settings, Serial is the relay that drives the heater
+	Sensor            string  `json:"sensor,omitempty"`
+	TargetTemperature float32 `json:"target_temperature,omitempty"`
+	Hysteresis        float32 `json:"hysteresis,omitempty"`
+
+	// Seconds an occupancy sensor stays occupied after the last motion
+	HoldTime int `json:"hold_time,omitempty"`
+
+	// Tilt angles at which a garage door or contact sensor is closed or open
+	Door *DoorConfig `json:"door,omitempty"`
+
+	// Alert when soil moisture drops below or noise rises above these
+	DryThreshold   float32 `json:"dry_threshold,omitempty"`
+	NoiseThreshold float32 `json:"noise_threshold,omitempty"`
+
+	// Alert when a tank drops below or rises above these, in percent
+	LowLevelThreshold  float32 `json:"low_level_threshold,omitempty"`
+	HighLevelThreshold float32 `json:"high_level_threshold,omitempty"`
+
+	// The sensor box has a fan with a filter that needs changing below
+	// FilterThreshold percent of its life, 10 by default
+	Filter          bool    `json:"filter,omitempty"`
+	FilterThreshold float32 `json:"filter_threshold,omitempty"`
+
+	// Alert when the average signal strength drops below this, in dBm
+	RSSIThreshold int `json:"rssi_threshold,omitempty"`
+
+	// Firmware image to offer the sensor, optionally pinned to a version
+	FirmwareImage string `json:"firmware_image,omitempty"`
+	FirmwarePin   string `json:"firmware_pin,omitempty"`
+
+	// Built-in alert for a freezer, fridge or frost, optionally at a custom
+	// temperature
+	Profile  string   `json:"profile,omitempty"`
+	Setpoint *float64 `json:"setpoint,omitempty"`
+
+	// Corrections for values the sensor reports, like {"temperature": {"offset": -0.5}}
+	Calibration map[string]Calibration `json:"calibration,omitempty"`
+
+	// Drop values that are far outside of what the sensor normally reports
+	Anomaly *AnomalyConfig `json:"anomaly,omitempty"`
+
+	// The stages measurements go through, calibration and anomaly detection
+	// by default
+	Pipeline []StageConfig `json:"pipeline,omitempty"`
+
+	// Values that mean a reading failed and are dropped, -127, -999 and
+	// 65535 by default, an empty list drops none
+	Sentinels *[]float64 `json:"sentinels,omitempty"`
+
+	// Units the sensor reports in where they differ from the input units of
+	// the bridge
+	Units *UnitsConfig `json:"units,omitempty"`
+
+	// Decimals of the values HomeKit gets, as the sensor sent them by default
+	Precision *int `json:"precision,omitempty"`
+
+	// Declared metrics to show in HomeKit, like ["co2"]
+	Metrics []string `json:"metrics,omitempty"`
+
+	// Temperature services for the probes of the sensor and what to call
+	// them, like {"soil": "Soil"}
+	Probes map[string]string `json:"probes,omitempty"`
+
+	// Range, step and display unit of the temperature in HomeKit
+	Temperature *TemperatureConfig `json:"temperature,omitempty"`
+
+	// Seconds after which a measurement is too old to be served
+	TTL int `json:"ttl,omitempty"`
+
+	// Seconds over which bursts of measurements become a single HomeKit
+	// notification
+	NotifyWindow int `json:"notify_window,omitempty"`
+
+	// Values taken from other sensors, like {"humidity": "f008d1d4092c"} or
+	// {"temperature": {"sensors": ["a", "b", "c"], "aggregate": "mean"}}
+	Sources map[string]MetricSource `json:"sources,omitempty"`
+
+	// Virtual sensors combine the values of all Members with Aggregate
+	Members   []string `json:"members,omitempty"`
+	Aggregate string   `json:"aggregate,omitempty"`
+
+	// file is where the sensor is defined if it is not in the config file
+	file string
 }
 
 type BridgeConfig struct {
@@ -130,15 +346,122 @@ type BridgeConfig struct {
 	Pin          string         `json:"pin"`
 	Sensors      []SensorConfig `json:"sensors"`
 	Address      string         `json:"address"`
+	Port         string         `json:"port,omitempty"`
+
+	// Disabled runs only ingestion, the API and the logs, without HomeKit
+	Disabled bool `json:"disabled,omitempty"`
+
+	// NameTemplate names sensors that have no name, like "{room} {type}"
+	NameTemplate string `json:"name_template,omitempty"`
+
+	// Manufacturer, model and revisions of the sensors that do not set their
+	// own
+	SensorDefaults *AccessoryMetadata `json:"sensor_defaults,omitempty"`
 }
 
+func (c BridgeConfig) sensor(serial string) (SensorConfig, bool) {
+	for _, sensor := range c.Sensors {
+		if sensor.Serial == serial {
+			return sensor, true
+		}
+	}
+	return SensorConfig{}, false
+}
+
+// ReceiverConfig describes one source of packets. Type is "udp" (the
+// default) or "http", Format is "json" (the default) or "legacy". UDP
+// receivers can be limited to "udp4" or "udp6" with Network and can join the
+// multicast Group on Interface. MaxPacketSize defaults to 1024 bytes and
+// ReadBuffer, when set, raises the socket receive buffer. Parsing is either
+// "strict" or "lenient" to validate packets field by field. Encoding is
+// "json" (the default), "cbor", "msgpack" or "auto" to detect it per packet,
+// or the name of a decoder plugin. Rules decode the packets from some subnets
+// differently.
 type ReceiverConfig struct {
-	Port int `json:"port"`
+	Tag       string `json:"tag"`
+	Type      string `json:"type"`
+	Network   string `json:"network"`
+	Port      int    `json:"port"`
+	Address   string `json:"address"`
+	Group     string `json:"group"`
+	Interface string `json:"interface"`
+	Format    string `json:"format"`
+	Encoding  string `json:"encoding"`
+	Parsing   string `json:"parsing"`
+	Ack       bool   `json:"ack"`
+
+	MaxPacketSize int `json:"max_packet_size"`
+	ReadBuffer    int `json:"read_buffer"`
+
+	// MaxDecompressedSize caps gzip and zlib payloads, 64 KiB by default
+	MaxDecompressedSize int `json:"max_decompressed_size"`
+
+	// IdleRebind binds a UDP receiver again after this many seconds without
+	// a packet, for multicast groups that are lost when an interface bounces
+	IdleRebind int `json:"idle_rebind,omitempty"`
+
+	Rules []DecodingRule `json:"rules,omitempty"`
 }
 
 type Config struct {
-	Receiver ReceiverConfig `json:"receiver"`
-	Bridge   BridgeConfig   `json:"bridge"`
+	Receiver     ReceiverConfig     `json:"receiver"`
+	Receivers    []ReceiverConfig   `json:"receivers"`
+	Bridge       BridgeConfig       `json:"bridge"`
+	API          APIConfig          `json:"api"`
+	Provisioning ProvisioningConfig `json:"provisioning"`
+	Discovery    DiscoveryConfig    `json:"discovery"`
+	RateLimit    RateLimitConfig    `json:"rate_limit"`
+	Quarantine   QuarantineConfig   `json:"quarantine"`
+	Clock        ClockConfig        `json:"clock"`
+	Replay       ReplayConfig       `json:"replay"`
+	Reporting    ReportingConfig    `json:"reporting"`
+	Firmware     FirmwareConfig     `json:"firmware"`
+
+	MeasurementLog RotateConfig        `json:"measurement_log"`
+	AuditLog       RotateConfig        `json:"audit_log"`
+	Logging        LoggingConfig       `json:"logging"`
+	Notifications  NotificationsConfig `json:"notifications"`
+	AlertRules     []AlertRule         `json:"alert_rules"`
+
+	// Run as one of a primary and standby pair
+	HA HAConfig `json:"ha"`
+
+	// Upstream bridges to forward packets to
+	Relays []RelayConfig `json:"relays,omitempty"`
+
+	// Values sensors report beyond the built-in ones, by name
+	Metrics map[string]MetricConfig `json:"metrics,omitempty"`
+
+	// Units sensors report in and that sinks get
+	Units UnitSystemConfig `json:"units"`
+
+	// Decoder plugins for payload formats the bridge does not know, by name
+	Decoders map[string]DecoderConfig `json:"decoders,omitempty"`
+
+	// SensorsDir holds more sensors, one per JSON file, relative to the
+	// config file
+	SensorsDir string `json:"sensors_dir,omitempty"`
+}
+
+// receivers returns the configured receivers, falling back to the single
+// receiver of older configurations.
+func (c Config) receivers() []ReceiverConfig {
+	if len(c.Receivers) == 0 {
+		receiver := c.Receiver
+		if receiver.Tag == "" {
+			receiver.Tag = "default"
+		}
+		return []ReceiverConfig{receiver}
+	}
+
+	receivers := make([]ReceiverConfig, len(c.Receivers))
+	for i, receiver := range c.Receivers {
+		if receiver.Tag == "" {
+			receiver.Tag = fmt.Sprintf("receiver%d", i)
+		}
+		receivers[i] = receiver
+	}
+	return receivers
 }
 
 func createBridge(config BridgeConfig) (*accessory.Bridge, error) {
@@ -152,16 +475,115 @@ func createBridge(config BridgeConfig) (*accessory.Bridge, error) {
 	return accessory.NewBridge(bridgeInfo), nil
 }
 
+const (
+	configPath  = "sensor-bridge.json"
+	storagePath = "data"
+)
+
+func loadConfig(path string) (Config, error) {
+	encodedConfig, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	if encodedConfig, err = interpolate(encodedConfig, filepath.Dir(path)); err != nil {
+		return Config{}, err
+	}
+
+	config := Config{
+		Receiver:     ReceiverConfig{Port: 3232},
+		Provisioning: ProvisioningConfig{ReportInterval: 60},
+		Logging: LoggingConfig{
+			SampleEvery: 1,
+			LogReads:    true,
+			HomeKit:     true,
+		},
+		MeasurementLog: RotateConfig{
+			MaxSizeMB: 10,
+			MaxFiles:  10,
+			Compress:  true,
+		},
+	}
+	if err := json.Unmarshal(encodedConfig, &config); err != nil {
+		return Config{}, err
+	}
+
+	if config.SensorsDir != "" {
+		sensors, err := loadSensorsDir(config.sensorsDir(path))
+		if err != nil {
+			return Config{}, err
+		}
+		config.Bridge.Sensors = append(config.Bridge.Sensors, sensors...)
+	}
+	if err := declareMetrics(config.Metrics); err != nil {
+		return Config{}, err
+	}
+	if err := config.Units.validate(); err != nil {
+		return Config{}, err
+	}
+	if err := validateReceivers(config.receivers()); err != nil {
+		return Config{}, err
+	}
+	if err := validateSensors(config.Bridge.Sensors); err != nil {
+		return Config{}, err
+	}
+
+	for i, sensor := range config.Bridge.Sensors {
+		config.Bridge.Sensors[i].Name = sensor.expandName(config.Bridge.NameTemplate)
+	}
+
+	return config, nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "approve":
+			approveCommand(os.Args[2:])
+		case "status":
+			statusCommand(os.Args[2:])
+		case "top":
+			topCommand(os.Args[2:])
+		case "check":
+			checkCommand(os.Args[2:])
+		case "snapshot":
+			snapshotCommand(os.Args[2:])
+		case "supervise":
+			superviseCommand(os.Args[2:])
+		case "loadtest":
+			loadtestCommand(os.Args[2:])
+		case "e2e":
+			e2eCommand(os.Args[2:])
+		case "emulate":
+			emulateCommand(os.Args[2:])
+		case "dump-accessories":
+			dumpAccessoriesCommand(os.Args[2:])
+		case "trace":
+			traceCommand(os.Args[2:])
+		case "doctor":
+			doctorCommand(os.Args[2:])
+		case "export":
+			exportCommand(os.Args[2:])
+		case "import":
+			importCommand(os.Args[2:])
+		case "install-service":
+			installServiceCommand(os.Args[2:])
+		default:
+			log.Fatalf("Unknown command <%s>", os.Args[1])
+		}
+		return
+	}
+
 	log.Println("[*] Starting sensor-hub")
-	encodedConfig, err := ioutil.ReadFile("sensor-bridge.json")
+	config, err := loadConfig(configPath)
 	if err != nil {
 		log.Fatal("Could not load config file: ", err)
 	}
+	setLiveConfig(config)
 
-	var config Config
-	if err := json.Unmarshal(encodedConfig, &config); err != nil {
-		log.Fatal("Could not parse config file: ", err)
+	configureLogging(config.Logging)
+
+	if err := configureHA(config.HA); err != nil {
+		log.Fatal("Could not configure high availability: ", err)
 	}
 
 	// Create the bridge and sensors
@@ -170,37 +592,99 @@ func main() {
 	if err != nil {
 		log.Fatal("Could not create bridge: ", err)
 	}
+	registerBridge(bridge.Accessory)
+
+	if err := accessoryIDs.Load(); err != nil {
+		log.Fatal("Could not load accessory IDs: ", err)
+	}
 
 	var sensors []*accessory.Accessory
-	for i, sensorConfig := range config.Bridge.Sensors {
-		sensor, err := createSensor(sensorConfig, 2+uint64(i))
+	for _, sensorConfig := range config.Bridge.Sensors {
+		id, err := accessoryIDs.ID(sensorConfig.Serial)
+		if err != nil {
+			log.Fatal("Could not assign accessory ID: ", err)
+		}
+		sensor, err := createAccessory(sensorConfig, id)
 		if err != nil {
 			log.Fatalf("Could not create sensor <%s>: %v", sensorConfig.Serial, err)
 		}
 		sensors = append(sensors, sensor)
+		registerAccessory(sensorConfig.Serial, sensor)
+		store.SetTTL(sensorConfig.Serial, time.Duration(sensorConfig.TTL)*time.Second)
+		store.SetMetadata(sensorConfig.Serial, Metadata{Room: sensorConfig.Room, Group: sensorConfig.Group, Tags: sensorConfig.Tags})
+		for metric, source := range sensorConfig.sources() {
+			if err := store.AddSource(sensorConfig.Serial, metric, source); err != nil {
+				log.Fatalf("Could not configure sources of <%s>: %v", sensorConfig.Serial, err)
+			}
+		}
+		watchAlerts(sensorConfig.Serial)
+		watchRollups(sensorConfig)
+		if err := validateSensor(sensorConfig); err != nil {
+			log.Fatalf("Could not configure sensor <%s>: %v", sensorConfig.Serial, err)
+		}
+		watchRules(sensorConfig.Serial)
+		addHardwareRevision(sensorConfig, sensor)
+		watchFirmwareRevision(sensorConfig, sensor)
 	}
 
 	// Start it
 
-	hcConfig := hc.Config{
-		Pin:         config.Bridge.Pin,
-		StoragePath: "data",
-		IP:          config.Bridge.Address,
+	if err := pendingSensors.Load(); err != nil {
+		log.Fatal("Could not load pending sensors: ", err)
 	}
 
-	transport, err := hc.NewIPTransport(hcConfig, bridge.Accessory, sensors...)
-	if err != nil {
-		log.Fatal("Could not create ip transport: ", err)
+	firmware.Configure(config.Firmware)
+	configureRateLimits(config.RateLimit)
+	configureClock(config.Clock)
+	configureReplay(config.Replay)
+	if err := configureDecoders(config.Decoders); err != nil {
+		log.Fatal("Could not configure decoders: ", err)
+	}
+	if err := configureRelays(config.Relays); err != nil {
+		log.Fatal("Could not configure relays: ", err)
+	}
+	if err := configureNotifications(config.Notifications); err != nil {
+		log.Fatal("Could not configure notifications: ", err)
+	}
+	if err := validateRules(config.AlertRules); err != nil {
+		log.Fatal("Could not configure alert rules: ", err)
+	}
+	if err := configureReporting(config.Reporting); err != nil {
+		log.Fatal("Could not configure reporting: ", err)
+	}
+	if n, err := backfillRollups(config.MeasurementLog, config.Units); err != nil {
+		log.Println("[!] Could not backfill rollups from the measurement log: ", err)
+	} else if n != 0 {
+		log.Printf("[*] Backfilled rollups with %d measurements from the measurement log", n)
 	}
 
-	// On termination we stop all timers and then the transport
+	if err := openMeasurementLog(config.MeasurementLog); err != nil {
+		log.Fatal("Could not open measurement log: ", err)
+	}
+	if err := openAuditLog(config.AuditLog); err != nil {
+		log.Fatal("Could not open audit log: ", err)
+	}
 
-	hc.OnTermination(func() {
-		// TODO Stop all Accessory timers ...
-		<-transport.Stop()
-	})
+	startReceivers(config)
+	go watchReload()
+	go watchSnapshots()
+	if config.HA.Role == "standby" {
+		go watchPeer()
+	}
+	if config.SensorsDir != "" {
+		go watchSensorsDir(config.sensorsDir(configPath))
+	}
+	announce(config)
+
+	if config.API.Address != "" {
+		go serveAPI(config.API, config.Firmware)
+	}
 
-	transport.Start()
+	if config.Bridge.Disabled {
+		runWithoutHomeKit()
+	} else {
+		runHomeKit(config, bridge, sensors)
+	}
 
 	log.Println("[*] Done")
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
+
+// createSoilMoistureSensor exposes the moisture percentage of a soil probe as
+// a humidity sensor, HomeKit has no dedicated soil moisture service.
+func createSoilMoistureSensor(config SensorConfig, id uint64) (*accessory.Accessory, error) {
+	ac := accessory.New(accessoryInfo(config, id), accessory.TypeSensor)
+
+	moistureSensor := service.NewHumiditySensor()
+
+	addServiceName(config, moistureSensor.Service, "Moisture")
+
+	statusActive := characteristic.NewStatusActive()
+	moistureSensor.AddCharacteristic(statusActive.Characteristic)
+
+	var fetchMoisture = func() interface{} {
+		if measurement, ok := store.Latest(config.Serial); ok && measurement.MeasurementData.Moisture != nil {
+			statusActive.UpdateValue(true)
+			return config.homeKitValue(*measurement.MeasurementData.Moisture)
+		}
+		statusActive.UpdateValue(false)
+		return 0.0
+	}
+
+	moistureSensor.CurrentRelativeHumidity.OnValueGet(fetchMoisture)
+
+	addStatusTampered(config, moistureSensor.Service)
+
+	onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+		if measurement.MeasurementData.Moisture == nil {
+			return
+		}
+
+		moistureSensor.CurrentRelativeHumidity.UpdateValue(config.homeKitValue(*measurement.MeasurementData.Moisture))
+	})
+
+	ac.AddService(moistureSensor.Service)
+
+	return ac, nil
+}
+
+// createTankSensor exposes the fill level of a cistern or sump as a humidity
+// sensor, like soil moisture HomeKit has no service for a percentage.
+func createTankSensor(config SensorConfig, id uint64) (*accessory.Accessory, error) {
+	ac := accessory.New(accessoryInfo(config, id), accessory.TypeSensor)
+
+	levelSensor := service.NewHumiditySensor()
+
+	addServiceName(config, levelSensor.Service, "Level")
+
+	statusActive := characteristic.NewStatusActive()
+	levelSensor.AddCharacteristic(statusActive.Characteristic)
+
+	levelSensor.CurrentRelativeHumidity.OnValueGet(func() interface{} {
+		if measurement, ok := store.Latest(config.Serial); ok && measurement.MeasurementData.Level != nil {
+			statusActive.UpdateValue(true)
+			return config.homeKitValue(*measurement.MeasurementData.Level)
+		}
+		statusActive.UpdateValue(false)
+		return 0.0
+	})
+
+	addStatusTampered(config, levelSensor.Service)
+
+	onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+		if measurement.MeasurementData.Level == nil {
+			return
+		}
+
+		levelSensor.CurrentRelativeHumidity.UpdateValue(config.homeKitValue(*measurement.MeasurementData.Level))
+	})
+
+	ac.AddService(levelSensor.Service)
+
+	return ac, nil
+}
+
+// createEnergyMeter exposes a power monitor as an outlet that is always on,
+// which is how the Eve app expects to find its energy characteristics.
+func createEnergyMeter(config SensorConfig, id uint64) (*accessory.Accessory, error) {
+	ac := accessory.New(accessoryInfo(config, id), accessory.TypeOutlet)
+
+	outlet := service.NewOutlet()
+	outlet.On.SetValue(true)
+	outlet.On.Perms = characteristic.PermsRead()
+
+	onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+		if watts := measurement.MeasurementData.Watts; watts != nil {
+			outlet.OutletInUse.SetValue(*watts > 0)
+		}
+	})
+
+	if len(config.Characteristics) == 0 {
+		config.Characteristics = []string{"voltage", "current", "watts", "kwh"}
+	}
+
+	if err := addCustomCharacteristics(config, outlet.Service); err != nil {
+		return nil, err
+	}
+
+	ac.AddService(outlet.Service)
+
+	return ac, nil
+}
+
+const defaultHoldTime = 5 * time.Minute
+
+// createOccupancySensor turns the motion events of a sensor into occupancy,
+// which stays detected until there has been no motion for the hold time.
+// Automations handle that better than a short blip per motion.
+func createOccupancySensor(config SensorConfig, id uint64) (*accessory.Accessory, error) {
+	ac := accessory.New(accessoryInfo(config, id), accessory.TypeSensor)
+
+	occupancy := service.NewOccupancySensor()
+	addServiceName(config, occupancy.Service, "Occupancy")
+
+	hold := defaultHoldTime
+	if config.HoldTime > 0 {
+		hold = time.Duration(config.HoldTime) * time.Second
+	}
+
+	var mutex sync.Mutex
+	var timer Timer
+
+	// Every event counts, so these updates are not coalesced
+	store.OnUpdate(config.Serial, func(measurement Measurement) {
+		if motion := measurement.MeasurementData.Motion; motion == nil || !*motion {
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		occupancy.OccupancyDetected.SetValue(characteristic.OccupancyDetectedOccupancyDetected)
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = clock.AfterFunc(hold, func() {
+			occupancy.OccupancyDetected.SetValue(characteristic.OccupancyDetectedOccupancyNotDetected)
+		})
+	})
+
+	addStatusTampered(config, occupancy.Service)
+
+	ac.AddService(occupancy.Service)
+
+	return ac, nil
+}
+
+// addStatusTampered mirrors the optional tampered flag that sensors with an
+// enclosure switch include in their reports.
+func addStatusTampered(config SensorConfig, svc *service.Service) {
+	tampered := characteristic.NewStatusTampered()
+
+	onHomeKitUpdate(config.Serial, config.notifyWindow(), func(measurement Measurement) {
+		if measurement.MeasurementData.Tampered == nil {
+			return
+		}
+		if *measurement.MeasurementData.Tampered {
+			tampered.SetValue(characteristic.StatusTamperedTampered)
+		} else {
+			tampered.SetValue(characteristic.StatusTamperedNotTampered)
+		}
+	})
+
+	svc.AddCharacteristic(tampered.Characteristic)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+func (c Config) sensorsDir(configPath string) string {
+	if filepath.IsAbs(c.SensorsDir) {
+		return c.SensorsDir
+	}
+	return filepath.Join(filepath.Dir(configPath), c.SensorsDir)
+}
+
+// sensorFiles returns the sensor files in dir in the order they are loaded.
+// Hidden files are skipped, so are the temporary files of editors.
+func sensorFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// loadSensorsDir reads the sensors in dir, one per file.
+func loadSensorsDir(dir string) ([]SensorConfig, error) {
+	files, err := sensorFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var sensors []SensorConfig
+	for _, file := range files {
+		encoded, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if encoded, err = interpolate(encoded, filepath.Dir(file)); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		var sensor SensorConfig
+		if err := json.Unmarshal(encoded, &sensor); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if sensor.Serial == "" {
+			return nil, fmt.Errorf("%s: sensor has no serial", file)
+		}
+		sensor.file = file
+		sensors = append(sensors, sensor)
+	}
+	return sensors, nil
+}
+
+// validateSensors checks that every sensor is configured only once, which
+// is easy to get wrong with sensors spread over several files.
+func validateSensors(sensors []SensorConfig) error {
+	seen := map[string]string{}
+	for _, sensor := range sensors {
+		file := sensor.file
+		if file == "" {
+			file = "the config file"
+		}
+		if other, ok := seen[sensor.Serial]; ok {
+			return fmt.Errorf("sensor <%s> is configured in both %s and %s", sensor.Serial, other, file)
+		}
+		seen[sensor.Serial] = file
+	}
+	return nil
+}
+
+// sensorsDirState is the names, sizes and modification times of the files in
+// a directory, to tell when something changed.
+func sensorsDirState(dir string) string {
+	files, err := sensorFiles(dir)
+	if err != nil {
+		return ""
+	}
+
+	var state []string
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			state = append(state, fmt.Sprintf("%s:%d:%d", file, info.Size(), info.ModTime().UnixNano()))
+		}
+	}
+	return strings.Join(state, "\n")
+}
+
+// watchSensorsDir reloads the config when a sensor file is added, changed or
+// removed.
+func watchSensorsDir(dir string) {
+	state := sensorsDirState(dir)
+	ticker := clock.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for range ticker.Chan() {
+		if current := sensorsDirState(dir); current != state {
+			state = current
+			log.Printf("[*] Sensors in <%s> changed", dir)
+			if err := reloadConfig(); err != nil {
+				log.Println("Could not reload config: ", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// StateSnapshot is everything the bridge knows at one moment, for debugging
+// a problem after the fact.
+type StateSnapshot struct {
+	Time        time.Time           `json:"time"`
+	GoVersion   string              `json:"go_version"`
+	Goroutines  int                 `json:"goroutines"`
+	ConfigHash  string              `json:"config_hash"`
+	Health      map[string]bool     `json:"health"`
+	Sensors     []SensorState       `json:"sensors"`
+	Alerts      []Alert             `json:"alerts"`
+	Pending     []PendingSensor     `json:"pending"`
+	Quarantined []QuarantinedSensor `json:"quarantined"`
+}
+
+// configHash identifies the running config without revealing it.
+func configHash(config Config) string {
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+func takeSnapshot() StateSnapshot {
+	return StateSnapshot{
+		Time:        clock.Now(),
+		GoVersion:   runtime.Version(),
+		Goroutines:  runtime.NumGoroutine(),
+		ConfigHash:  configHash(liveConfig()),
+		Health:      health.checks(storagePath),
+		Sensors:     store.Snapshot(),
+		Alerts:      alerts.List(),
+		Pending:     pendingWithoutKeys(),
+		Quarantined: quarantine.List(),
+	}
+}
+
+// pendingWithoutKeys lists the pending sensors without the keys they are to
+// sign with once approved.
+func pendingWithoutKeys() []PendingSensor {
+	sensors := pendingSensors.List()
+	for i := range sensors {
+		sensors[i].HMACKey = ""
+	}
+	return sensors
+}
+
+func writeSnapshot(path string, snapshot StateSnapshot) error {
+	encoded, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(encoded, '\n'), 0600)
+}
+
+func snapshotName(t time.Time) string {
+	return "snapshot-" + t.Format("20060102-150405") + ".json"
+}
+
+// watchSnapshots writes a snapshot to the storage directory on SIGUSR1.
+func watchSnapshots() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		snapshot := takeSnapshot()
+		path := filepath.Join(storagePath, snapshotName(snapshot.Time))
+		if err := writeSnapshot(path, snapshot); err != nil {
+			log.Println("[!] Could not write snapshot: ", err)
+			continue
+		}
+		log.Printf("[*] Wrote snapshot to <%s>", path)
+	}
+}
+
+// handleSnapshot handles GET /api/v1/snapshot
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(takeSnapshot()); err != nil {
+		log.Println("Failed to encode snapshot: ", err)
+	}
+}
+
+// snapshotCommand fetches a snapshot from the running bridge and writes it
+// to the given file, or to a timestamped file in the current directory.
+func snapshotCommand(args []string) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatal("Could not load config file: ", err)
+	}
+
+	if config.API.Address == "" {
+		log.Fatal("The API is not enabled in the config file, send SIGUSR1 to the bridge instead")
+	}
+
+	var snapshot StateSnapshot
+	if err := fetchAPI(config.API, "/api/v1/snapshot", &snapshot); err != nil {
+		log.Fatal("Could not fetch snapshot: ", err)
+	}
+
+	path := snapshotName(snapshot.Time)
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if err := writeSnapshot(path, snapshot); err != nil {
+		log.Fatal("Could not write snapshot: ", err)
+	}
+	fmt.Println("Wrote snapshot to", path)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotHidesPendingKeys(t *testing.T) {
+	usePendingSensors(t)
+	pending, err := pendingSensors.Register("f0:08:d1:d4:09:2c", &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := json.Marshal(takeSnapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(encoded), pending.SensorID) {
+		t.Fatal("snapshot does not list the pending sensor")
+	}
+	if strings.Contains(string(encoded), pending.HMACKey) {
+		t.Fatal("snapshot reveals the key of a pending sensor")
+	}
+	if sensors := pendingSensors.List(); sensors[0].HMACKey != pending.HMACKey {
+		t.Fatal("snapshot removed the key of the pending sensor itself")
+	}
+}
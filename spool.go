@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Spool is a bounded queue of packets that is kept on disk, so that packets
+// for an unreachable upstream survive a restart. Packets are appended to the
+// file as base64 lines and the file is rewritten once it holds twice as many
+// as are still queued. A full spool drops its oldest packet.
+type Spool struct {
+	mutex   sync.Mutex
+	path    string
+	max     int
+	packets [][]byte
+	file    *os.File
+	lines   int
+	head    uint64 // packets ever removed from the front
+	dropped uint64
+}
+
+func openSpool(path string, max int) (*Spool, error) {
+	s := &Spool{path: path, max: max}
+
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			// A line cut short by a crash is skipped
+			if packet, err := base64.StdEncoding.DecodeString(scanner.Text()); err == nil {
+				s.packets = append(s.packets, packet)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		if len(s.packets) > max {
+			s.packets = s.packets[len(s.packets)-max:]
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := s.rewrite(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Len returns the number of packets in the spool.
+func (s *Spool) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.packets)
+}
+
+// Dropped returns the number of packets a full spool had to drop.
+func (s *Spool) Dropped() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dropped
+}
+
+// Push adds a copy of a packet to the end of the spool.
+func (s *Spool) Push(packet []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.packets = append(s.packets, append([]byte(nil), packet...))
+	if len(s.packets) > s.max {
+		s.packets = s.packets[1:]
+		s.head++
+		s.dropped++
+	}
+
+	if s.file == nil || s.lines >= 2*s.max {
+		return s.rewrite()
+	}
+	if _, err := s.file.WriteString(base64.StdEncoding.EncodeToString(packet) + "\n"); err != nil {
+		return err
+	}
+	s.lines++
+	return nil
+}
+
+// Peek returns copies of up to n packets from the front of the spool and
+// where the front is, so that they can be sent without holding the spool.
+func (s *Spool) Peek(n int) ([][]byte, uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var packets [][]byte
+	for i := 0; i < n && i < len(s.packets); i++ {
+		packets = append(packets, append([]byte(nil), s.packets[i]...))
+	}
+	return packets, s.head
+}
+
+// Discard removes the first n packets of a Peek at head once they were sent.
+// Those a full spool dropped in the meantime are gone already.
+func (s *Spool) Discard(head uint64, n int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.discard(n - int(s.head-head))
+}
+
+// discard removes n sent packets. The caller must hold the lock.
+func (s *Spool) discard(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if n > len(s.packets) {
+		n = len(s.packets)
+	}
+
+	// Sent packets stay in the file until half of it is stale, after a
+	// restart they go out again and the upstream takes them as duplicates
+	s.packets = s.packets[n:]
+	s.head += uint64(n)
+	if len(s.packets) == 0 || s.lines >= 2*len(s.packets) {
+		return s.rewrite()
+	}
+	return nil
+}
+
+// rewrite replaces the file with the packets that are queued.
+func (s *Spool) rewrite() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, packet := range s.packets {
+		w.WriteString(base64.StdEncoding.EncodeToString(packet) + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.lines = len(s.packets)
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func spoolContents(s *Spool) []string {
+	packets, _ := s.Peek(s.Len())
+	var contents []string
+	for _, packet := range packets {
+		contents = append(contents, string(packet))
+	}
+	return contents
+}
+
+func TestSpoolDiscardAfterDrop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.spool")
+	s, err := openSpool(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, packet := range []string{"1", "2", "3"} {
+		if err := s.Push([]byte(packet)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// While 1 and 2 are sent the full spool drops 1 for 4
+	packets, head := s.Peek(2)
+	if len(packets) != 2 || string(packets[0]) != "1" {
+		t.Fatalf("unexpected peek %q", packets)
+	}
+	if err := s.Push([]byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Discard(head, len(packets)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := spoolContents(s); len(got) != 2 || got[0] != "3" || got[1] != "4" {
+		t.Fatalf("spool holds %q, want [3 4]", got)
+	}
+
+	reopened, err := openSpool(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := spoolContents(reopened); len(got) < 2 || got[len(got)-2] != "3" || got[len(got)-1] != "4" {
+		t.Fatalf("reopened spool holds %q", got)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// apiURL turns the configured listen address into a URL we can connect to.
+func apiURL(config APIConfig, path string) string {
+	address := config.Address
+	if strings.HasPrefix(address, ":") {
+		address = "localhost" + address
+	}
+	scheme := "http://"
+	if config.TLS != nil {
+		scheme = "https://"
+	}
+	return scheme + address + path
+}
+
+func fetchAPI(config APIConfig, path string, v interface{}) error {
+	return requestAPI(config, http.MethodGet, path, v)
+}
+
+func requestAPI(config APIConfig, method, path string, v interface{}) error {
+	request, err := http.NewRequest(method, apiURL(config, path), nil)
+	if err != nil {
+		return err
+	}
+	config.authorize(request)
+
+	response, err := config.client().Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", path, response.Status)
+	}
+
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+func formatAge(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
+
+func statusCommand(args []string) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatal("Could not load config file: ", err)
+	}
+
+	if config.API.Address == "" {
+		log.Fatal("The API is not enabled in the config file")
+	}
+
+	var states []SensorState
+	if err := fetchAPI(config.API, "/api/v1/sensors", &states); err != nil {
+		log.Fatal("Could not fetch sensors: ", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SENSOR\tNAME\tFIRST SEEN\tLAST SEEN\tPACKETS\tERRORS\tLOST\tINTERVAL")
+	for _, state := range states {
+		name := "-"
+		if sensor, ok := config.Bridge.sensor(state.SensorID); ok {
+			name = sensor.Name
+		}
+		interval := time.Duration(state.Interval * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", state.SensorID, name,
+			formatAge(state.Stats.FirstSeen), formatAge(state.Stats.LastSeen),
+			state.Stats.Received, state.Stats.ParseErrors, state.Stats.Lost,
+			interval)
+	}
+	w.Flush()
+}
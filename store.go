@@ -0,0 +1,661 @@
+package main
+
+import (
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SensorStats struct {
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+	Received     uint64    `json:"received"`
+	ParseErrors  uint64    `json:"parse_errors"`
+	Lost         uint64    `json:"lost"`
+	Duplicates   uint64    `json:"duplicates"`
+	RateLimited  uint64    `json:"rate_limited"`
+	Encoding     string    `json:"encoding,omitempty"`
+	LastSequence uint32    `json:"last_sequence"`
+	OutOfOrder   uint64    `json:"out_of_order"`
+	Replayed     uint64    `json:"replayed"`
+
+	// Clock is ok, skewed or bogus for sensors that report their time
+	Clock     string   `json:"clock,omitempty"`
+	ClockSkew *float64 `json:"clock_skew_seconds,omitempty"`
+
+	// Moving averages of the seconds from the sensor time to the bridge and
+	// from the bridge to HomeKit
+	Latency   *float64 `json:"latency_seconds,omitempty"`
+	NotifyLag *float64 `json:"notify_lag_seconds,omitempty"`
+
+	RSSI        *int     `json:"rssi,omitempty"`
+	RSSIAverage *float64 `json:"rssi_average,omitempty"`
+	LinkQuality string   `json:"link_quality,omitempty"`
+
+	sequenced bool
+}
+
+// trackRSSI keeps a moving average of the signal strength so that a single
+// bad reading does not make a sensor look like it is drifting out of range.
+func (s *SensorStats) trackRSSI(rssi *int) {
+	if rssi == nil {
+		return
+	}
+
+	value := *rssi
+	s.RSSI = &value
+
+	s.RSSIAverage = movingAverage(s.RSSIAverage, float64(value))
+	s.LinkQuality = linkQuality(*s.RSSIAverage)
+}
+
+func linkQuality(rssi float64) string {
+	switch {
+	case rssi >= -60:
+		return "excellent"
+	case rssi >= -70:
+		return "good"
+	case rssi >= -80:
+		return "fair"
+	default:
+		return "poor"
+	}
+}
+
+// AverageInterval returns the average time between two reports of the sensor.
+func (s SensorStats) AverageInterval() time.Duration {
+	if s.Received < 2 {
+		return 0
+	}
+	return s.LastSeen.Sub(s.FirstSeen) / time.Duration(s.Received-1)
+}
+
+// LossRatio returns the fraction of packets that never arrived, based on gaps
+// in the sequence numbers reported by the sensor.
+func (s SensorStats) LossRatio() float64 {
+	if s.Received+s.Lost == 0 {
+		return 0
+	}
+	return float64(s.Lost) / float64(s.Received+s.Lost)
+}
+
+// track records a received packet and returns false if it is a duplicate of
+// the previous one, which happens when a sensor retransmits after a lost ACK.
+func (s *SensorStats) track(sequence *uint32) bool {
+	if sequence != nil {
+		seq := *sequence
+		if s.sequenced && seq == s.LastSequence {
+			s.Duplicates++
+			return false
+		}
+		// A sequence that goes backwards most likely means the sensor rebooted
+		if s.sequenced && seq > s.LastSequence {
+			s.Lost += uint64(seq - s.LastSequence - 1)
+		}
+		s.sequenced = true
+		s.LastSequence = seq
+	}
+
+	now := clock.Now()
+	if s.FirstSeen.IsZero() {
+		s.FirstSeen = now
+	}
+	s.LastSeen = now
+
+	s.Received++
+	return true
+}
+
+type Metadata struct {
+	Room  string   `json:"room,omitempty"`
+	Group string   `json:"group,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// matches returns true if the metadata has the room, group and tag. Empty
+// values match anything.
+func (m Metadata) matches(room, group, tag string) bool {
+	if room != "" && room != m.Room {
+		return false
+	}
+	if group != "" && group != m.Group {
+		return false
+	}
+	if tag == "" {
+		return true
+	}
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type Diagnostics struct {
+	Status string    `json:"status"`
+	Since  time.Time `json:"since"`
+}
+
+// SensorState is what we know about a sensor. Measurement is nil once the
+// latest measurement of the sensor has outlived its TTL.
+type SensorState struct {
+	SensorID string `json:"sensor_id"`
+	Metadata
+	Measurement *Measurement `json:"measurement"`
+	Stats       SensorStats  `json:"stats"`
+	Interval    float64      `json:"average_interval_seconds"`
+	Diagnostics *Diagnostics `json:"diagnostics,omitempty"`
+
+	FirmwareVersion string `json:"firmware_version,omitempty"`
+
+	// Virtual is set for sensors whose values come from other sensors
+	Virtual bool `json:"virtual,omitempty"`
+
+	// Updated is when each of the values in Measurement was last reported
+	Updated map[string]time.Time `json:"updated,omitempty"`
+}
+
+// source routes one value of physical sensors to a logical sensor. A nil
+// aggregate passes on the value that was reported last, unless the route
+// fails over from one sensor to the next after staleAfter.
+type source struct {
+	sensorID   string
+	metric     string
+	probe      string
+	sensors    []string
+	aggregate  func([]float64) float64
+	failover   bool
+	staleAfter time.Duration
+}
+
+// value is what the route takes from data, the named probe or the metric.
+func (r source) value(data MeasurementData) (reflect.Value, bool) {
+	if r.probe != "" {
+		v, ok := data.Probes[r.probe]
+		return reflect.ValueOf(&v), ok
+	}
+	v, ok := metricValues(data)[r.metric]
+	return v, ok
+}
+
+type Store struct {
+	mutex        sync.RWMutex
+	measurements map[string]Measurement
+	stats        map[string]*SensorStats
+	addresses    map[string]net.Addr
+	diagnostics  map[string]Diagnostics
+	firmware     map[string]string
+	received     map[string]time.Time
+	taken        map[string]time.Time
+	updated      map[string]map[string]time.Time
+	ttls         map[string]time.Duration
+	sources      map[string][]source
+	active       map[string]string
+	virtual      map[string]bool
+	metadata     map[string]Metadata
+	listeners    map[string][]func(Measurement)
+	subscribers  map[chan Measurement]bool
+}
+
+func newStore() *Store {
+	return &Store{
+		measurements: map[string]Measurement{},
+		stats:        map[string]*SensorStats{},
+		addresses:    map[string]net.Addr{},
+		diagnostics:  map[string]Diagnostics{},
+		firmware:     map[string]string{},
+		received:     map[string]time.Time{},
+		taken:        map[string]time.Time{},
+		updated:      map[string]map[string]time.Time{},
+		ttls:         map[string]time.Duration{},
+		sources:      map[string][]source{},
+		active:       map[string]string{},
+		virtual:      map[string]bool{},
+		metadata:     map[string]Metadata{},
+		listeners:    map[string][]func(Measurement){},
+		subscribers:  map[chan Measurement]bool{},
+	}
+}
+
+var store = newStore()
+
+// metricValues returns the values present in data by their JSON name.
+func metricValues(data MeasurementData) map[string]reflect.Value {
+	values := map[string]reflect.Value{}
+	v := reflect.ValueOf(data)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() != reflect.Ptr || field.IsNil() {
+			continue
+		}
+		values[strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]] = field
+	}
+	for name, value := range data.Metrics {
+		if isDeclaredMetric(name) {
+			value := value
+			values[name] = reflect.ValueOf(&value)
+		}
+	}
+	return values
+}
+
+// withMetric returns a copy of data with nothing but the named value in it.
+func withMetric(metric string, value reflect.Value) MeasurementData {
+	var data MeasurementData
+	v := reflect.ValueOf(&data).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0] == metric {
+			v.Field(i).Set(value)
+		}
+	}
+	if isDeclaredMetric(metric) {
+		data.Metrics = map[string]float64{metric: value.Elem().Float()}
+	}
+	return data
+}
+
+// withoutStale removes the values of data that have not been reported within
+// ttl, so that each value goes stale on its own.
+func withoutStale(data MeasurementData, updated map[string]time.Time, ttl time.Duration) MeasurementData {
+	if ttl <= 0 {
+		return data
+	}
+
+	v := reflect.ValueOf(&data).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() != reflect.Ptr || field.IsNil() {
+			continue
+		}
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if clock.Since(updated[name]) > ttl {
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+	if len(data.Metrics) != 0 {
+		metrics := map[string]float64{}
+		for name, value := range data.Metrics {
+			if clock.Since(updated[name]) <= ttl {
+				metrics[name] = value
+			}
+		}
+		data.Metrics = metrics
+	}
+	return data
+}
+
+// fresh returns the latest measurement of a sensor without its stale values.
+// The caller must hold the lock.
+func (s *Store) fresh(sensorID string) (Measurement, bool) {
+	measurement, ok := s.measurements[sensorID]
+	if !ok || s.expired(sensorID) {
+		return Measurement{}, false
+	}
+	measurement.MeasurementData = withoutStale(measurement.MeasurementData, s.updated[sensorID], s.ttls[sensorID])
+	return measurement, true
+}
+
+// merge stores the values of data as the latest for a sensor and records when
+// they were reported. The caller must hold the lock.
+func (s *Store) merge(measurement Measurement, now time.Time) Measurement {
+	id := measurement.SensorID
+
+	updated, ok := s.updated[id]
+	if !ok {
+		updated = map[string]time.Time{}
+		s.updated[id] = updated
+	}
+	for name := range metricValues(measurement.MeasurementData) {
+		updated[name] = now
+	}
+
+	if previous, ok := s.fresh(id); ok {
+		measurement.MeasurementData = measurement.MeasurementData.merge(previous.MeasurementData)
+	}
+
+	s.measurements[id] = measurement
+	s.received[id] = now
+
+	return measurement
+}
+
+// AddSource makes the named value of a sensor come from other sensors, for
+// logical sensors that combine several physical ones.
+func (s *Store) AddSource(sensorID, metric string, config MetricSource) error {
+	aggregate, err := aggregateFunc(config.Aggregate)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.virtual[sensorID] = true
+	s.statsFor(sensorID)
+
+	route := source{
+		sensorID:   sensorID,
+		metric:     metric,
+		probe:      config.Probe,
+		sensors:    config.Sensors,
+		aggregate:  aggregate,
+		failover:   config.Aggregate == "failover",
+		staleAfter: config.staleAfter(),
+	}
+	for _, sourceID := range config.Sensors {
+		s.sources[sourceID] = append(s.sources[sourceID], route)
+	}
+	return nil
+}
+
+// derive computes the value of a logical sensor from the latest values of its
+// sources, after value was reported by one of them. The caller must hold the
+// lock.
+func (s *Store) derive(route source, value reflect.Value) reflect.Value {
+	if route.failover {
+		return s.failover(route, value)
+	}
+
+	kind := value.Elem().Kind()
+	if route.aggregate == nil || (kind != reflect.Float32 && kind != reflect.Float64) {
+		return value
+	}
+
+	var values []float64
+	for _, sourceID := range route.sensors {
+		if measurement, ok := s.fresh(sourceID); ok {
+			if v, ok := route.value(measurement.MeasurementData); ok {
+				values = append(values, v.Elem().Float())
+			}
+		}
+	}
+	if len(values) == 0 {
+		return value
+	}
+
+	result := route.aggregate(values)
+	if kind == reflect.Float64 {
+		return reflect.ValueOf(&result)
+	}
+	narrowed := float32(result)
+	return reflect.ValueOf(&narrowed)
+}
+
+// failover returns the value of the first sensor of a route that reported it
+// within staleAfter, so that a backup only takes over while the sensors
+// before it are quiet. The caller must hold the lock.
+func (s *Store) failover(route source, value reflect.Value) reflect.Value {
+	// A probe is only in the data, it has no time of its own
+	updated := func(sourceID string) time.Time {
+		if route.probe != "" {
+			return s.received[sourceID]
+		}
+		return s.updated[sourceID][route.metric]
+	}
+
+	for _, sourceID := range route.sensors {
+		measurement, ok := s.fresh(sourceID)
+		if !ok || clock.Since(updated(sourceID)) > route.staleAfter {
+			continue
+		}
+		if v, ok := route.value(measurement.MeasurementData); ok {
+			key := route.sensorID + "/" + route.metric
+			if previous := s.active[key]; previous != sourceID {
+				if previous != "" {
+					log.Printf("[*] Sensor <%s> takes %s from <%s> instead of <%s>", route.sensorID, route.metric, sourceID, previous)
+				}
+				s.active[key] = sourceID
+			}
+			return v
+		}
+	}
+	return value
+}
+
+// Update stores the measurement as the latest for its sensor. Values missing
+// from the measurement are kept from the previous one. It returns false if
+// the measurement was a duplicate and has been ignored. A measurement that
+// was taken before the latest one is counted but does not replace it.
+func (s *Store) Update(measurement Measurement, address net.Addr) bool {
+	s.mutex.Lock()
+
+	stats := s.statsFor(measurement.SensorID)
+	if !stats.track(measurement.Sequence) {
+		s.mutex.Unlock()
+		return false
+	}
+
+	stats.trackRSSI(measurement.MeasurementData.RSSI)
+
+	now := clock.Now()
+
+	// Without a clock we can trust, measurements are in the order we get them
+	stats.trackClock(measurement.SensorID, measurement.SensorTime, now)
+	if stats.Clock == clockOK {
+		taken := time.Unix(measurement.SensorTime, 0)
+		if taken.Before(s.taken[measurement.SensorID]) {
+			stats.OutOfOrder++
+			s.mutex.Unlock()
+			return true
+		}
+		s.taken[measurement.SensorID] = taken
+	} else {
+		delete(s.taken, measurement.SensorID)
+	}
+
+	reported := measurement.MeasurementData
+	measurement = s.merge(measurement, now)
+	// Measurements copied from a peer have no address
+	if address != nil {
+		s.addresses[measurement.SensorID] = address
+	}
+
+	// Logical sensors only get the values they take from this sensor
+	var derived []Measurement
+	for _, route := range s.sources[measurement.SensorID] {
+		if value, ok := route.value(reported); ok {
+			data := withMetric(route.metric, s.derive(route, value))
+			derived = append(derived, s.merge(Measurement{SensorID: route.sensorID, MeasurementData: data}, now))
+		}
+	}
+
+	// Sensors may only include their firmware version every now and then
+	if measurement.FirmwareVersion != "" {
+		s.firmware[measurement.SensorID] = measurement.FirmwareVersion
+	}
+
+	if data := measurement.MeasurementData; data.Faulted() {
+		if s.diagnostics[measurement.SensorID].Status != data.Status {
+			s.diagnostics[measurement.SensorID] = Diagnostics{Status: data.Status, Since: clock.Now()}
+		}
+	} else {
+		delete(s.diagnostics, measurement.SensorID)
+	}
+	listeners := s.listeners[measurement.SensorID]
+	derivedListeners := make([][]func(Measurement), len(derived))
+	for i, d := range derived {
+		derivedListeners[i] = s.listeners[d.SensorID]
+	}
+
+	s.mutex.Unlock()
+
+	for _, listener := range listeners {
+		listener(measurement)
+	}
+	for i, d := range derived {
+		for _, listener := range derivedListeners[i] {
+			listener(d)
+		}
+	}
+
+	s.publish(measurement)
+	for _, d := range derived {
+		s.publish(d)
+	}
+
+	return true
+}
+
+// Subscribe returns a channel that gets every measurement that is stored,
+// and a function that ends the subscription. A subscriber that falls behind
+// misses measurements rather than hold up the store.
+func (s *Store) Subscribe() (<-chan Measurement, func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ch := make(chan Measurement, 64)
+	s.subscribers[ch] = true
+
+	return ch, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.subscribers, ch)
+	}
+}
+
+func (s *Store) publish(measurement Measurement) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- measurement:
+		default:
+		}
+	}
+}
+
+func (s *Store) statsFor(sensorID string) *SensorStats {
+	stats, ok := s.stats[sensorID]
+	if !ok {
+		stats = &SensorStats{}
+		s.stats[sensorID] = stats
+	}
+	return stats
+}
+
+// RecordParseError counts a packet from the sensor that could not be decoded.
+func (s *Store) RecordParseError(sensorID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statsFor(sensorID).ParseErrors++
+}
+
+// RecordRateLimited counts a packet from the sensor that was dropped because it
+// exceeded its rate limit.
+func (s *Store) RecordRateLimited(sensorID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statsFor(sensorID).RateLimited++
+}
+
+// RecordReplayed counts a signed packet from the sensor that was seen before.
+func (s *Store) RecordReplayed(sensorID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statsFor(sensorID).Replayed++
+}
+
+// RecordEncoding remembers which encoding the sensor sent its last packet in.
+func (s *Store) RecordEncoding(sensorID, encoding string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statsFor(sensorID).Encoding = encoding
+}
+
+// OnUpdate registers fn to be called with every new measurement of a sensor.
+func (s *Store) OnUpdate(sensorID string, fn func(Measurement)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners[sensorID] = append(s.listeners[sensorID], fn)
+}
+
+// Address returns where the last packet of a sensor came from, which is
+// where downlink commands for it should be sent.
+func (s *Store) Address(sensorID string) (net.Addr, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	address, ok := s.addresses[sensorID]
+	return address, ok
+}
+
+// SetTTL sets how long the measurements of a sensor stay valid. Expired
+// measurements are withdrawn as if the sensor never reported, and values that
+// have not been reported for this long are withdrawn on their own.
+func (s *Store) SetTTL(sensorID string, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ttls[sensorID] = ttl
+}
+
+// SetMetadata sets where a sensor is. It is included in snapshots.
+func (s *Store) SetMetadata(sensorID string, metadata Metadata) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.metadata[sensorID] = metadata
+}
+
+func (s *Store) expired(sensorID string) bool {
+	ttl, ok := s.ttls[sensorID]
+	return ok && ttl > 0 && clock.Since(s.received[sensorID]) > ttl
+}
+
+func (s *Store) Latest(sensorID string) (Measurement, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.fresh(sensorID)
+}
+
+func (s *Store) FirmwareVersion(sensorID string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	version, ok := s.firmware[sensorID]
+	return version, ok
+}
+
+func (s *Store) Stats(sensorID string) (SensorStats, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if stats, ok := s.stats[sensorID]; ok {
+		return *stats, true
+	}
+	return SensorStats{}, false
+}
+
+func (s *Store) Snapshot() []SensorState {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var states []SensorState
+	for id, stats := range s.stats {
+		state := SensorState{
+			SensorID: id,
+			Metadata: s.metadata[id],
+			Stats:    *stats,
+			Interval: stats.AverageInterval().Seconds(),
+		}
+		if measurement, ok := s.fresh(id); ok {
+			state.Measurement = &measurement
+			state.Updated = map[string]time.Time{}
+			for name := range metricValues(measurement.MeasurementData) {
+				state.Updated[name] = s.updated[id][name]
+			}
+		}
+		state.FirmwareVersion = s.firmware[id]
+		state.Virtual = s.virtual[id]
+		if diagnostics, ok := s.diagnostics[id]; ok {
+			state.Diagnostics = &diagnostics
+		}
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].SensorID < states[j].SensorID
+	})
+
+	return states
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func float32p(f float32) *float32 { return &f }
+
+func TestStoreTTLExpiry(t *testing.T) {
+	c := useManualClock(t)
+	s := newStore()
+	s.SetTTL("a", time.Minute)
+
+	s.Update(Measurement{SensorID: "a", MeasurementData: MeasurementData{Temperature: float32p(20)}}, nil)
+	c.Advance(59 * time.Second)
+	if _, ok := s.Latest("a"); !ok {
+		t.Fatal("measurement expired before its TTL")
+	}
+
+	c.Advance(2 * time.Second)
+	if _, ok := s.Latest("a"); ok {
+		t.Fatal("measurement did not expire after its TTL")
+	}
+
+	// A sensor without a TTL keeps its values
+	s.Update(Measurement{SensorID: "b", MeasurementData: MeasurementData{Temperature: float32p(20)}}, nil)
+	c.Advance(24 * time.Hour)
+	if _, ok := s.Latest("b"); !ok {
+		t.Fatal("measurement without a TTL expired")
+	}
+}
+
+func TestStoreStaleValues(t *testing.T) {
+	c := useManualClock(t)
+	s := newStore()
+	s.SetTTL("a", time.Minute)
+
+	s.Update(Measurement{SensorID: "a", MeasurementData: MeasurementData{Temperature: float32p(20), Humidity: float32p(40)}}, nil)
+	c.Advance(40 * time.Second)
+	s.Update(Measurement{SensorID: "a", MeasurementData: MeasurementData{Humidity: float32p(45)}}, nil)
+
+	latest, _ := s.Latest("a")
+	if latest.MeasurementData.Temperature == nil || *latest.MeasurementData.Temperature != 20 {
+		t.Fatalf("temperature is %v, want the 20 kept from before", latest.MeasurementData.Temperature)
+	}
+
+	// The temperature goes stale on its own, the humidity was reported since
+	c.Advance(30 * time.Second)
+	latest, ok := s.Latest("a")
+	if !ok {
+		t.Fatal("measurement expired although the humidity is fresh")
+	}
+	if latest.MeasurementData.Temperature != nil {
+		t.Fatalf("stale temperature %v was served", *latest.MeasurementData.Temperature)
+	}
+	if latest.MeasurementData.Humidity == nil || *latest.MeasurementData.Humidity != 45 {
+		t.Fatalf("humidity is %v, want 45", latest.MeasurementData.Humidity)
+	}
+}
+
+func TestStoreFailover(t *testing.T) {
+	c := useManualClock(t)
+	s := newStore()
+	source := MetricSource{Sensors: []string{"wired", "wireless"}, Aggregate: "failover", StaleAfter: 60}
+	if err := s.AddSource("logical", "temperature", source); err != nil {
+		t.Fatal(err)
+	}
+
+	report := func(sensorID string, temperature float32) {
+		s.Update(Measurement{SensorID: sensorID, MeasurementData: MeasurementData{Temperature: float32p(temperature)}}, nil)
+	}
+	expect := func(want float32, why string) {
+		t.Helper()
+		latest, ok := s.Latest("logical")
+		if !ok || latest.MeasurementData.Temperature == nil {
+			t.Fatalf("%s: no temperature", why)
+		}
+		if got := *latest.MeasurementData.Temperature; got != want {
+			t.Fatalf("%s: temperature is %v, want %v", why, got, want)
+		}
+	}
+
+	report("wired", 20)
+	report("wireless", 25)
+	expect(20, "primary is fresh")
+
+	c.Advance(59 * time.Second)
+	report("wireless", 26)
+	expect(20, "primary is not stale yet")
+
+	c.Advance(2 * time.Second)
+	report("wireless", 27)
+	expect(27, "primary is stale")
+
+	report("wired", 21)
+	expect(21, "primary is back")
+
+	report("wireless", 28)
+	expect(21, "backup while the primary is fresh")
+}
+
+func TestStoreFailoverDefaultStaleAfter(t *testing.T) {
+	c := useManualClock(t)
+	s := newStore()
+	if err := s.AddSource("logical", "temperature", MetricSource{Sensors: []string{"wired", "wireless"}, Aggregate: "failover"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Update(Measurement{SensorID: "wired", MeasurementData: MeasurementData{Temperature: float32p(20)}}, nil)
+	c.Advance(defaultStaleAfter - time.Second)
+	s.Update(Measurement{SensorID: "wireless", MeasurementData: MeasurementData{Temperature: float32p(25)}}, nil)
+	if latest, _ := s.Latest("logical"); *latest.MeasurementData.Temperature != 20 {
+		t.Fatalf("failed over to %v before the default of %s", *latest.MeasurementData.Temperature, defaultStaleAfter)
+	}
+
+	c.Advance(2 * time.Second)
+	s.Update(Measurement{SensorID: "wireless", MeasurementData: MeasurementData{Temperature: float32p(26)}}, nil)
+	if latest, _ := s.Latest("logical"); *latest.MeasurementData.Temperature != 26 {
+		t.Fatalf("temperature is %v, want the backup after %s", *latest.MeasurementData.Temperature, defaultStaleAfter)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleSensor routes /api/v1/sensors/<id> and the actions below it.
+func handleSensor(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/sensors/")
+	sensorID, action := path, ""
+	if i := strings.Index(path, "/"); i != -1 {
+		sensorID, action = path[:i], path[i+1:]
+	}
+
+	switch action {
+	case "":
+		handleLatest(w, r, sensorID)
+	case "rename":
+		handleRename(w, r, sensorID)
+	case "command":
+		handleCommand(w, r, sensorID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleLatest handles GET /api/v1/sensors/<id>
+func handleLatest(w http.ResponseWriter, r *http.Request, sensorID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	for _, state := range store.Snapshot() {
+		if state.SensorID == sensorID {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(outputStateUnits(state, liveConfig().Units)); err != nil {
+				log.Println("Failed to encode sensor: ", err)
+			}
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// handleCommand handles POST /api/v1/sensors/<id>/command, which sends a
+// command like {"on": true} or {"position": 50} to the device.
+func handleCommand(w http.ResponseWriter, r *http.Request, sensorID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var command Command
+	if err := json.NewDecoder(r.Body).Decode(&command); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if command.On == nil && command.Speed == nil && command.Position == nil {
+		http.Error(w, "command has nothing to do", http.StatusBadRequest)
+		return
+	}
+
+	sensor, ok := liveSensor(sensorID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("sensor <%s> is not configured", sensorID), http.StatusNotFound)
+		return
+	}
+
+	if err := downlink.Send(sensor, command); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleStream handles GET /api/v1/stream, which pushes every measurement as
+// a line of JSON for as long as the client stays connected. A ?sensor= only
+// streams the measurements of that sensor.
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	sensorID := r.URL.Query().Get("sensor")
+
+	measurements, unsubscribe := store.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Empty lines keep proxies from closing an idle stream
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return
+			}
+		case measurement := <-measurements:
+			if sensorID != "" && measurement.SensorID != sensorID {
+				continue
+			}
+			if err := encoder.Encode(outputUnits(measurement, liveConfig().Units, "api")); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
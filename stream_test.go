@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCommandUsesLiveConfig(t *testing.T) {
+	// There is no config file here, only the config the bridge runs
+	inTempDir(t)
+	previous := liveConfig()
+	t.Cleanup(func() { setLiveConfig(previous) })
+	var config Config
+	config.Bridge.Sensors = []SensorConfig{{Serial: "switch", Type: "switch"}}
+	setLiveConfig(config)
+
+	for sensorID, status := range map[string]int{"switch": http.StatusConflict, "other": http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/sensors/"+sensorID+"/command", strings.NewReader(`{"on": true}`))
+		handleCommand(w, r, sensorID)
+		if w.Code != status {
+			t.Errorf("command for <%s> answered %d, want %d: %s", sensorID, w.Code, status, w.Body)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The bridge keeps its state for the whole process, so the supervisor runs
+// every instance as a child process in its own directory. Each directory has
+// its own config file and storage, and with that its own HomeKit bridge.
+
+// instanceDirs returns the subdirectories of dir that have a config file.
+func instanceDirs(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, entry.Name(), configPath)); err == nil {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// checkInstances loads the config of every instance and makes sure that no
+// two instances listen on the same port.
+func checkInstances(dir string, names []string) error {
+	owners := map[string]string{}
+	claim := func(name, what string) error {
+		if owner, ok := owners[what]; ok {
+			return fmt.Errorf("instances <%s> and <%s> both use %s", owner, name, what)
+		}
+		owners[what] = name
+		return nil
+	}
+
+	for _, name := range names {
+		config, err := loadConfig(filepath.Join(dir, name, configPath))
+		if err != nil {
+			return fmt.Errorf("instance <%s>: %v", name, err)
+		}
+		for _, receiver := range config.receivers() {
+			typ := receiver.Type
+			if typ == "" {
+				typ = "udp"
+			}
+			if err := claim(name, fmt.Sprintf("%s port %d", typ, receiver.Port)); err != nil {
+				return err
+			}
+		}
+		if config.API.Address != "" {
+			if err := claim(name, "API address "+config.API.Address); err != nil {
+				return err
+			}
+		}
+		if !config.Bridge.Disabled && config.Bridge.Port != "" {
+			if err := claim(name, "HomeKit port "+config.Bridge.Port); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type instance struct {
+	name string
+	dir  string
+
+	mutex   sync.Mutex
+	process *os.Process
+}
+
+func (i *instance) signal(sig os.Signal) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.process != nil {
+		i.process.Signal(sig)
+	}
+}
+
+// copyLines writes the output of an instance to stderr, marked with its name.
+func (i *instance) copyLines(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", i.name, scanner.Text())
+	}
+}
+
+// run keeps the instance running until stop is closed, restarting it with a
+// growing delay when it exits.
+func (i *instance) run(executable string, stop <-chan struct{}) {
+	delay := time.Second
+	for {
+		cmd := exec.Command(executable)
+		cmd.Dir = i.dir
+		output, err := cmd.StdoutPipe()
+		if err == nil {
+			cmd.Stderr = cmd.Stdout
+			err = cmd.Start()
+		}
+
+		started := time.Now()
+		if err == nil {
+			log.Printf("[*] Started instance <%s>", i.name)
+			i.mutex.Lock()
+			i.process = cmd.Process
+			i.mutex.Unlock()
+
+			i.copyLines(output)
+			err = cmd.Wait()
+
+			i.mutex.Lock()
+			i.process = nil
+			i.mutex.Unlock()
+		}
+
+		select {
+		case <-stop:
+			log.Printf("[*] Stopped instance <%s>", i.name)
+			return
+		default:
+		}
+
+		// An instance that ran for a while is restarted right away
+		if time.Since(started) > time.Minute {
+			delay = time.Second
+		}
+		log.Printf("[!] Instance <%s> exited, restarting in %s: %v", i.name, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return
+		}
+		if delay *= 2; delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+}
+
+// superviseCommand runs a bridge for every instance directory in the given
+// directory. SIGHUP and SIGUSR1 are passed on to all instances, SIGINT and
+// SIGTERM stop them.
+func superviseCommand(args []string) {
+	if len(args) != 1 {
+		log.Fatal("Usage: sensor-bridge supervise <dir>")
+	}
+
+	names, err := instanceDirs(args[0])
+	if err != nil {
+		log.Fatal("Could not read instances: ", err)
+	}
+	if len(names) == 0 {
+		log.Fatalf("No instances in <%s>, each needs a directory with a %s", args[0], configPath)
+	}
+	if err := checkInstances(args[0], names); err != nil {
+		log.Fatal("Could not start instances: ", err)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal("Could not find the bridge executable: ", err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var instances []*instance
+	for _, name := range names {
+		i := &instance{name: name, dir: filepath.Join(args[0], name)}
+		instances = append(instances, i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			i.run(executable, stop)
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, os.Interrupt, syscall.SIGTERM)
+	for sig := range signals {
+		stopping := sig == os.Interrupt || sig == syscall.SIGTERM
+		if stopping {
+			close(stop)
+		}
+		for _, i := range instances {
+			i.signal(sig)
+		}
+		if stopping {
+			break
+		}
+	}
+
+	wg.Wait()
+	log.Println("[*] Stopped all instances")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state update to systemd when running as a Type=notify
+// service. It does nothing when NOTIFY_SOCKET is not set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Abstract sockets are passed with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifyReady tells systemd that the bridge is up once it is ready.
+func notifyReady() {
+	ticker := clock.NewTicker(readyCheckInterval)
+	defer ticker.Stop()
+	for !health.Ready() {
+		<-ticker.Chan()
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.Println("Could not notify systemd: ", err)
+	}
+}
+
+const readyCheckInterval = 100 * time.Millisecond
+
+// activatedPacketConn returns the UDP socket systemd passed to us with socket
+// activation, or nil if we were not socket activated.
+func activatedPacketConn() (net.PacketConn, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	if fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err != nil || fds < 1 {
+		return nil, nil
+	}
+
+	// Passed file descriptors start at 3
+	file := os.NewFile(3, "systemd-socket")
+	defer file.Close()
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	return net.FilePacketConn(file)
+}
+
+// runWatchdog pings the systemd watchdog for as long as the bridge is healthy.
+// If the receive loop or the HomeKit transport hangs the pings stop and
+// systemd restarts us.
+func runWatchdog(hapPort string) {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.Printf("[*] Pinging systemd watchdog every %s", interval)
+
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.Chan() {
+		if !health.ReceiverHealthy() {
+			log.Println("[!] Receive loop is not responding, skipping watchdog ping")
+			continue
+		}
+
+		if hapPort != "" {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", hapPort), 2*time.Second)
+			if err != nil {
+				log.Println("[!] HomeKit transport is not responding, skipping watchdog ping: ", err)
+				continue
+			}
+			conn.Close()
+		}
+
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Println("Could not ping systemd watchdog: ", err)
+		}
+	}
+}
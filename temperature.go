@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
+
+// TemperatureConfig sets the range and step HomeKit shows the temperature of
+// a sensor with, and whether the Home app should show it in "celsius" or
+// "fahrenheit". Values are always in Celsius.
+type TemperatureConfig struct {
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+	Step *float64 `json:"step,omitempty"`
+	Unit string   `json:"unit,omitempty"`
+}
+
+// HomeKit defaults to 0 to 100 degrees, which clips winter readings outside
+const (
+	defaultMinTemperature = -40
+	defaultMaxTemperature = 100
+)
+
+var temperatureUnits = map[string]int{
+	"celsius":    characteristic.TemperatureDisplayUnitsCelsius,
+	"fahrenheit": characteristic.TemperatureDisplayUnitsFahrenheit,
+}
+
+func (c *TemperatureConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Unit != "" {
+		if _, ok := temperatureUnits[c.Unit]; !ok {
+			return fmt.Errorf("unknown temperature unit <%s>", c.Unit)
+		}
+	}
+	if c.Min != nil && c.Max != nil && *c.Min >= *c.Max {
+		return fmt.Errorf("temperature min must be below max")
+	}
+	if c.Step != nil && *c.Step <= 0 {
+		return fmt.Errorf("temperature step must be positive")
+	}
+	return nil
+}
+
+// configureTemperature applies the temperature settings of a sensor to its
+// CurrentTemperature and, when there is one, to its display units.
+func configureTemperature(config *TemperatureConfig, current *characteristic.CurrentTemperature, units *characteristic.TemperatureDisplayUnits) {
+	current.SetMinValue(defaultMinTemperature)
+	current.SetMaxValue(defaultMaxTemperature)
+	if config == nil {
+		return
+	}
+
+	if config.Min != nil {
+		current.SetMinValue(*config.Min)
+	}
+	if config.Max != nil {
+		current.SetMaxValue(*config.Max)
+	}
+	if config.Step != nil {
+		current.SetStepValue(*config.Step)
+	}
+	if units != nil && config.Unit != "" {
+		units.SetValue(temperatureUnits[config.Unit])
+	}
+}
+
+// addTemperatureUnits adds the display units hint to a temperature sensor
+// that has a unit configured.
+func addTemperatureUnits(config *TemperatureConfig, svc *service.TemperatureSensor) *characteristic.TemperatureDisplayUnits {
+	if config == nil || config.Unit == "" {
+		return nil
+	}
+	units := characteristic.NewTemperatureDisplayUnits()
+	units.Perms = characteristic.PermsRead()
+	svc.AddCharacteristic(units.Characteristic)
+	return units
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func formatValue(v *float32, format string) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf(format, *v)
+}
+
+// topCommand shows a live updating table of all sensors, refreshed from the API.
+func topCommand(args []string) {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	interval := flags.Duration("interval", 2*time.Second, "refresh interval")
+	flags.Parse(args)
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatal("Could not load config file: ", err)
+	}
+
+	if config.API.Address == "" {
+		log.Fatal("The API is not enabled in the config file")
+	}
+
+	previous := map[string]uint64{}
+	var previousTime time.Time
+
+	for {
+		var states []SensorState
+		err := fetchAPI(config.API, "/api/v1/sensors", &states)
+		now := time.Now()
+
+		// Render into a buffer first so the screen does not flicker
+		var buffer bytes.Buffer
+		buffer.WriteString("\033[H\033[2J")
+		fmt.Fprintf(&buffer, "sensor-bridge top - %s - %d sensors\n\n", now.Format("15:04:05"), len(states))
+
+		if err != nil {
+			fmt.Fprintf(&buffer, "Could not fetch sensors: %v\n", err)
+		}
+
+		w := tabwriter.NewWriter(&buffer, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SENSOR\tNAME\tTEMP\tHUM\tPRESS\tAGE\tPKT/MIN\tLOSS\tSTATUS")
+		for _, state := range states {
+			name := "-"
+			if sensor, ok := config.Bridge.sensor(state.SensorID); ok {
+				name = sensor.Name
+			}
+
+			temperature, humidity, pressure := "-", "-", "-"
+			status := "ok"
+			if m := state.Measurement; m != nil {
+				temperature = formatValue(m.MeasurementData.Temperature, "%.1f")
+				humidity = formatValue(m.MeasurementData.Humidity, "%.0f%%")
+				pressure = formatValue(m.MeasurementData.Pressure, "%.0f")
+			} else {
+				status = "expired"
+			}
+			if state.Diagnostics != nil {
+				status = state.Diagnostics.Status
+			}
+
+			rate := "-"
+			if received, ok := previous[state.SensorID]; ok && !previousTime.IsZero() {
+				rate = fmt.Sprintf("%.1f", float64(state.Stats.Received-received)/now.Sub(previousTime).Minutes())
+			}
+			previous[state.SensorID] = state.Stats.Received
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.1f%%\t%s\n", state.SensorID, name,
+				temperature, humidity, pressure, formatAge(state.Stats.LastSeen), rate,
+				state.Stats.LossRatio()*100, status)
+		}
+		w.Flush()
+
+		previousTime = now
+		os.Stdout.Write(buffer.Bytes())
+
+		time.Sleep(*interval)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTraceMinutes = 10
+	maxTraceMinutes     = 24 * 60
+)
+
+// PacketTrace logs the full packets of one sensor or of one source address
+// until it expires, to debug a sensor without logging every packet.
+type PacketTrace struct {
+	SensorID string    `json:"sensor_id,omitempty"`
+	Address  string    `json:"address,omitempty"`
+	Until    time.Time `json:"until"`
+}
+
+func (t PacketTrace) target() string {
+	if t.SensorID != "" {
+		return t.SensorID
+	}
+	return t.Address
+}
+
+type packetTracer struct {
+	mutex  sync.Mutex
+	traces []PacketTrace
+}
+
+var packetTraces = &packetTracer{}
+
+// Start adds a trace, or extends the one for the same sensor or address.
+func (t *packetTracer) Start(sensorID, address string, minutes int) (PacketTrace, error) {
+	if (sensorID == "") == (address == "") {
+		return PacketTrace{}, fmt.Errorf("a trace needs either a sensor or an address")
+	}
+	if address != "" && net.ParseIP(address) == nil {
+		return PacketTrace{}, fmt.Errorf("invalid address <%s>", address)
+	}
+	if minutes <= 0 || minutes > maxTraceMinutes {
+		return PacketTrace{}, fmt.Errorf("minutes must be between 1 and %d", maxTraceMinutes)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	trace := PacketTrace{SensorID: sensorID, Address: address, Until: clock.Now().Add(time.Duration(minutes) * time.Minute)}
+	t.remove(sensorID, address)
+	t.traces = append(t.traces, trace)
+	log.Printf("[*] Tracing packets of <%s> until %s", trace.target(), trace.Until.Format(time.RFC3339))
+	return trace, nil
+}
+
+// Stop removes the trace for a sensor or address, or all of them when both
+// are empty.
+func (t *packetTracer) Stop(sensorID, address string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if sensorID == "" && address == "" {
+		t.traces = nil
+		return
+	}
+	t.remove(sensorID, address)
+}
+
+// remove drops a trace. The caller must hold the lock.
+func (t *packetTracer) remove(sensorID, address string) {
+	traces := t.traces[:0]
+	for _, trace := range t.traces {
+		if trace.SensorID != sensorID || trace.Address != address {
+			traces = append(traces, trace)
+		}
+	}
+	t.traces = traces
+}
+
+// expire drops the traces that ran out. The caller must hold the lock.
+func (t *packetTracer) expire() {
+	now := clock.Now()
+	traces := t.traces[:0]
+	for _, trace := range t.traces {
+		if now.Before(trace.Until) {
+			traces = append(traces, trace)
+		} else {
+			log.Printf("[*] Stopped tracing packets of <%s>", trace.target())
+		}
+	}
+	t.traces = traces
+}
+
+// List returns the traces that did not expire yet.
+func (t *packetTracer) List() []PacketTrace {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.expire()
+	return append([]PacketTrace{}, t.traces...)
+}
+
+// matches returns the trace that covers a packet, if any.
+func (t *packetTracer) matches(p packet) (PacketTrace, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.expire()
+	if len(t.traces) == 0 {
+		return PacketTrace{}, false
+	}
+
+	host := addressHost(p.address)
+	sender := ""
+	for _, trace := range t.traces {
+		if trace.Address != "" && trace.Address == host {
+			return trace, true
+		}
+		if trace.SensorID != "" {
+			if sender == "" {
+				sender = packetSender(p)
+			}
+			if trace.SensorID == sender {
+				return trace, true
+			}
+		}
+	}
+	return PacketTrace{}, false
+}
+
+// Trace logs a packet and what became of it when a trace covers it.
+func (t *packetTracer) Trace(p packet, err error) {
+	trace, ok := t.matches(p)
+	if !ok {
+		return
+	}
+
+	log.Printf("[*] Trace <%s> from <%s>: %d bytes %s", trace.target(), p.address, len(p.payload), hex.EncodeToString(p.payload))
+	if payload, decodeErr := packetJSON(p); decodeErr == nil {
+		log.Printf("[*] Trace <%s> from <%s>: %s", trace.target(), p.address, payload)
+	}
+	if err != nil {
+		log.Printf("[!] Trace <%s> from <%s>: %v", trace.target(), p.address, err)
+	}
+}
+
+// handleTraces handles /api/v1/traces. POST starts a trace for the sensor or
+// address in the query, DELETE stops it or all of them.
+func handleTraces(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		minutes := defaultTraceMinutes
+		if s := query.Get("minutes"); s != "" {
+			var err error
+			if minutes, err = strconv.Atoi(s); err != nil {
+				http.Error(w, "invalid minutes", http.StatusBadRequest)
+				return
+			}
+		}
+		if _, err := packetTraces.Start(query.Get("sensor"), query.Get("address"), minutes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		packetTraces.Stop(query.Get("sensor"), query.Get("address"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(packetTraces.List()); err != nil {
+		log.Println("Failed to encode traces: ", err)
+	}
+}
+
+// traceCommand starts or stops a trace on the running bridge and prints the
+// traces that are active.
+func traceCommand(args []string) {
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	sensorID := flags.String("sensor", "", "sensor to trace")
+	address := flags.String("address", "", "source address to trace")
+	minutes := flags.Int("minutes", defaultTraceMinutes, "how long to trace")
+	stop := flags.Bool("stop", false, "stop the trace, or all traces")
+	flags.Parse(args)
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatal("Could not load config file: ", err)
+	}
+
+	if config.API.Address == "" {
+		log.Fatal("The API is not enabled in the config file")
+	}
+
+	query := url.Values{}
+	if *sensorID != "" {
+		query.Set("sensor", *sensorID)
+	}
+	if *address != "" {
+		query.Set("address", *address)
+	}
+
+	method := http.MethodGet
+	switch {
+	case *stop:
+		method = http.MethodDelete
+	case len(query) > 0:
+		method = http.MethodPost
+		query.Set("minutes", strconv.Itoa(*minutes))
+	}
+
+	path := "/api/v1/traces"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var traces []PacketTrace
+	if err := requestAPI(config.API, method, path, &traces); err != nil {
+		log.Fatal("Could not update traces: ", err)
+	}
+
+	if len(traces) == 0 {
+		fmt.Println("No packets are traced")
+		return
+	}
+	for _, trace := range traces {
+		fmt.Printf("%s until %s\n", trace.target(), trace.Until.Local().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import "fmt"
+
+// UnitsConfig names the units of the values that have more than one in use.
+// Temperature is "celsius", "fahrenheit" or "kelvin", Pressure "hpa", "pa",
+// "kpa", "inhg" or "mmhg", WindSpeed "m/s", "km/h", "mph" or "knots" and Rain
+// "mm" or "in". Empty means the unit the bridge works in, the first of each.
+type UnitsConfig struct {
+	Temperature string `json:"temperature,omitempty"`
+	Pressure    string `json:"pressure,omitempty"`
+	WindSpeed   string `json:"wind_speed,omitempty"`
+	Rain        string `json:"rain,omitempty"`
+}
+
+// UnitSystemConfig declares the units sensors report in, which are converted
+// when packets come in so that everything inside the bridge, HomeKit included,
+// works in one unit per value. Outputs convert them again for a sink, by name:
+// "measurement_log" or "api". Sensors that report in other units than the rest
+// set their own.
+type UnitSystemConfig struct {
+	Input   UnitsConfig            `json:"input"`
+	Outputs map[string]UnitsConfig `json:"outputs,omitempty"`
+}
+
+// unitConversion converts a value to and from the unit the bridge works in.
+type unitConversion struct {
+	from, to func(float64) float64
+}
+
+func unitScale(factor float64) unitConversion {
+	return unitConversion{
+		from: func(v float64) float64 { return v * factor },
+		to:   func(v float64) float64 { return v / factor },
+	}
+}
+
+// unitConversions holds the conversions of the values with a unit, by metric.
+var unitConversions = map[string]map[string]unitConversion{
+	"temperature": {
+		"celsius": unitScale(1),
+		"fahrenheit": {
+			from: func(v float64) float64 { return (v - 32) * 5 / 9 },
+			to:   func(v float64) float64 { return v*9/5 + 32 },
+		},
+		"kelvin": {
+			from: func(v float64) float64 { return v - 273.15 },
+			to:   func(v float64) float64 { return v + 273.15 },
+		},
+	},
+	"pressure": {
+		"hpa":  unitScale(1),
+		"pa":   unitScale(0.01),
+		"kpa":  unitScale(10),
+		"inhg": unitScale(33.8639),
+		"mmhg": unitScale(1.33322),
+	},
+	"wind_speed": {
+		"m/s":   unitScale(1),
+		"km/h":  unitScale(1 / 3.6),
+		"mph":   unitScale(0.44704),
+		"knots": unitScale(0.514444),
+	},
+	"rain_mm": {
+		"mm": unitScale(1),
+		"in": unitScale(25.4),
+	},
+}
+
+// byMetric returns the configured units by the metric they apply to.
+func (c UnitsConfig) byMetric() map[string]string {
+	return map[string]string{
+		"temperature": c.Temperature,
+		"pressure":    c.Pressure,
+		"wind_speed":  c.WindSpeed,
+		"rain_mm":     c.Rain,
+	}
+}
+
+func (c UnitsConfig) validate() error {
+	for metric, unit := range c.byMetric() {
+		if _, ok := unitConversions[metric][unit]; unit != "" && !ok {
+			return fmt.Errorf("unknown %s unit <%s>", metric, unit)
+		}
+	}
+	return nil
+}
+
+var unitSinks = []string{"api", "measurement_log"}
+
+func (c UnitSystemConfig) validate() error {
+	if err := c.Input.validate(); err != nil {
+		return fmt.Errorf("units: %v", err)
+	}
+	for sink, output := range c.Outputs {
+		if !contains(unitSinks, sink) {
+			return fmt.Errorf("units: unknown output <%s>", sink)
+		}
+		if err := output.validate(); err != nil {
+			return fmt.Errorf("units of %s: %v", sink, err)
+		}
+	}
+	return nil
+}
+
+// inputFor returns the units a sensor reports in.
+func (c UnitSystemConfig) inputFor(sensor SensorConfig) UnitsConfig {
+	input := c.Input
+	if sensor.Units != nil {
+		for _, override := range []struct{ unit, by *string }{
+			{&input.Temperature, &sensor.Units.Temperature},
+			{&input.Pressure, &sensor.Units.Pressure},
+			{&input.WindSpeed, &sensor.Units.WindSpeed},
+			{&input.Rain, &sensor.Units.Rain},
+		} {
+			if *override.by != "" {
+				*override.unit = *override.by
+			}
+		}
+	}
+	return input
+}
+
+// convertUnits converts the values of a measurement between the units of the
+// bridge and those in config, to the bridge when inbound is set.
+func convertUnits(data *MeasurementData, config UnitsConfig, inbound bool) {
+	byMetric := config.byMetric()
+	var metrics []string
+	for metric, unit := range byMetric {
+		if unit != "" {
+			metrics = append(metrics, metric)
+		}
+	}
+	if len(metrics) == 0 {
+		return
+	}
+
+	convert := func(metric string, value float64) float64 {
+		conversion := unitConversions[metric][byMetric[metric]]
+		if inbound {
+			return conversion.from(value)
+		}
+		return conversion.to(value)
+	}
+
+	mapValues(data, metrics, convert)
+
+	// Probes are all temperatures
+	if len(data.Probes) != 0 && config.Temperature != "" {
+		probes := make(map[string]float32, len(data.Probes))
+		for name, value := range data.Probes {
+			probes[name] = float32(convert("temperature", float64(value)))
+		}
+		data.Probes = probes
+	}
+}
+
+// normalizeUnits converts what a sensor reported to the units of the bridge.
+func normalizeUnits(data *MeasurementData, input UnitsConfig) {
+	convertUnits(data, input, true)
+}
+
+// outputUnits returns a measurement converted for a sink. The values of the
+// measurement are replaced rather than changed, the store shares them.
+func outputUnits(measurement Measurement, config UnitSystemConfig, sink string) Measurement {
+	if output, ok := config.Outputs[sink]; ok {
+		convertUnits(&measurement.MeasurementData, output, false)
+	}
+	return measurement
+}
+
+// outputStateUnits converts the latest measurement of a sensor for the API.
+func outputStateUnits(state SensorState, config UnitSystemConfig) SensorState {
+	if state.Measurement != nil {
+		measurement := outputUnits(*state.Measurement, config, "api")
+		state.Measurement = &measurement
+	}
+	return state
+}